@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/api"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	controlplane "github.com/khulnasoft/next.vim/arcadevim/pkg/control-plane"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/ctrlc"
 	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 	prettylog "github.com/khulnasoft/next.vim/arcadevim/pkg/pretty-log"
@@ -25,9 +27,11 @@ func main() {
         assert.Never("debug log should never be specified for a dummy server")
     }
 
+    // game servers on another host report over the control plane, only the
+    // ones sharing the matchmaker's disk write to the database
+    controlPlane := controlplane.AddrFromEnv()
     sqlitePath := os.Getenv("SQLITE")
-    assert.Assert(sqlitePath != "", "you must provide a sqlite env variable to run the simulation dummy server")
-    sqlitePath = gameserverstats.EnsureSqliteURI(sqlitePath)
+    assert.Assert(controlPlane != "" || sqlitePath != "", "you must provide a control plane or sqlite env variable to run the simulation dummy server")
 
     prettylog.CreateLoggerFromEnv(os.Stderr)
     slog.SetDefault(slog.Default().With("process", fmt.Sprintf("DummyServer-%s", getId())))
@@ -35,10 +39,27 @@ func main() {
     ll :=  slog.Default().With("area", "dummy-server")
     ll.Warn("dummy-server initializing...")
 
-    db := gameserverstats.NewSqlite(sqlitePath)
-    db.SetSqliteModes()
+    var reporter gameserverstats.GameServerReporter
+    var client *controlplane.Client
+    if controlPlane != "" {
+        ll.Info("reporting over the control plane", "addr", controlPlane)
+        client = controlplane.NewClient(controlPlane, controlplane.TokenFromEnv())
+        defer client.Close()
+        reporter = client
+    } else {
+        db := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(sqlitePath))
+        db.SetSqliteModes()
+        defer db.Close()
+        reporter = db
+    }
+
     host, port := api.GetHostAndPort()
 
+    visibility := gameserverstats.VisibilityPublic
+    if os.Getenv("PRIVATE") == "true" {
+        visibility = gameserverstats.VisibilityPrivate
+    }
+
     config := gameserverstats.GameServerConfig {
         State: gameserverstats.GSStateReady,
         Connections: 0,
@@ -46,15 +67,18 @@ func main() {
         Id: getId(),
         Host: host,
         Port: port,
+        GameType: os.Getenv("GAME_TYPE"),
+        Region: os.Getenv("REGION"),
+        Visibility: visibility,
     }
 
     ll.Info("creating server", "port", port, "host", host)
-    server := api.NewGameServerRunner(db, config)
+    heartbeat, _ := strconv.ParseInt(os.Getenv("STATS_HEARTBEAT_MS"), 10, 64)
+    server := api.NewGameServerRunner(reporter, config).WithHeartbeat(heartbeat)
     ctx, cancel := context.WithCancel(context.Background())
     ctrlc.HandleCtrlC(cancel)
 
     defer server.Close()
-    go db.Run(ctx)
     go func () {
         ll.Info("running server", "port", port, "host", host)
         err := server.Run(ctx)
@@ -66,5 +90,11 @@ func main() {
 
     server.Wait()
     cancel()
+
+    if client != nil {
+        if err := client.Deregister("game server finished"); err != nil {
+            ll.Error("unable to deregister from the control plane", "error", err)
+        }
+    }
     ll.Error("dummy game server finished")
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+// replays every state change of one game server, oldest first
+func main() {
+    path := ""
+    server := ""
+    flag.StringVar(&path, "sqlite", os.Getenv("SQLITE"), "the stats database, defaults to SQLITE")
+    flag.StringVar(&server, "server", "", "the game server to replay")
+    flag.Parse()
+
+    assert.Assert(path != "", "expected --sqlite or SQLITE to be provided")
+    assert.Assert(server != "", "expected --server to be provided")
+
+    db := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(path))
+    defer db.Close()
+
+    events, err := db.GetLifecycleEvents(server)
+    assert.NoError(err, "unable to read lifecycle events", "server", server)
+
+    if len(events) == 0 {
+        fmt.Fprintf(os.Stderr, "no lifecycle events for server %s\n", server)
+        os.Exit(1)
+    }
+
+    out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(out, "TIME\tELAPSED\tSOURCE\tSTATE\tCONNS\tADDED\tREMOVED\tREASON")
+
+    start := events[0].AtMS
+    for _, e := range events {
+        fmt.Fprintf(out, "%s\t+%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+            time.UnixMilli(e.AtMS).UTC().Format(time.RFC3339Nano),
+            time.Duration(e.AtMS-start)*time.Millisecond,
+            e.Source,
+            e.State,
+            e.Connections,
+            e.ConnectionsAdded,
+            e.ConnectionsRemoved,
+            e.Reason,
+        )
+    }
+    out.Flush()
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 
 	"github.com/joho/godotenv"
+	controlplane "github.com/khulnasoft/next.vim/arcadevim/pkg/control-plane"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/ctrlc"
 	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/pretty-log"
@@ -33,10 +34,21 @@ func main() {
         os.Exit(1)
     }
 
-    db := gameserverstats.NewSqlite("file:/tmp/sim.db")
+    reaper := gameserverstats.ReaperParamsFromEnv()
+    db := gameserverstats.NewSqlite("file:/tmp/sim.db").WithStaleAfter(reaper.StaleAfterMS)
     db.SetSqliteModes()
+
+    // game servers without a control plane write to the database file
+    // themselves, the only way to see their writes is to poll it
+    controlPort, controlErr := strconv.Atoi(os.Getenv("CONTROL_PLANE_PORT"))
+    if controlErr != nil {
+        db.WithPolling(gameserverstats.DefaultPollIntervalMS)
+    }
     local := servermanagement.NewLocalServers(db, servermanagement.ServerParams{
         MaxLoad: 0.9,
+        Supervisor: servermanagement.SupervisorParams{
+            Restart: servermanagement.RestartPolicy(os.Getenv("RESTART_POLICY")),
+        },
     })
     mm := matchmaking.NewMatchMakingServer(matchmaking.MatchMakingServerParams{
         Port: port,
@@ -47,6 +59,15 @@ func main() {
     ctrlc.HandleCtrlC(cancel)
 
     go db.Run(ctx)
+    go gameserverstats.NewSampler(db, gameserverstats.SamplerParamsFromEnv()).Run(ctx)
+    go gameserverstats.NewReaper(db, reaper).Run(ctx)
+
+    // game servers on other hosts register here instead of opening the
+    // database
+    if controlErr == nil {
+        go controlplane.NewListener(db, uint16(controlPort), controlplane.TokenFromEnv()).Run(ctx)
+    }
+
     err = mm.Run(ctx)
 
     logger.Warn("mm main finished", "error", err)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+func formatTime(ms int64) string {
+    return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+func formatLoad(load float32) string {
+    return strconv.FormatFloat(float64(load), 'f', 4, 32)
+}
+
+func writeServer(out *csv.Writer, samples []gameserverstats.Sample) {
+    out.Write([]string{"time", "server", "resolution_ms", "state", "connections", "connections_added", "connections_removed", "load", "game_type", "region"})
+    for _, s := range samples {
+        out.Write([]string{
+            formatTime(s.SampledMS),
+            s.GameServerId,
+            strconv.FormatInt(s.ResolutionMS, 10),
+            strconv.Itoa(int(s.State)),
+            strconv.Itoa(s.Connections),
+            strconv.Itoa(s.ConnectionsAdded),
+            strconv.Itoa(s.ConnectionsRemoved),
+            formatLoad(s.Load),
+            s.GameType,
+            s.Region,
+        })
+    }
+}
+
+func writeFleet(out *csv.Writer, samples []gameserverstats.FleetSample) {
+    out.Write([]string{"time", "servers", "connections", "load"})
+    for _, s := range samples {
+        out.Write([]string{
+            formatTime(s.SampledMS),
+            strconv.Itoa(s.Servers),
+            strconv.Itoa(s.Connections),
+            formatLoad(s.Load),
+        })
+    }
+}
+
+// prints the game server history as csv, the whole fleet unless --server is
+// given
+func main() {
+    path := ""
+    server := ""
+    since := time.Hour
+    until := time.Duration(0)
+    flag.StringVar(&path, "sqlite", os.Getenv("SQLITE"), "the stats database, defaults to SQLITE")
+    flag.StringVar(&server, "server", "", "the game server to print, the whole fleet when empty")
+    flag.DurationVar(&since, "since", since, "how far back to start")
+    flag.DurationVar(&until, "until", until, "how far back to stop, 0 is now")
+    flag.Parse()
+
+    assert.Assert(path != "", "expected --sqlite or SQLITE to be provided")
+
+    now := time.Now()
+    from := now.Add(-since).UnixMilli()
+    to := now.Add(-until).UnixMilli() + 1
+
+    db := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(path))
+    defer db.Close()
+
+    out := csv.NewWriter(os.Stdout)
+    if server != "" {
+        samples, err := db.GetServerSamples(server, from, to)
+        assert.NoError(err, "unable to read server samples", "server", server)
+        writeServer(out, samples)
+    } else {
+        samples, err := db.GetFleetSamples(from, to)
+        assert.NoError(err, "unable to read fleet samples")
+        writeFleet(out, samples)
+    }
+
+    out.Flush()
+    if err := out.Error(); err != nil {
+        fmt.Fprintf(os.Stderr, "unable to write csv: %s\n", err)
+        os.Exit(1)
+    }
+}
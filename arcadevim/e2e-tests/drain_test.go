@@ -0,0 +1,119 @@
+package e2etests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/khulnasoft/next.vim/arcadevim/e2e-tests/sim"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+func drainProgress(t *testing.T, adminURL string) amproxy.DrainProgress {
+    rsp, err := http.Get(adminURL + "/drain")
+    require.NoError(t, err)
+    defer rsp.Body.Close()
+
+    progress := amproxy.DrainProgress{}
+    require.NoError(t, json.NewDecoder(rsp.Body).Decode(&progress))
+    return progress
+}
+
+func TestProxyDrain(t *testing.T) {
+    sim.CreateLogger("TestProxyDrain")
+    ctx, cancel := context.WithCancel(context.Background())
+    sim.KillContext(cancel)
+
+    path := sim.GetDBPath("no_server")
+    state := sim.CreateEnvironment(ctx, path, servermanagement.ServerParams{
+        MaxLoad: 0.9,
+    })
+    t.Cleanup(func() {cancel()})
+
+    clients := state.Factory.CreateBatchedConnections(2)
+    sim.AssertClients(&state, clients)
+
+    adminURL := fmt.Sprintf("http://127.0.0.1:%d", state.AdminPort)
+    rsp, err := http.Post(adminURL + "/drain?timeoutMS=250", "application/json", nil)
+    require.NoError(t, err)
+    rsp.Body.Close()
+    require.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+    // the listener is gone as soon as the drain starts
+    _, err = net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", state.Port))
+    require.Error(t, err)
+
+    progress := drainProgress(t, adminURL)
+    require.True(t, progress.Draining)
+    require.Equal(t, 2, progress.Remaining)
+
+    // nobody leaves on their own so the deadline closes them
+    for _, c := range clients {
+        c.WaitForDone()
+        require.Equal(t, amproxy.AMProxyShuttingDown.Error(), c.CloseReason)
+    }
+
+    require.Eventually(t, func() bool {
+        return drainProgress(t, adminURL).Done
+    }, time.Second, time.Millisecond * 50)
+
+    progress = drainProgress(t, adminURL)
+    require.True(t, progress.Forced)
+    require.Equal(t, 0, progress.Remaining)
+
+    sim.AssertConnectionCount(&state, gameserverstats.GameServecConfigConnectionStats{
+        Connections: 0,
+        ConnectionsAdded: 2,
+        ConnectionsRemoved: 2,
+    }, time.Second * 2)
+
+    // the proxy and the game server both saw each client leave and why
+    for _, c := range clients {
+        require.Eventually(t, func() bool {
+            sessions, err := state.Sqlite.GetPlayerSessions(c.Id())
+            require.NoError(t, err)
+            if len(sessions) != 2 {
+                return false
+            }
+            for _, s := range sessions {
+                if s.Connected() || s.Reason != amproxy.AMProxyShuttingDown.Error() {
+                    return false
+                }
+            }
+            return sessions[0].Source != sessions[1].Source
+        }, time.Second * 2, time.Millisecond * 50)
+    }
+}
+
+func TestProxyDrainOnSignal(t *testing.T) {
+    sim.CreateLogger("TestProxyDrainOnSignal")
+    ctx, cancel := context.WithCancel(context.Background())
+    sim.KillContext(cancel)
+
+    path := sim.GetDBPath("no_server")
+    state := sim.CreateEnvironment(ctx, path, servermanagement.ServerParams{
+        MaxLoad: 0.9,
+    })
+    t.Cleanup(func() {cancel()})
+
+    clients := state.Factory.CreateBatchedConnections(1)
+    sim.AssertClients(&state, clients)
+
+    require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+
+    adminURL := fmt.Sprintf("http://127.0.0.1:%d", state.AdminPort)
+    require.Eventually(t, func() bool {
+        return drainProgress(t, adminURL).Draining
+    }, time.Second, time.Millisecond * 10)
+
+    _, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", state.Port))
+    require.Error(t, err)
+}
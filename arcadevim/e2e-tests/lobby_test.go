@@ -0,0 +1,56 @@
+package e2etests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/khulnasoft/next.vim/arcadevim/e2e-tests/sim"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/api"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+func TestPrivateLobby(t *testing.T) {
+    sim.CreateLogger("TestPrivateLobby")
+    ctx, cancel := context.WithCancel(context.Background())
+    sim.KillContext(cancel)
+
+    path := sim.GetDBPath("no_server")
+    state := sim.CreateEnvironment(ctx, path, servermanagement.ServerParams{
+        MaxLoad: 0.9,
+    })
+    t.Cleanup(func() {cancel()})
+
+    owner := state.Factory.NewWith(func(c *api.Client) {
+        c.CreateLobby = true
+    })
+    require.NotEqual(t, "", owner.LobbyCode)
+
+    private := state.Sqlite.GetById(owner.ServerId)
+    require.NotNil(t, private)
+    require.Equal(t, gameserverstats.VisibilityPrivate, private.Visibility)
+
+    // matchmaking never sees the private server
+    public := state.Factory.New()
+    require.NotEqual(t, owner.ServerId, public.ServerId)
+
+    friend := state.Factory.NewWith(func(c *api.Client) {
+        c.JoinLobby = owner.LobbyCode
+    })
+    require.Equal(t, owner.ServerId, friend.ServerId)
+    require.Equal(t, owner.LobbyCode, friend.LobbyCode)
+
+    lobby, err := state.Sqlite.GetLobby(owner.LobbyCode)
+    require.NoError(t, err)
+    require.NotNil(t, lobby)
+    require.Equal(t, owner.Id(), lobby.Owner)
+
+    owner.Disconnect()
+    friend.Disconnect()
+    require.Eventually(t, func() bool {
+        lobby, err := state.Sqlite.GetLobby(owner.LobbyCode)
+        return err == nil && lobby == nil
+    }, time.Second * 2, time.Millisecond * 50)
+}
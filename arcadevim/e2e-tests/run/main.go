@@ -33,8 +33,6 @@ func main() {
 
     sqlite := gameserverstats.NewSqlite("file:" + name)
     sqlite.SetSqliteModes()
-    err = sqlite.CreateGameServerConfigs()
-    assert.NoError(err, "unable to create game server config")
 
     for _, c := range config.servers {
         fmt.Printf("inserting: %+v\n", c)
@@ -160,6 +160,7 @@ func (f *TestingClientFactory) CreateBatchedConnectionsWithWait(count int, wait
 
 func (f *TestingClientFactory) CreateBatchedConnections(count int) []*api.Client {
 	wait := &sync.WaitGroup{}
+	wait.Add(count)
 	clients := f.CreateBatchedConnectionsWithWait(count, wait)
 
 	f.logger.Info("CreateBatchedConnections waiting", "count", count)
@@ -174,7 +175,14 @@ func (f TestingClientFactory) WithPort(port uint16) TestingClientFactory {
 }
 
 func (f *TestingClientFactory) New() *api.Client {
+	return f.NewWith(func(*api.Client) {})
+}
+
+// NewWith lets the client be configured, party, lobby, etc, before it
+// connects
+func (f *TestingClientFactory) NewWith(setup func(client *api.Client)) *api.Client {
 	client := api.NewClient(f.host, f.port, getNextId())
+	setup(&client)
 	f.logger.Info("factory connecting", "id", client.Id())
 	client.Connect(context.Background())
     client.WaitForReady()
@@ -183,6 +191,7 @@ func (f *TestingClientFactory) New() *api.Client {
 }
 
 // this is getting hacky...
+// the caller has already added the client to wait, it is done once connected
 func (f *TestingClientFactory) NewWait(wait *sync.WaitGroup) *api.Client {
 	client := api.NewClient(f.host, f.port, [16]byte(getNextId()))
 
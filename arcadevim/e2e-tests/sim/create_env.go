@@ -2,14 +2,17 @@ package sim
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path"
+	"syscall"
 
 	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/api"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	controlplane "github.com/khulnasoft/next.vim/arcadevim/pkg/control-plane"
 	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
 )
@@ -21,7 +24,7 @@ type ServerCreationConfig struct {
 
 func createServer(ctx context.Context, server *ServerState, logger *slog.Logger) (string, *gameserverstats.GameServerConfig) {
     logger.Info("creating server")
-    sId, err := server.Server.CreateNewServer(ctx)
+    sId, err := server.Server.CreateNewServer(ctx, gameserverstats.MatchRequest{})
     logger.Info("created server", "id", sId, "err", err)
     assert.NoError(err, "unable to create server")
     logger.Info("waiting server...", "id", sId)
@@ -114,15 +117,39 @@ func CreateEnvironment(ctx context.Context, path string, params servermanagement
 
     logger.Info("creating sqlite", "path", path)
     sqlite := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(path))
+
+    // the game servers report through the control plane like they would from
+    // another host, only the matchmaker touches the database
+    controlPort, err := api.GetFreePort()
+    assert.NoError(err, "unable to get a free control plane port")
+    os.Setenv("CONTROL_PLANE_TOKEN", "e2e-control-plane")
+    control := controlplane.NewListener(sqlite, uint16(controlPort), controlplane.TokenFromEnv())
+    go control.Run(ctx)
+    control.WaitForReady(ctx)
+    os.Setenv("CONTROL_PLANE", fmt.Sprintf("127.0.0.1:%d", controlPort))
+
     logger.Info("creating local servers", "params", params)
     local := servermanagement.NewLocalServers(sqlite, params)
     logger.Info("creating matchmaking", "port", port)
 
-    proxy := amproxy.NewAMProxy(ctx, &local, amproxy.CreateTCPConnectionFrom)
+    config := amproxy.AMProxyConfigFromEnv()
+    if config.AdminPort == 0 {
+        config.AdminPort, err = api.GetFreePort()
+        assert.NoError(err, "unable to get a free admin port")
+    }
+
+    proxy := amproxy.NewAMProxy(ctx, &local, amproxy.CreateTCPConnectionFrom, config)
+    proxy.WithAuthenticator(amproxy.AuthenticatorFromEnv())
+    proxy.WithLobbies(sqlite)
+    proxy.WithPlayerSessions(sqlite)
+    proxy.WithMetrics(local.Autoscaler())
     tcpProxy := amproxy.NewTCPProxy(&proxy, uint16(port))
     go tcpProxy.Run(ctx)
     tcpProxy.WaitForReady(ctx)
 
+    // a deploy drains the proxy with SIGUSR1 or POST /drain on the admin api
+    tcpProxy.DrainOnSignal(ctx, syscall.SIGUSR1)
+
     logger.Info("creating client factory", "port", port)
     factory := NewTestingClientFactory("0.0.0.0", uint16(port), logger)
 
@@ -132,6 +159,7 @@ func CreateEnvironment(ctx context.Context, path string, params servermanagement
         Server: &local,
         Proxy: &tcpProxy,
         Port: port,
+        AdminPort: config.AdminPort,
         Factory: &factory,
         Conns: nil,
     }
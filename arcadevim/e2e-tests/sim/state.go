@@ -1,6 +1,7 @@
 package sim
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -14,12 +15,14 @@ import (
 )
 
 type ServerState struct {
-	Sqlite  *gameserverstats.Sqlite
-	Server  *servermanagement.LocalServers
-	Proxy   *amproxy.AMTCPProxy
-	Port    int
-	Factory *TestingClientFactory
-	Conns   ConnMap
+	Sqlite *gameserverstats.Sqlite
+	Server *servermanagement.LocalServers
+	Proxy  *amproxy.AMTCPProxy
+	Port   int
+	// the proxy admin http api
+	AdminPort int
+	Factory   *TestingClientFactory
+	Conns     ConnMap
 }
 
 func (s *ServerState) Close() {
@@ -84,14 +87,21 @@ func (s *ServerStateWaiter) WaitForRound(added, removed int, t time.Duration) {
 	s.conns.ConnectionsRemoved += removed
 	s.conns.ConnectionsAdded += added
 
-	start := time.Now()
-	for time.Now().Sub(start).Milliseconds() < t.Milliseconds() {
-		conns := s.Stats.GetTotalConnectionCount()
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
 
+	events := s.Stats.Watch(ctx)
+	for {
+		conns := s.Stats.GetTotalConnectionCount()
 		if conns.Equal(&s.conns) {
-			break
+			return
+		}
+
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return
 		}
-		<-time.NewTimer(time.Millisecond * 250).C
 	}
 }
 
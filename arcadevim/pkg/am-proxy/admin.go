@@ -0,0 +1,112 @@
+package amproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminDrain struct {
+	Id          string `json:"id"`
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Default().With("area", "AMProxyAdmin").Error("unable to write response", "error", err)
+	}
+}
+
+// NewAdminHandler is the admin http api of the proxy
+//
+//	GET    /connections             live connections and their game servers
+//	POST   /connections/{id}/kick   disconnect a connection
+//	POST   /servers/{id}/drain      stop sending new clients to a game server
+//	DELETE /servers/{id}/drain      start sending clients to it again
+//	GET    /stats                   AMProxyStats as json
+//	GET    /metrics                 prometheus metrics
+//
+// with an AdminToken configured every request needs it as a bearer token
+func NewAdminHandler(proxy *AMProxy) http.Handler {
+	return withAdminToken(proxy.config.AdminToken, newAdminMux(proxy))
+}
+
+func newAdminMux(proxy *AMProxy) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, proxy.Connections())
+	})
+
+	mux.HandleFunc("POST /connections/{id}/kick", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "connection id must be a number"})
+			return
+		}
+
+		err = proxy.Kick(id)
+		if errors.Is(err, AMProxyConnectionNotFound) {
+			writeJSON(w, http.StatusNotFound, adminError{Error: err.Error()})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /servers/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		writeJSON(w, http.StatusOK, adminDrain{
+			Id:          id,
+			Draining:    true,
+			Connections: proxy.DrainServer(id),
+		})
+	})
+
+	mux.HandleFunc("DELETE /servers/{id}/drain", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		writeJSON(w, http.StatusOK, adminDrain{
+			Id:          id,
+			Draining:    false,
+			Connections: proxy.UndrainServer(id),
+		})
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, proxy.Stats())
+	})
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		proxy.WriteMetrics(w)
+	})
+
+	return mux
+}
+
+func withAdminToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, adminError{Error: "admin token required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package amproxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+func adminRequest(t *testing.T, method string, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { rsp.Body.Close() })
+	return rsp
+}
+
+func adminConnections(t *testing.T, url string) []amproxy.ConnectionInfo {
+	rsp := adminRequest(t, http.MethodGet, url+"/connections")
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	conns := []amproxy.ConnectionInfo{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&conns))
+	return conns
+}
+
+func TestAdminKick(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, queueConfig())
+	admin := httptest.NewServer(amproxy.NewAdminHandler(&proxy))
+	defer admin.Close()
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	require.Equal(t, "0", packet.ServerAuthGameId(nextPacket(t, framer)))
+
+	conns := adminConnections(t, admin.URL)
+	require.Len(t, conns, 1)
+	require.Equal(t, "0", conns[0].GameServerId)
+	require.Equal(t, "00000000000000000000000000000000", conns[0].ClientId)
+	require.False(t, conns[0].Parked)
+
+	rsp := adminRequest(t, http.MethodPost, admin.URL+"/connections/69/kick")
+	require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	rsp = adminRequest(t, http.MethodPost, admin.URL+"/connections/nice/kick")
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+	rsp = adminRequest(t, http.MethodPost, admin.URL+"/connections/1/kick")
+	require.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	requireErrorPacket(t, framer, amproxy.AMProxyKicked)
+
+	require.Eventually(t, func() bool {
+		return len(adminConnections(t, admin.URL)) == 0
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestAdminDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	games := newGameConns()
+	servers := &fakeGameServers{capacity: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, games.factory, queueConfig())
+	admin := httptest.NewServer(amproxy.NewAdminHandler(&proxy))
+	defer admin.Close()
+
+	first, firstFramer := addPipeConnection(t, &proxy)
+	authenticate(t, first)
+	require.Equal(t, "0", packet.ServerAuthGameId(nextPacket(t, firstFramer)))
+
+	rsp := adminRequest(t, http.MethodPost, admin.URL+"/servers/0/drain")
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	drain := map[string]any{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&drain))
+	require.Equal(t, true, drain["draining"])
+	require.Equal(t, float64(1), drain["connections"])
+
+	// the drained server is skipped so a new one gets created
+	second, secondFramer := addPipeConnection(t, &proxy)
+	authenticate(t, second)
+	require.Equal(t, "1", packet.ServerAuthGameId(nextPacket(t, secondFramer)))
+
+	rsp = adminRequest(t, http.MethodDelete, admin.URL+"/servers/0/drain")
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+type extraMetrics struct{}
+
+func (extraMetrics) WriteMetrics(w io.Writer) {
+	io.WriteString(w, "extra_metric 1\n")
+}
+
+func TestAdminMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, queueConfig())
+	proxy.WithMetrics(extraMetrics{})
+	admin := httptest.NewServer(amproxy.NewAdminHandler(&proxy))
+	defer admin.Close()
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	nextPacket(t, framer)
+	game := games.next(t)
+
+	msg := packet.CreateMessage("hello")
+	_, err := msg.Into(client)
+	require.NoError(t, err)
+	require.Equal(t, "hello", mustDecodeMessage(t, nextPacket(t, game)))
+
+	rsp := adminRequest(t, http.MethodGet, admin.URL+"/metrics")
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+
+	metrics := string(body)
+	require.Contains(t, metrics, "amproxy_connections_active 1\n")
+	require.Contains(t, metrics, "amproxy_connections_total 1\n")
+	require.Contains(t, metrics, `amproxy_packets_total{from="client",type="Message"} 1`+"\n")
+	require.Contains(t, metrics, `amproxy_bytes_total{from="client"} 9`+"\n")
+	require.Contains(t, metrics, `amproxy_matchmaking_seconds_bucket{le="+Inf"} 1`+"\n")
+	require.Contains(t, metrics, "amproxy_matchmaking_seconds_count 1\n")
+	require.Contains(t, metrics, "amproxy_queue_depth 0\n")
+	require.Contains(t, metrics, "extra_metric 1\n")
+}
+
+func TestAdminToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.AdminToken = "operator"
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, config)
+	tcp := amproxy.NewTCPProxy(&proxy, freePort(t))
+	admin := httptest.NewServer(tcp.AdminHandler())
+	defer admin.Close()
+
+	for _, path := range []string{"/connections", "/drain"} {
+		rsp := adminRequest(t, http.MethodGet, admin.URL+path)
+		require.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+		req, err := http.NewRequest(http.MethodGet, admin.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer guessed")
+		rsp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+		req.Header.Set("Authorization", "Bearer operator")
+		rsp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, http.StatusOK, rsp.StatusCode)
+	}
+}
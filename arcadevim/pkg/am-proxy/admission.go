@@ -0,0 +1,193 @@
+package amproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+)
+
+var AMProxyAtCapacity = fmt.Errorf("the proxy is at capacity, please try again later")
+var AMProxyTooManyFromIP = fmt.Errorf("too many connections from your address")
+var AMProxyRateLimited = fmt.Errorf("too many connection attempts, please try again later")
+
+// buckets that are full are forgotten once there are this many of them
+const maxIdleBuckets = 4096
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	t.tokens = min(burst, t.tokens+now.Sub(t.last).Seconds()*rate)
+	t.last = now
+}
+
+func parseNetList(list []string) []*net.IPNet {
+	out := []*net.IPNet{}
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			assert.NotNil(ip, "invalid ip in allow/deny list", "entry", entry)
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		assert.NoError(err, "invalid cidr in allow/deny list", "entry", entry)
+		out = append(out, ipNet)
+	}
+	return out
+}
+
+func containsIP(list []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range list {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// AdmissionControl decides if a new connection is allowed onto the proxy.
+// every Admit that succeeds must be paired with a Release
+type AdmissionControl struct {
+	config AMProxyConfig
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+
+	mutex   sync.Mutex
+	active  int
+	perIP   map[string]int
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func NewAdmissionControl(config AMProxyConfig) *AdmissionControl {
+	return &AdmissionControl{
+		config:  config,
+		allow:   parseNetList(config.AllowList),
+		deny:    parseNetList(config.DenyList),
+		mutex:   sync.Mutex{},
+		perIP:   map[string]int{},
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// WithClock is for testing the connect rate limits
+func (a *AdmissionControl) WithClock(now func() time.Time) *AdmissionControl {
+	a.now = now
+	return a
+}
+
+func (a *AdmissionControl) rateLimited(host string, now time.Time) bool {
+	if a.config.ConnectRatePerSecond <= 0 {
+		return false
+	}
+
+	rate := float64(a.config.ConnectRatePerSecond)
+	burst := float64(max(a.config.ConnectBurst, 1))
+
+	bucket, ok := a.buckets[host]
+	if !ok {
+		if len(a.buckets) >= maxIdleBuckets {
+			a.forgetFullBuckets(now, rate, burst)
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		a.buckets[host] = bucket
+	}
+
+	bucket.refill(now, rate, burst)
+	if bucket.tokens < 1 {
+		return true
+	}
+
+	bucket.tokens--
+	return false
+}
+
+func (a *AdmissionControl) forgetFullBuckets(now time.Time, rate float64, burst float64) {
+	for host, bucket := range a.buckets {
+		bucket.refill(now, rate, burst)
+		if bucket.tokens >= burst {
+			delete(a.buckets, host)
+		}
+	}
+}
+
+func (a *AdmissionControl) Admit(addr string) error {
+	host := hostFromAddr(addr)
+	ip := net.ParseIP(host)
+
+	if containsIP(a.deny, ip) {
+		return AMProxyDisallowed
+	}
+
+	if len(a.allow) > 0 && !containsIP(a.allow, ip) {
+		return AMProxyDisallowed
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.rateLimited(host, a.now()) {
+		return AMProxyRateLimited
+	}
+
+	if a.config.MaxConnections > 0 && a.active >= a.config.MaxConnections {
+		return AMProxyAtCapacity
+	}
+
+	if a.config.MaxConnectionsPerIP > 0 && a.perIP[host] >= a.config.MaxConnectionsPerIP {
+		return AMProxyTooManyFromIP
+	}
+
+	a.active++
+	a.perIP[host]++
+	return nil
+}
+
+func (a *AdmissionControl) Release(addr string) {
+	host := hostFromAddr(addr)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	assert.Assert(a.active > 0, "released more connections than were admitted", "addr", addr)
+	a.active--
+	a.perIP[host]--
+	if a.perIP[host] <= 0 {
+		delete(a.perIP, host)
+	}
+}
+
+func (a *AdmissionControl) Active() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.active
+}
@@ -0,0 +1,77 @@
+package amproxy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+)
+
+func TestAdmissionLists(t *testing.T) {
+	admit := amproxy.NewAdmissionControl(amproxy.AMProxyConfig{
+		AllowList: []string{"10.0.0.0/8", "192.168.1.1"},
+		DenyList:  []string{"10.0.0.69"},
+	})
+
+	require.NoError(t, admit.Admit("10.1.2.3:4000"))
+	require.NoError(t, admit.Admit("192.168.1.1:4000"))
+	require.ErrorIs(t, admit.Admit("10.0.0.69:4000"), amproxy.AMProxyDisallowed)
+	require.ErrorIs(t, admit.Admit("192.168.1.2:4000"), amproxy.AMProxyDisallowed)
+	require.Equal(t, 2, admit.Active())
+}
+
+func TestAdmissionCaps(t *testing.T) {
+	admit := amproxy.NewAdmissionControl(amproxy.AMProxyConfig{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+	})
+
+	require.NoError(t, admit.Admit("1.1.1.1:1"))
+	require.NoError(t, admit.Admit("1.1.1.1:2"))
+	require.ErrorIs(t, admit.Admit("1.1.1.1:3"), amproxy.AMProxyTooManyFromIP)
+	require.NoError(t, admit.Admit("2.2.2.2:1"))
+	require.ErrorIs(t, admit.Admit("3.3.3.3:1"), amproxy.AMProxyAtCapacity)
+
+	admit.Release("1.1.1.1:1")
+	require.NoError(t, admit.Admit("3.3.3.3:1"))
+	require.ErrorIs(t, admit.Admit("1.1.1.1:4"), amproxy.AMProxyAtCapacity)
+}
+
+func TestAdmissionRateLimit(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	admit := amproxy.NewAdmissionControl(amproxy.AMProxyConfig{
+		ConnectRatePerSecond: 2,
+		ConnectBurst:         2,
+	}).WithClock(func() time.Time { return now })
+
+	require.NoError(t, admit.Admit("1.1.1.1:1"))
+	require.NoError(t, admit.Admit("1.1.1.1:2"))
+	require.ErrorIs(t, admit.Admit("1.1.1.1:3"), amproxy.AMProxyRateLimited)
+	require.NoError(t, admit.Admit("2.2.2.2:1"))
+
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, admit.Admit("1.1.1.1:4"))
+	require.ErrorIs(t, admit.Admit("1.1.1.1:5"), amproxy.AMProxyRateLimited)
+}
+
+func TestAMProxyRejectionStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, nil, nil, amproxy.AMProxyConfig{
+		AuthTimeoutMS:  1000,
+		MaxConnections: 1,
+	})
+
+	addPipeConnection(t, &proxy)
+
+	_, server := pipeConnection(t)
+	require.ErrorIs(t, proxy.Add(server), amproxy.AMProxyAtCapacity)
+
+	stats := proxy.Stats()
+	require.Equal(t, 1, stats.ActiveConnections)
+	require.Equal(t, 1, stats.Rejected)
+	require.Equal(t, 1, stats.RejectedCapacity)
+}
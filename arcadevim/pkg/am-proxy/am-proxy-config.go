@@ -3,12 +3,109 @@ package amproxy
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 )
 
+const DefaultAdminHost = "127.0.0.1"
+const DefaultAuthTimeoutMS = 5000
+const DefaultPartyTimeoutMS = 30000
+
 type AMProxyConfig struct {
+    // how long a new connection has to send its auth, 0 uses
+    // DefaultAuthTimeoutMS
     AuthTimeoutMS int64 `json:"authTimeoutMS"`
+
+    // 0 disables heartbeats
+    HeartbeatIntervalMS int64 `json:"heartbeatIntervalMS"`
+    HeartbeatMissedLimit int `json:"heartbeatMissedLimit"`
+
+    // admission control, 0 means unlimited
+    MaxConnections int `json:"maxConnections"`
+    MaxConnectionsPerIP int `json:"maxConnectionsPerIP"`
+    ConnectRatePerSecond int `json:"connectRatePerSecond"`
+    ConnectBurst int `json:"connectBurst"`
+
+    // ips or cidrs.  an empty allow list allows everyone not denied
+    AllowList []string `json:"allowList"`
+    DenyList []string `json:"denyList"`
+
+    // matchmaking queue for when no game server can be created, a timeout of
+    // 0 means clients wait forever
+    QueueTimeoutMS int64 `json:"queueTimeoutMS"`
+    QueueStatusIntervalMS int64 `json:"queueStatusIntervalMS"`
+    QueueRetryIntervalMS int64 `json:"queueRetryIntervalMS"`
+
+    // one of fill-first, least-loaded, round-robin or consistent-hash
+    ServerSelection string `json:"serverSelection"`
+
+    // how long the game server connection is held for a client that dropped
+    // so it can resume with its session token.  0 disables resuming
+    SessionGraceMS int64 `json:"sessionGraceMS"`
+
+    // port of the admin http api on AMTCPProxy, 0 disables it
+    AdminPort int `json:"adminPort"`
+
+    // the admin api can kick and drain, it only listens on loopback unless
+    // told otherwise.  When a token is set every request has to carry it as
+    // a bearer token
+    AdminHost string `json:"adminHost"`
+    AdminToken string `json:"adminToken"`
+
+    // how long a drain waits on connections before closing them
+    DrainTimeoutMS int64 `json:"drainTimeoutMS"`
+
+    // used when the client auth doesn't ask for a game type or region, empty
+    // matches any server
+    DefaultGameType string `json:"defaultGameType"`
+    DefaultRegion string `json:"defaultRegion"`
+
+    // clients a game server can hold, used to keep room for parties and to
+    // cap lobbies.  0 means servers are only limited by their load and
+    // parties of more than one are refused, without it their seats cannot be
+    // held.
+    //
+    // lobby members are counted by each proxy on its own.  A lobby joined
+    // through more than one proxy can hold more than this and is removed once
+    // the first of those proxies has no members left in it
+    ServerCapacity int `json:"serverCapacity"`
+
+    // how long a party waits on its members before going without them, 0
+    // uses DefaultPartyTimeoutMS
+    PartyTimeoutMS int64 `json:"partyTimeoutMS"`
+
+    // how long a new game server has to become ready.  0 waits for as long
+    // as the proxy is running
+    ServerReadyTimeoutMS int64 `json:"serverReadyTimeoutMS"`
+
+    // which proxy the player sessions of its clients went through, defaults
+    // to the hostname
+    ProxyId string `json:"proxyId"`
+}
+
+func readString(key string, d string) string {
+    vStr := os.Getenv(key)
+    if vStr == "" {
+        return d
+    }
+    return vStr
+}
+
+func hostname() string {
+    name, err := os.Hostname()
+    if err != nil {
+        return ""
+    }
+    return name
+}
+
+func readList(key string) []string {
+    vStr := os.Getenv(key)
+    if vStr == "" {
+        return []string{}
+    }
+    return strings.Split(vStr, ",")
 }
 
 func readInt(key string, d int) int {
@@ -23,9 +120,47 @@ func readInt(key string, d int) int {
     return v
 }
 
+// AuthenticatorFromEnv uses signed tokens when AUTH_HMAC_SECRET is provided
+// and lets everyone in otherwise
+func AuthenticatorFromEnv() Authenticator {
+    secret := os.Getenv("AUTH_HMAC_SECRET")
+    if secret == "" {
+        return AllowAllAuthenticator{}
+    }
+    return NewHMACAuthenticator([]byte(secret))
+}
+
 func AMProxyConfigFromEnv() AMProxyConfig {
+    authTimeoutMS := readInt("AUTH_TIMEOUT_MS", DefaultAuthTimeoutMS)
+    assert.Assert(authTimeoutMS >= 0, "AUTH_TIMEOUT_MS cannot be negative", "authTimeoutMS", authTimeoutMS)
+    partyTimeoutMS := readInt("PARTY_TIMEOUT_MS", DefaultPartyTimeoutMS)
+    assert.Assert(partyTimeoutMS >= 0, "PARTY_TIMEOUT_MS cannot be negative", "partyTimeoutMS", partyTimeoutMS)
+
     return AMProxyConfig{
-        AuthTimeoutMS: int64(readInt("AUTH_TIMEOUT_MS", 5000)),
+        AuthTimeoutMS: int64(authTimeoutMS),
+        HeartbeatIntervalMS: int64(readInt("HEARTBEAT_INTERVAL_MS", 5000)),
+        HeartbeatMissedLimit: readInt("HEARTBEAT_MISSED_LIMIT", 3),
+        MaxConnections: readInt("MAX_CONNECTIONS", 0),
+        MaxConnectionsPerIP: readInt("MAX_CONNECTIONS_PER_IP", 0),
+        ConnectRatePerSecond: readInt("CONNECT_RATE_PER_SEC", 0),
+        ConnectBurst: readInt("CONNECT_BURST", 1),
+        AllowList: readList("ALLOW_LIST"),
+        DenyList: readList("DENY_LIST"),
+        QueueTimeoutMS: int64(readInt("QUEUE_TIMEOUT_MS", 60000)),
+        QueueStatusIntervalMS: int64(readInt("QUEUE_STATUS_INTERVAL_MS", 1000)),
+        QueueRetryIntervalMS: int64(readInt("QUEUE_RETRY_INTERVAL_MS", 1000)),
+        ServerSelection: readString("SERVER_SELECTION", SelectFillFirst),
+        SessionGraceMS: int64(readInt("SESSION_GRACE_MS", 10000)),
+        AdminPort: readInt("ADMIN_PORT", 0),
+        AdminHost: readString("ADMIN_HOST", DefaultAdminHost),
+        AdminToken: readString("ADMIN_TOKEN", ""),
+        DrainTimeoutMS: int64(readInt("DRAIN_TIMEOUT_MS", 30000)),
+        DefaultGameType: readString("DEFAULT_GAME_TYPE", ""),
+        DefaultRegion: readString("DEFAULT_REGION", ""),
+        ServerCapacity: readInt("SERVER_CAPACITY", 0),
+        PartyTimeoutMS: int64(partyTimeoutMS),
+        ServerReadyTimeoutMS: int64(readInt("SERVER_READY_TIMEOUT_MS", 60000)),
+        ProxyId: readString("PROXY_ID", hostname()),
     }
 }
 
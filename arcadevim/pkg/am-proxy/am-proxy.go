@@ -1,36 +1,178 @@
 package amproxy
 
 import (
+	"cmp"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
 )
 
 var AMProxyDisallowed = fmt.Errorf("unable to connnect, please try again later")
+var AMProxyConnectionNotFound = fmt.Errorf("connection not found")
+var AMProxyKicked = fmt.Errorf("you have been disconnected by an administrator")
+var AMProxyShuttingDown = fmt.Errorf("the proxy is shutting down")
+
+// ConnectionInfo is what the admin api knows about a live connection
+type ConnectionInfo struct {
+	Id           uint64    `json:"id"`
+	Addr         string    `json:"addr"`
+	ClientId     string    `json:"clientId"`
+	GameServerId string    `json:"gameServerId"`
+	GameType     string    `json:"gameType"`
+	Region       string    `json:"region"`
+	Party        string    `json:"party"`
+	Lobby        string    `json:"lobby"`
+	Parked       bool      `json:"parked"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+}
 
 type AMConnectionWrapper struct {
+	id          uint64
+	connectedAt time.Time
+
 	cConn AMConnection
 	gConn AMConnection
 
-	ctx    context.Context
-	cancel context.CancelFunc
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cancelCause context.CancelCauseFunc
+
+	cFramer *packet.PacketFramer
+	gFramer *packet.PacketFramer
+
+	// closed once the client connection can no longer be read from
+	cClosed chan struct{}
 
-	cFramer packet.PacketFramer
-	gFramer packet.PacketFramer
+	// the packet version the client authenticated with, every packet the
+	// proxy creates for the client is sent back in this version
+	version uint8
+
+	cBeat heartbeat
+	gBeat heartbeat
 
 	// hell yeah brother
 	gsId string
+
+	// hex of the 16 byte id the client authenticated with
+	clientId string
+
+	// what the client asked to be matched into
+	match gameserverstats.MatchRequest
+	party string
+
+	// join code of the private lobby the client is in
+	lobby string
+
+	// row of the player session, 0 when none is being recorded
+	playerSession    int64
+	disconnectReason string
+
+	// session resume.  once the connection is established these are only
+	// touched by the lifecycle goroutine
+	session SessionToken
+	parked  bool
+	grace   *time.Timer
+	resume  chan *AMConnectionWrapper
+
+	kick chan error
+
+	// closes the connection with a PacketCloseConnection to both sides
+	closeReq chan error
+
+	// guards the fields read by Info, they are only ever written by the
+	// goroutine handling the connection so that goroutine reads them freely
+	mutex sync.Mutex
+
+	closeOnce sync.Once
+
+	// releases the admission of the client connection, this moves with the
+	// client connection when a session is resumed
+	onClose func()
+
+	// called once the connection is completely finished
+	onFinish func()
 }
 
-func (a *AMConnectionWrapper) Close() error {
-	a.cancel()
-	a.cConn.Close()
-	if a.gConn != nil {
-		a.gConn.Close()
+func (a *AMConnectionWrapper) Info() ConnectionInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return ConnectionInfo{
+		Id:           a.id,
+		Addr:         a.cConn.Addr(),
+		ClientId:     a.clientId,
+		GameServerId: a.gsId,
+		GameType:     a.match.GameType,
+		Region:       a.match.Region,
+		Party:        a.party,
+		Lobby:        a.lobby,
+		Parked:       a.parked,
+		ConnectedAt:  a.connectedAt,
+	}
+}
+
+// untilClientCloses is a context that is cancelled as soon as the client
+// connection can no longer be read from
+func (a *AMConnectionWrapper) untilClientCloses() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a.ctx)
+	closed := a.cClosed
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cancelled is the reason the connection was cancelled, nil when nobody gave
+// one
+func (a *AMConnectionWrapper) cancelled() error {
+	cause := context.Cause(a.ctx)
+	if errors.Is(cause, context.Canceled) {
+		return nil
+	}
+	return cause
+}
+
+func (a *AMConnectionWrapper) established() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.gsId != ""
+}
+
+func (a *AMConnectionWrapper) graceExpired() <-chan time.Time {
+	if a.grace == nil {
+		return nil
 	}
+	return a.grace.C
+}
+
+func (a *AMConnectionWrapper) Close() error {
+	a.closeOnce.Do(func() {
+		a.cancel()
+		a.cConn.Close()
+		if a.gConn != nil {
+			a.gConn.Close()
+		}
+		if a.onClose != nil {
+			a.onClose()
+		}
+		if a.onFinish != nil {
+			a.onFinish()
+		}
+	})
 	return nil
 }
 
@@ -38,68 +180,341 @@ type AMProxyStats struct {
 	ActiveConnections int
 	TotalConnections  int
 	Errors            int
+
+	ClientRTT     RTTStats
+	GameServerRTT RTTStats
+
+	Rejected          int
+	RejectedDenied    int
+	RejectedCapacity  int
+	RejectedPerIP     int
+	RejectedRateLimit int
+
+	SessionsParked  int
+	SessionsResumed int
+	SessionsExpired int
+
+	FromClient     TrafficStats
+	FromGameServer TrafficStats
+	Matchmaking    LatencyHistogram
 }
 
-type AMProxy struct {
-	servers GameServer
-	match   *MatchMakingServer
-	factory ConnectionFactory
+func (s *AMProxyStats) reject(err error) {
+	s.Rejected++
+	switch err {
+	case AMProxyDisallowed:
+		s.RejectedDenied++
+	case AMProxyAtCapacity:
+		s.RejectedCapacity++
+	case AMProxyTooManyFromIP:
+		s.RejectedPerIP++
+	case AMProxyRateLimited:
+		s.RejectedRateLimit++
+	}
+}
 
-	logger *slog.Logger
-	ctx    context.Context
-	cancel context.CancelFunc
-	closed bool
-	stats  AMProxyStats
+type AMProxy struct {
+	servers  GameServer
+	match    *MatchMakingServer
+	factory  ConnectionFactory
+	config   AMProxyConfig
+	auth     Authenticator
+	admit    *AdmissionControl
+	sessions *sessionStore
+
+	logger     *slog.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closed     bool
+	stats      AMProxyStats
+	statsMutex sync.Mutex
+
+	connsMutex sync.Mutex
+	conns      map[uint64]*AMConnectionWrapper
+	nextConnId uint64
+
+	draining atomic.Bool
+
+	lobbies      gameserverstats.LobbyStore
+	lobbyMutex   sync.Mutex
+	lobbyMembers map[string]int
+
+	players gameserverstats.PlayerSessionStore
+
+	metrics []MetricsWriter
 }
 
-func NewAMProxy(outer context.Context, servers GameServer, factory ConnectionFactory) AMProxy {
+func NewAMProxy(outer context.Context, servers GameServer, factory ConnectionFactory, config AMProxyConfig) AMProxy {
+	assert.Assert(config.AuthTimeoutMS >= 0, "auth timeout cannot be negative", "authTimeoutMS", config.AuthTimeoutMS)
+	if config.AuthTimeoutMS == 0 {
+		config.AuthTimeoutMS = DefaultAuthTimeoutMS
+	}
+
 	ctx, cancel := context.WithCancel(outer)
 	return AMProxy{
-		servers: servers,
-		match:   NewMatchMakingServer(servers),
-		factory: factory,
+		servers:  servers,
+		match:    NewMatchMakingServer(ctx, servers, config),
+		factory:  factory,
+		config:   config,
+		auth:     AllowAllAuthenticator{},
+		admit:    NewAdmissionControl(config),
+		sessions: newSessionStore(),
+
+		logger:     slog.Default().With("area", "AMProxy"),
+		ctx:        ctx,
+		cancel:     cancel,
+		closed:     false,
+		stats:      AMProxyStats{},
+		statsMutex: sync.Mutex{},
+
+		connsMutex: sync.Mutex{},
+		conns:      map[uint64]*AMConnectionWrapper{},
+		nextConnId: 0,
+
+		lobbyMutex:   sync.Mutex{},
+		lobbyMembers: map[string]int{},
+	}
+}
+
+func (m *AMProxy) WithAuthenticator(auth Authenticator) *AMProxy {
+	m.auth = auth
+	return m
+}
+
+func (m *AMProxy) QueueLength() int {
+	return m.match.QueueLength()
+}
+
+func (m *AMProxy) Stats() AMProxyStats {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	return m.stats
+}
+
+// Connections lists every live connection, parked sessions included, in the
+// order they connected
+func (m *AMProxy) Connections() []ConnectionInfo {
+	wrappers := m.connections()
+	out := make([]ConnectionInfo, 0, len(wrappers))
+	for _, w := range wrappers {
+		out = append(out, w.Info())
+	}
+	slices.SortFunc(out, func(a, b ConnectionInfo) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return out
+}
+
+func (m *AMProxy) ConnectionCount() int {
+	m.connsMutex.Lock()
+	defer m.connsMutex.Unlock()
+	return len(m.conns)
+}
 
-		logger: slog.Default().With("area", "AMProxy"),
-		ctx:    ctx,
-		cancel: cancel,
-		closed: false,
-		stats:  AMProxyStats{},
+func (m *AMProxy) connections() []*AMConnectionWrapper {
+	m.connsMutex.Lock()
+	defer m.connsMutex.Unlock()
+
+	out := make([]*AMConnectionWrapper, 0, len(m.conns))
+	for _, w := range m.conns {
+		out = append(out, w)
 	}
+	return out
+}
+
+func (m *AMProxy) connection(id uint64) *AMConnectionWrapper {
+	m.connsMutex.Lock()
+	defer m.connsMutex.Unlock()
+	return m.conns[id]
 }
 
-func (m *AMProxy) allowedToConnect(AMConnection) error {
+func (m *AMProxy) unregister(w *AMConnectionWrapper) {
+	m.connsMutex.Lock()
+	defer m.connsMutex.Unlock()
+	delete(m.conns, w.id)
+}
+
+// Kick disconnects the connection with an error telling the client why.  A
+// connection that is still being matchmade is cancelled
+func (m *AMProxy) Kick(id uint64) error {
+	w := m.connection(id)
+	if w == nil {
+		return AMProxyConnectionNotFound
+	}
+
+	m.logger.Warn("kicking connection", "id", id)
+	select {
+	case w.kick <- AMProxyKicked:
+	default:
+	}
+
+	if !w.established() {
+		w.cancelCause(AMProxyKicked)
+	}
 	return nil
 }
 
+// StartDrain refuses every new connection, the live ones are left alone
+func (m *AMProxy) StartDrain() {
+	m.logger.Warn("draining, no longer accepting connections")
+	m.draining.Store(true)
+}
+
+func (m *AMProxy) Draining() bool {
+	return m.draining.Load()
+}
+
+// CloseConnections sends every established connection a
+// PacketCloseConnection with the reason, the ones still being matchmade are
+// cancelled with it
+func (m *AMProxy) CloseConnections(reason error) {
+	for _, w := range m.connections() {
+		select {
+		case w.closeReq <- reason:
+		default:
+		}
+
+		if !w.established() {
+			w.cancelCause(reason)
+		}
+	}
+}
+
+func (m *AMProxy) connectionsOn(gameId string) int {
+	count := 0
+	for _, info := range m.Connections() {
+		if info.GameServerId == gameId {
+			count++
+		}
+	}
+	return count
+}
+
+// DrainServer stops new clients from being placed on the game server.  The
+// connections already on it are left alone, their count is returned
+func (m *AMProxy) DrainServer(gameId string) int {
+	m.match.Drain(gameId)
+	return m.connectionsOn(gameId)
+}
+
+func (m *AMProxy) UndrainServer(gameId string) int {
+	m.match.Undrain(gameId)
+	return m.connectionsOn(gameId)
+}
+
+func (m *AMProxy) allowedToConnect(conn AMConnection) error {
+	err := m.admit.Admit(conn.Addr())
+	if err != nil {
+		m.logger.Warn("connection rejected", "addr", conn.Addr(), "reason", err)
+		m.statsMutex.Lock()
+		m.stats.reject(err)
+		m.statsMutex.Unlock()
+	}
+	return err
+}
+
+func (m *AMProxy) release(conn AMConnection) {
+	m.admit.Release(conn.Addr())
+
+	m.statsMutex.Lock()
+	m.stats.ActiveConnections -= 1
+	m.statsMutex.Unlock()
+
+	m.match.capacityChanged()
+}
+
 func (m *AMProxy) Add(conn AMConnection) error {
 	assert.Assert(m.closed == false, "adding connections when the proxy has been closed")
 
-	m.stats.ActiveConnections += 1
+	if m.draining.Load() {
+		return AMProxyShuttingDown
+	}
 
 	if err := m.allowedToConnect(conn); err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(m.ctx)
+	m.statsMutex.Lock()
+	m.stats.ActiveConnections += 1
+	m.stats.TotalConnections += 1
+	m.statsMutex.Unlock()
+
+	ctx, cancelCause := context.WithCancelCause(m.ctx)
 	wrapper := &AMConnectionWrapper{
-		cConn:  conn,
-		ctx:    ctx,
-		cancel: cancel,
+		connectedAt: time.Now(),
+		cConn:       conn,
+		ctx:         ctx,
+		cancel:      func() { cancelCause(nil) },
+		cancelCause: cancelCause,
+		cClosed:     make(chan struct{}),
+		version:     packet.VERSION,
+		resume:      make(chan *AMConnectionWrapper),
+		kick:        make(chan error, 1),
+		closeReq:    make(chan error, 1),
+		onClose:     func() { m.release(conn) },
 	}
+	wrapper.onFinish = func() {
+		m.unregister(wrapper)
+		m.leaveLobby(wrapper)
+		m.endPlayerSession(wrapper)
+	}
+
+	m.connsMutex.Lock()
+	m.nextConnId++
+	wrapper.id = m.nextConnId
+	m.conns[wrapper.id] = wrapper
+	m.connsMutex.Unlock()
 
 	go m.handleConnection(wrapper)
 
 	return nil
 }
 
-func (m *AMProxy) authenticate(*packet.Packet) error {
-	return nil
+func (m *AMProxy) authenticate(pkt *packet.Packet) (packet.ClientAuth, error) {
+	if pkt.Type() != packet.PacketClientAuth {
+		return packet.ClientAuth{}, AMProxyAuthFailed
+	}
+
+	auth, err := packet.Decode[packet.ClientAuth](pkt)
+	if err != nil {
+		m.logger.Warn("malformed client auth", "error", err)
+		return auth, AMProxyAuthFailed
+	}
+
+	return auth, m.auth.Authenticate(auth)
+}
+
+// matchRequest fills in whatever the client left out with the defaults of
+// the proxy
+func (m *AMProxy) matchRequest(auth packet.ClientAuth) gameserverstats.MatchRequest {
+	req := gameserverstats.MatchRequest{
+		GameType: auth.GameType,
+		Region:   auth.Region,
+	}
+
+	if req.GameType == "" {
+		req.GameType = m.config.DefaultGameType
+	}
+	if req.Region == "" {
+		req.Region = m.config.DefaultRegion
+	}
+
+	return req
 }
 
 func (m *AMProxy) removeConnection(w *AMConnectionWrapper, report error) {
 
 	if report != nil {
+		w.disconnected(report.Error())
+		m.statsMutex.Lock()
+		m.stats.Errors += 1
+		m.statsMutex.Unlock()
+	}
+
+	// a parked connection has no client to tell
+	if report != nil && !w.parked {
 		pkt := packet.CreateErrorPacket(report)
+		pkt = pkt.WithVersion(w.version)
 		_, err := pkt.Into(w.cConn)
 		if err != nil {
 			m.logger.Error("could not write error message into connection", "error", err)
@@ -109,34 +524,93 @@ func (m *AMProxy) removeConnection(w *AMConnectionWrapper, report error) {
 	w.Close()
 }
 
-func (m *AMProxy) handleConnection(w *AMConnectionWrapper) {
-	w.cFramer = packet.NewPacketFramer()
-	w.gFramer = packet.NewPacketFramer()
-	go packet.FrameWithReader(&w.cFramer, w.cConn)
+// frame reads packets off of one side of the connection and calls done once
+// that side can no longer be read from
+func (m *AMProxy) frame(framer *packet.PacketFramer, conn AMConnection, done func()) {
+	err := packet.FrameWithReader(framer, conn)
+	m.logger.Info("connection read finished", "addr", conn.Addr(), "error", err)
+	done()
+}
 
-	// TODO(v1) this could hang forever and dumb brown hat hackers could hurt
-	// my delicious ports and memory :(
-	authPacket, ok := <-w.cFramer.C
+func (m *AMProxy) handleConnection(w *AMConnectionWrapper) {
+	cFramer := packet.NewPacketFramer()
+	gFramer := packet.NewPacketFramer()
+	w.cFramer = &cFramer
+	w.gFramer = &gFramer
+
+	cClosed := w.cClosed
+	go m.frame(w.cFramer, w.cConn, func() { close(cClosed) })
+
+	timer := time.NewTimer(time.Millisecond * time.Duration(m.config.AuthTimeoutMS))
+	defer timer.Stop()
+
+	var authPacket *packet.Packet
+	select {
+	case authPacket = <-w.cFramer.C:
+	case <-timer.C:
+		m.logger.Warn("client did not authenticate in time", "addr", w.cConn.Addr(), "timeoutMS", m.config.AuthTimeoutMS)
+		m.removeConnection(w, AMProxyAuthTimeout)
+		return
+	case <-w.cClosed:
+		m.removeConnection(w, nil)
+		return
+	case <-w.ctx.Done():
+		m.removeConnection(w, w.cancelled())
+		return
+	}
 
-	if !ok || authPacket == nil {
+	if authPacket == nil {
 		m.removeConnection(w, nil)
 		return
 	}
+	w.version = authPacket.Version()
+
+	if packet.IsClientResume(authPacket) {
+		m.resume(w, authPacket)
+		return
+	}
 
 	// TODO i probably want to have a "user" object that i can
 	// serialize/deserialize
-	if err := m.authenticate(authPacket); err != nil {
+	auth, err := m.authenticate(authPacket)
+	if err != nil {
+		m.logger.Warn("client failed to authenticate", "addr", w.cConn.Addr(), "error", err)
 		m.removeConnection(w, err)
 		return
 	}
+	w.mutex.Lock()
+	w.clientId = hex.EncodeToString(auth.Id[:])
+	w.match = m.matchRequest(auth)
+	w.party = auth.Party
+	w.mutex.Unlock()
 
 	// there is only one place to execute this...
-	gameConnInfo, err := m.match.matchmake(m.ctx, w.cConn)
+	start := time.Now()
+	matchCtx, matchCancel := w.untilClientCloses()
+	var gameConnInfo *GameConnectionInfo
+	switch {
+	case auth.Lobby == packet.LobbyCreate:
+		gameConnInfo, err = m.createLobby(matchCtx, w)
+	case auth.Lobby == packet.LobbyJoin:
+		gameConnInfo, err = m.joinLobby(matchCtx, w, auth.LobbyCode)
+	case auth.IsParty():
+		gameConnInfo, err = m.match.matchmakeParty(matchCtx, w.cConn, w.clientId, w.match, auth.Party, auth.PartySize)
+	default:
+		gameConnInfo, err = m.match.matchmake(matchCtx, w.cConn, w.clientId, w.match)
+	}
+	matchCancel()
 	if err != nil {
+		if cause := w.cancelled(); cause != nil {
+			err = cause
+		}
 		m.removeConnection(w, err)
 		return
 	}
 
+	m.statsMutex.Lock()
+	m.stats.Matchmaking.observe(time.Since(start))
+	m.statsMutex.Unlock()
+
 	gameConn, err := m.factory(gameConnInfo.Addr)
 	if err != nil {
 		m.removeConnection(w, err)
@@ -144,12 +618,38 @@ func (m *AMProxy) handleConnection(w *AMConnectionWrapper) {
 	}
 
 	w.gConn = gameConn
-	go packet.FrameWithReader(&w.gFramer, w.gConn)
+	w.mutex.Lock()
+	w.gsId = gameConnInfo.Id
+	w.mutex.Unlock()
+	go m.frame(w.gFramer, w.gConn, func() {
+		w.disconnected("game server connection lost")
+		w.cancel()
+	})
+
+	// the game server learns who the client is the same way the proxy did
+	gameAuth := packet.CreateClientAuth(auth.Id[:])
+	_, err = gameAuth.Into(w.gConn)
+	if err != nil {
+		m.removeConnection(w, err)
+		return
+	}
 
 	// wait.. what is the id???
-	resp := packet.CreateServerAuthResponse(true, gameConnInfo.Id)
+	authRsp := packet.ServerAuthResponse{
+		Accepted: true,
+		GameId:   gameConnInfo.Id,
+		Lobby:    w.lobby,
+	}
+	if m.config.SessionGraceMS > 0 {
+		w.session = m.sessions.create(w)
+		authRsp.Session = w.session
+	}
+
+	m.startPlayerSession(w)
+	resp := packet.MustEncodeWithVersion(w.version, packet.PacketServerAuthResponse, authRsp)
 	_, err = resp.Into(w.cConn)
 	if err != nil {
+		m.sessions.remove(w.session)
 		m.removeConnection(w, err)
 		return
 	}
@@ -157,23 +657,248 @@ func (m *AMProxy) handleConnection(w *AMConnectionWrapper) {
 	go m.handleConnectionLifecycles(w)
 }
 
+// handleHeartbeat answers pings and consumes the pongs of our own pings.
+// returns true if the packet was a heartbeat and should not be forwarded
+func (m *AMProxy) handleHeartbeat(w *AMConnectionWrapper, conn AMConnection, beat *heartbeat, rtt *RTTStats, pkt *packet.Packet) bool {
+	beat.received()
+
+	switch pkt.Type() {
+	case packet.PacketPing:
+		ping, err := packet.Decode[packet.Heartbeat](pkt)
+		if err != nil {
+			m.removeConnection(w, err)
+			return true
+		}
+
+		pong := packet.CreatePong(ping, pkt.Version())
+		_, err = pong.Into(conn)
+		if err != nil {
+			m.removeConnection(w, err)
+		}
+		return true
+	case packet.PacketPong:
+		if d, ok := beat.pong(pkt, time.Now()); ok {
+			m.statsMutex.Lock()
+			rtt.add(d)
+			m.statsMutex.Unlock()
+			m.logger.Debug("heartbeat", "server-id", w.gsId, "addr", conn.Addr(), "rtt", d)
+		}
+		return true
+	}
+
+	return false
+}
+
+// heartbeat pings both sides, a parked connection only pings the game server
+func (m *AMProxy) heartbeat(w *AMConnectionWrapper) {
+	limit := m.config.HeartbeatMissedLimit
+	clientDead := !w.parked && w.cBeat.dead(limit)
+	if clientDead || w.gBeat.dead(limit) {
+		m.logger.Warn("heartbeat missed", "server-id", w.gsId, "client missed", w.cBeat.missed, "game missed", w.gBeat.missed)
+	}
+
+	if w.gBeat.dead(limit) {
+		m.removeConnection(w, AMProxyHeartbeatMissed)
+		return
+	}
+
+	if clientDead {
+		m.clientLost(w, AMProxyHeartbeatMissed)
+		return
+	}
+
+	now := time.Now()
+	if !w.parked {
+		pkt := w.cBeat.ping(w.version, now)
+		if _, err := pkt.Into(w.cConn); err != nil {
+			m.clientLost(w, err)
+			return
+		}
+	}
+
+	pkt := w.gBeat.ping(packet.VERSION, now)
+	if _, err := pkt.Into(w.gConn); err != nil {
+		m.removeConnection(w, err)
+	}
+}
+
+// closeConnection tells both sides the connection is closing and why
+func (m *AMProxy) closeConnection(w *AMConnectionWrapper, reason error) {
+	m.logger.Info("closing connection", "id", w.id, "server-id", w.gsId, "reason", reason)
+	w.disconnected(reason.Error())
+
+	pkt := packet.CreateCloseConnectionWithReason(reason.Error())
+	if !w.parked {
+		cPkt := pkt.WithVersion(w.version)
+		if _, err := cPkt.Into(w.cConn); err != nil {
+			m.logger.Error("could not write close connection into client", "error", err)
+		}
+	}
+
+	if _, err := pkt.Into(w.gConn); err != nil {
+		m.logger.Error("could not write close connection into game server", "error", err)
+	}
+
+	m.removeConnection(w, nil)
+}
+
+// resume hands a reconnecting client over to the session it was given in its
+// server auth response
+func (m *AMProxy) resume(t *AMConnectionWrapper, pkt *packet.Packet) {
+	req, err := packet.Decode[packet.ClientResume](pkt)
+	if err != nil {
+		m.logger.Warn("malformed client resume", "addr", t.cConn.Addr(), "error", err)
+		m.removeConnection(t, AMProxyAuthFailed)
+		return
+	}
+
+	w := m.sessions.take(req.Token)
+	if w == nil {
+		m.logger.Warn("client attempted to resume an unknown session", "addr", t.cConn.Addr())
+		m.removeConnection(t, AMProxySessionNotFound)
+		return
+	}
+
+	select {
+	case w.resume <- t:
+		// the session owns the client connection now
+		t.cancel()
+		m.unregister(t)
+	case <-w.ctx.Done():
+		m.removeConnection(t, AMProxySessionNotFound)
+	case <-t.cClosed:
+		m.removeConnection(t, nil)
+	}
+}
+
+// clientLost parks the connection if the client is able to resume it,
+// otherwise the whole connection is done
+func (m *AMProxy) clientLost(w *AMConnectionWrapper, err error) {
+	if w.session == (SessionToken{}) || w.parked {
+		if err == nil {
+			w.disconnected("client connection lost")
+		}
+		m.removeConnection(w, err)
+		return
+	}
+
+	m.logger.Info("client lost, holding game server connection", "server-id", w.gsId, "addr", w.cConn.Addr(), "error", err, "graceMS", m.config.SessionGraceMS)
+
+	w.cConn.Close()
+	w.cClosed = nil
+	w.mutex.Lock()
+	w.parked = true
+	w.mutex.Unlock()
+	w.grace = time.NewTimer(time.Millisecond * time.Duration(m.config.SessionGraceMS))
+
+	// parked sessions do not hold on to an admission slot, the client has to
+	// be admitted again to resume
+	if w.onClose != nil {
+		w.onClose()
+		w.onClose = nil
+	}
+
+	m.statsMutex.Lock()
+	m.stats.SessionsParked += 1
+	m.statsMutex.Unlock()
+}
+
+// splice swaps the client side of the connection out for the resumed one
+func (m *AMProxy) splice(w *AMConnectionWrapper, t *AMConnectionWrapper) {
+	if w.parked {
+		w.grace.Stop()
+		w.grace = nil
+	} else {
+		// the client came back before we noticed it had left
+		w.cConn.Close()
+		if w.onClose != nil {
+			w.onClose()
+		}
+	}
+
+	m.logger.Info("session resumed", "server-id", w.gsId, "addr", t.cConn.Addr())
+
+	w.mutex.Lock()
+	w.cConn = t.cConn
+	w.parked = false
+	w.mutex.Unlock()
+
+	w.cFramer = t.cFramer
+	w.cClosed = t.cClosed
+	w.version = t.version
+	w.onClose = t.onClose
+	w.cBeat = heartbeat{rtt: w.cBeat.rtt}
+	w.session = m.sessions.create(w)
+
+	m.statsMutex.Lock()
+	m.stats.SessionsResumed += 1
+	m.statsMutex.Unlock()
+
+	resp := packet.MustEncodeWithVersion(w.version, packet.PacketServerAuthResponse, packet.ServerAuthResponse{
+		Accepted: true,
+		GameId:   w.gsId,
+		Session:  w.session,
+	})
+	if _, err := resp.Into(w.cConn); err != nil {
+		m.clientLost(w, err)
+	}
+}
+
 func (m *AMProxy) handleConnectionLifecycles(w *AMConnectionWrapper) {
-	for {
+	defer func() { m.sessions.remove(w.session) }()
+
+	var beat <-chan time.Time
+	if m.config.HeartbeatIntervalMS > 0 {
+		ticker := time.NewTicker(time.Millisecond * time.Duration(m.config.HeartbeatIntervalMS))
+		defer ticker.Stop()
+		beat = ticker.C
+	}
+
+	// a removed connection can still have other cases ready, stop as soon as
+	// it is cancelled so nothing is handled twice
+	for w.ctx.Err() == nil {
 		select {
 		case pkt := <-w.gFramer.C:
+			m.statsMutex.Lock()
+			m.stats.FromGameServer.add(pkt)
+			m.statsMutex.Unlock()
+
+			if m.handleHeartbeat(w, w.gConn, &w.gBeat, &m.stats.GameServerRTT, pkt) {
+				continue
+			}
+
+			// nobody to hand it to while the client is away
+			if w.parked {
+				if packet.IsCloseConnection(pkt) {
+					w.disconnected(closeReason(pkt, "game server closed connection"))
+					m.removeConnection(w, nil)
+				}
+				continue
+			}
+
 			switch pkt.Type() {
 			case packet.PacketCloseConnection:
+				w.disconnected(closeReason(pkt, "game server closed connection"))
 				_, err := pkt.Into(w.cConn)
 				m.removeConnection(w, err)
 			default:
 				_, err := pkt.Into(w.cConn)
 				if err != nil {
-					m.removeConnection(w, err)
+					m.clientLost(w, err)
 				}
 			}
 		case pkt := <-w.cFramer.C:
+			m.statsMutex.Lock()
+			m.stats.FromClient.add(pkt)
+			m.statsMutex.Unlock()
+
+			if m.handleHeartbeat(w, w.cConn, &w.cBeat, &m.stats.ClientRTT, pkt) {
+				continue
+			}
+
 			switch pkt.Type() {
 			case packet.PacketCloseConnection:
+				w.disconnected(closeReason(pkt, "client closed connection"))
 				_, err := pkt.Into(w.gConn)
 				m.removeConnection(w, err)
 			default:
@@ -182,10 +907,34 @@ func (m *AMProxy) handleConnectionLifecycles(w *AMConnectionWrapper) {
 					m.removeConnection(w, err)
 				}
 			}
+		case <-w.cClosed:
+			m.clientLost(w, nil)
+		case t := <-w.resume:
+			m.splice(w, t)
+		case <-w.graceExpired():
+			m.logger.Info("session expired", "server-id", w.gsId, "graceMS", m.config.SessionGraceMS)
+			m.statsMutex.Lock()
+			m.stats.SessionsExpired += 1
+			m.statsMutex.Unlock()
+			w.disconnected("session expired")
+			m.removeConnection(w, nil)
+		case reason := <-w.kick:
+			m.logger.Warn("connection kicked", "id", w.id, "server-id", w.gsId)
+			m.removeConnection(w, reason)
+		case reason := <-w.closeReq:
+			m.closeConnection(w, reason)
+		case <-beat:
+			m.heartbeat(w)
 		case <-w.ctx.Done():
-			m.logger.Info("connection finished", "server-id", w.gsId)
 		}
 	}
+
+	if m.ctx.Err() != nil {
+		w.disconnected(AMProxyShuttingDown.Error())
+	}
+
+	m.logger.Info("connection finished", "server-id", w.gsId, "client rtt", w.cBeat.rtt.String(), "game rtt", w.gBeat.rtt.String())
+	w.Close()
 }
 
 func (m *AMProxy) Close() {
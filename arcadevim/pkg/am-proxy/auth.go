@@ -0,0 +1,89 @@
+package amproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var AMProxyAuthTimeout = fmt.Errorf("authentication timed out")
+var AMProxyAuthFailed = fmt.Errorf("authentication failed")
+var AMProxyAuthExpired = fmt.Errorf("authentication token has expired")
+
+type Authenticator interface {
+	Authenticate(auth packet.ClientAuth) error
+}
+
+// AllowAllAuthenticator accepts any well formed client auth packet
+type AllowAllAuthenticator struct{}
+
+func (a AllowAllAuthenticator) Authenticate(packet.ClientAuth) error {
+	return nil
+}
+
+const hmacUserIdOffset = 0
+const hmacExpiresOffset = 4
+const hmacSignatureOffset = 8
+const hmacSignatureSize = packet.CLIENT_ID_SIZE - hmacSignatureOffset
+
+// HMACAuthenticator validates client ids that are signed tokens
+//
+// | user id (4) | expires unix seconds (4) | HMAC-SHA256 of the first 8 (8) |
+//
+// whoever hands out tokens (the website, a launcher, whatever) has to share
+// the secret with the proxy
+type HMACAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewHMACAuthenticator(secret []byte) *HMACAuthenticator {
+	assert.Assert(len(secret) > 0, "hmac authenticator requires a secret")
+	return &HMACAuthenticator{
+		secret: secret,
+		now:    time.Now,
+	}
+}
+
+// WithClock is for testing the expiration of tokens
+func (h *HMACAuthenticator) WithClock(now func() time.Time) *HMACAuthenticator {
+	h.now = now
+	return h
+}
+
+func (h *HMACAuthenticator) signature(data []byte) []byte {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(data)
+	return mac.Sum(nil)[:hmacSignatureSize]
+}
+
+func (h *HMACAuthenticator) Sign(userId uint32, expires time.Time) [packet.CLIENT_ID_SIZE]byte {
+	token := [packet.CLIENT_ID_SIZE]byte{}
+	binary.BigEndian.PutUint32(token[hmacUserIdOffset:], userId)
+	binary.BigEndian.PutUint32(token[hmacExpiresOffset:], uint32(expires.Unix()))
+	copy(token[hmacSignatureOffset:], h.signature(token[:hmacSignatureOffset]))
+	return token
+}
+
+func (h *HMACAuthenticator) Authenticate(auth packet.ClientAuth) error {
+	expected := h.signature(auth.Id[:hmacSignatureOffset])
+	if !hmac.Equal(expected, auth.Id[hmacSignatureOffset:]) {
+		return AMProxyAuthFailed
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint32(auth.Id[hmacExpiresOffset:])), 0)
+	if !h.now().Before(expires) {
+		return AMProxyAuthExpired
+	}
+
+	return nil
+}
+
+func HMACUserId(auth packet.ClientAuth) uint32 {
+	return binary.BigEndian.Uint32(auth.Id[hmacUserIdOffset:])
+}
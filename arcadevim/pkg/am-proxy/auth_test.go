@@ -0,0 +1,120 @@
+package amproxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	auth := amproxy.NewHMACAuthenticator([]byte("secret")).
+		WithClock(func() time.Time { return now })
+
+	token := auth.Sign(69, now.Add(time.Minute))
+	require.NoError(t, auth.Authenticate(packet.ClientAuth{Id: token}))
+	require.Equal(t, uint32(69), amproxy.HMACUserId(packet.ClientAuth{Id: token}))
+
+	tampered := token
+	tampered[0] ^= 0xFF
+	require.ErrorIs(t, auth.Authenticate(packet.ClientAuth{Id: tampered}), amproxy.AMProxyAuthFailed)
+
+	other := amproxy.NewHMACAuthenticator([]byte("not the secret"))
+	require.ErrorIs(t, other.Authenticate(packet.ClientAuth{Id: token}), amproxy.AMProxyAuthFailed)
+
+	expired := auth.Sign(69, now)
+	require.ErrorIs(t, auth.Authenticate(packet.ClientAuth{Id: expired}), amproxy.AMProxyAuthExpired)
+}
+
+func pipeConnection(t *testing.T) (net.Conn, amproxy.AMConnection) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	return client, amproxy.NewConnection(server)
+}
+
+func addPipeConnection(t *testing.T, proxy *amproxy.AMProxy) (net.Conn, *packet.PacketFramer) {
+	client, server := pipeConnection(t)
+
+	framer := packet.NewPacketFramer()
+	go packet.FrameWithReader(&framer, client)
+
+	require.NoError(t, proxy.Add(server))
+	return client, &framer
+}
+
+func requireErrorPacket(t *testing.T, framer *packet.PacketFramer, expected error) {
+	select {
+	case pkt := <-framer.C:
+		require.Equal(t, packet.PacketError, pkt.Type())
+		msg, err := packet.Decode[string](pkt)
+		require.NoError(t, err)
+		require.Equal(t, expected.Error(), msg)
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected an error packet from the proxy")
+	}
+}
+
+func TestAMProxyAuthTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, nil, nil, amproxy.AMProxyConfig{AuthTimeoutMS: 50})
+	_, framer := addPipeConnection(t, &proxy)
+
+	requireErrorPacket(t, framer, amproxy.AMProxyAuthTimeout)
+}
+
+func TestAMProxyAuthRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, nil, nil, amproxy.AMProxyConfig{AuthTimeoutMS: 1000})
+	proxy.WithAuthenticator(amproxy.NewHMACAuthenticator([]byte("secret")))
+	client, framer := addPipeConnection(t, &proxy)
+
+	pkt := packet.CreateClientAuth(make([]byte, 16))
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+
+	requireErrorPacket(t, framer, amproxy.AMProxyAuthFailed)
+}
+
+func TestAMProxyAuthTimeoutDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// an unset timeout waits the default instead of rejecting right away
+	proxy := amproxy.NewAMProxy(ctx, nil, nil, amproxy.AMProxyConfig{})
+	proxy.WithAuthenticator(amproxy.NewHMACAuthenticator([]byte("secret")))
+	client, framer := addPipeConnection(t, &proxy)
+
+	time.Sleep(time.Millisecond * 50)
+	pkt := packet.CreateClientAuth(make([]byte, 16))
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+
+	requireErrorPacket(t, framer, amproxy.AMProxyAuthFailed)
+}
+
+func TestAMProxyAuthVersion2(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, queueConfig())
+	client, framer := addPipeConnection(t, &proxy)
+
+	auth := packet.MustEncodeWithVersion(packet.VERSION_2, packet.PacketClientAuth, packet.ClientAuth{GameType: "tetris"})
+	_, err := auth.Into(client)
+	require.NoError(t, err)
+
+	// a v2 client is answered in v2 and gets the json layout
+	rsp := nextPacket(t, framer)
+	require.Equal(t, packet.VERSION_2, rsp.Version())
+	require.Equal(t, packet.EncodingJSON, rsp.Encoding())
+	require.Equal(t, "0", packet.ServerAuthGameId(rsp))
+}
@@ -0,0 +1,156 @@
+package amproxy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+)
+
+// how often a drain checks on the remaining connections
+const drainCheckInterval = time.Millisecond * 50
+
+// how often a drain logs its progress
+const drainLogInterval = time.Second
+
+type DrainProgress struct {
+	Draining  bool      `json:"draining"`
+	Done      bool      `json:"done"`
+	StartedAt time.Time `json:"startedAt"`
+	Deadline  time.Time `json:"deadline"`
+	Remaining int       `json:"remaining"`
+
+	// the deadline passed and the remaining connections were told to close
+	Forced bool `json:"forced"`
+}
+
+func (a *AMTCPProxy) DrainProgress() DrainProgress {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.drain
+}
+
+func (a *AMTCPProxy) updateDrain(update func(d *DrainProgress)) DrainProgress {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	update(&a.drain)
+	return a.drain
+}
+
+// Drain stops accepting connections and gives the live ones until the
+// timeout to finish, whoever is left is then sent a PacketCloseConnection.
+// Draining an already draining proxy does nothing
+func (a *AMTCPProxy) Drain(timeout time.Duration) {
+	a.mutex.Lock()
+	if a.drain.Draining {
+		a.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	remaining := a.proxy.ConnectionCount()
+	a.drain = DrainProgress{
+		Draining:  true,
+		StartedAt: now,
+		Deadline:  now.Add(timeout),
+		Remaining: remaining,
+	}
+	a.mutex.Unlock()
+
+	a.logger.Warn("drain started", "timeout", timeout, "remaining", remaining)
+	a.proxy.StartDrain()
+	a.closeListener()
+
+	go a.runDrain()
+}
+
+func (a *AMTCPProxy) runDrain() {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	lastLog := time.Now()
+	for now := range ticker.C {
+		remaining := a.proxy.ConnectionCount()
+		progress := a.updateDrain(func(d *DrainProgress) {
+			d.Remaining = remaining
+			d.Done = remaining == 0
+		})
+
+		if progress.Done {
+			a.logger.Warn("drain finished", "forced", progress.Forced, "took", now.Sub(progress.StartedAt))
+			close(a.drained)
+			return
+		}
+
+		if !progress.Forced && now.After(progress.Deadline) {
+			a.logger.Warn("drain deadline passed, closing connections", "remaining", remaining)
+			a.updateDrain(func(d *DrainProgress) { d.Forced = true })
+			a.proxy.CloseConnections(AMProxyShuttingDown)
+		}
+
+		if now.Sub(lastLog) >= drainLogInterval {
+			a.logger.Info("draining", "remaining", remaining, "deadline", progress.Deadline)
+			lastLog = now
+		}
+	}
+}
+
+func (a *AMTCPProxy) WaitForDrained(ctx context.Context) {
+	select {
+	case <-a.drained:
+	case <-ctx.Done():
+	}
+}
+
+func (a *AMTCPProxy) drainTimeout() time.Duration {
+	return time.Millisecond * time.Duration(a.proxy.config.DrainTimeoutMS)
+}
+
+// DrainOnSignal starts a drain with the configured timeout once any of the
+// signals is received
+func (a *AMTCPProxy) DrainOnSignal(ctx context.Context, signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			a.logger.Warn("drain signal received", "signal", sig)
+			a.Drain(a.drainTimeout())
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// AdminHandler is the proxy admin api along with
+//
+//	POST /drain   start draining, ?timeoutMS= overrides the configured timeout
+//	GET  /drain   DrainProgress
+func (a *AMTCPProxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", newAdminMux(a.proxy))
+
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		timeout := a.drainTimeout()
+		if str := r.URL.Query().Get("timeoutMS"); str != "" {
+			ms, err := strconv.Atoi(str)
+			if err != nil || ms < 0 {
+				writeJSON(w, http.StatusBadRequest, adminError{Error: "timeoutMS must be a positive number"})
+				return
+			}
+			timeout = time.Millisecond * time.Duration(ms)
+		}
+
+		a.Drain(timeout)
+		writeJSON(w, http.StatusAccepted, a.DrainProgress())
+	})
+
+	mux.HandleFunc("GET /drain", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.DrainProgress())
+	})
+
+	return withAdminToken(a.proxy.config.AdminToken, mux)
+}
@@ -0,0 +1,86 @@
+package amproxy_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestTCPProxyDrainOnSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.DrainTimeoutMS = 100
+
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, config)
+	port := freePort(t)
+	tcp := amproxy.NewTCPProxy(&proxy, port)
+	go tcp.Run(ctx)
+	tcp.WaitForReady(ctx)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	client, err := net.Dial("tcp4", addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	framer := packet.NewPacketFramer()
+	go packet.FrameWithReader(&framer, client)
+	authenticate(t, client)
+	require.Equal(t, "0", packet.ServerAuthGameId(nextPacket(t, &framer)))
+	game := games.next(t)
+
+	tcp.DrainOnSignal(ctx, syscall.SIGUSR2)
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR2))
+
+	require.Eventually(t, func() bool {
+		return tcp.DrainProgress().Draining
+	}, time.Second, time.Millisecond)
+
+	_, err = net.Dial("tcp4", addr)
+	require.Error(t, err)
+
+	// both sides are told why once the deadline passes
+	for _, f := range []*packet.PacketFramer{&framer, game} {
+		pkt := nextPacket(t, f)
+		require.Equal(t, packet.PacketCloseConnection, pkt.Type())
+		closeConn, err := packet.Decode[packet.CloseConnection](pkt)
+		require.NoError(t, err)
+		require.Equal(t, amproxy.AMProxyShuttingDown.Error(), closeConn.Reason)
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, time.Second)
+	defer drainCancel()
+	tcp.WaitForDrained(drainCtx)
+
+	progress := tcp.DrainProgress()
+	require.True(t, progress.Done)
+	require.True(t, progress.Forced)
+	require.Equal(t, 0, progress.Remaining)
+}
+
+func TestAMProxyRefusesWhileDraining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, nil, nil, queueConfig())
+	proxy.StartDrain()
+
+	_, conn := pipeConnection(t)
+	require.ErrorIs(t, proxy.Add(conn), amproxy.AMProxyShuttingDown)
+}
@@ -3,20 +3,34 @@ package amproxy
 import (
 	"context"
 	"io"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 )
 
-// TODO consider all of these operations with game type
-// there will possibly be a day where i have more than one game type
 //go:generate mockery --name GameServer
 type GameServer interface {
-	GetBestServer() (string, error)
-	CreateNewServer(ctx context.Context) (string, error)
+	// ListServers are the ready servers matching the request that can still
+	// take connections, which one is used is up to the ServerSelector
+	ListServers(req gameserverstats.MatchRequest) []gameserverstats.GameServerConfig
+	CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error)
 	WaitForReady(ctx context.Context, id string) error
 	GetConnectionString(id string) (string, error)
-	//ListServers() []gameserverstats.GameServerConfig
 	String() string
 }
 
+// GameServerWatcher is a GameServer that tells the matchmaker about server
+// changes as they happen, queued clients are retried right away instead of on
+// the next retry interval
+type GameServerWatcher interface {
+	Watch(ctx context.Context) <-chan gameserverstats.GameServerEvent
+}
+
+// GameServerDestroyer is a GameServer that can tear down a server, a private
+// server nobody can join is destroyed instead of left to the reaper
+type GameServerDestroyer interface {
+	Destroy(ctx context.Context, id string) error
+}
+
 type AMConnection interface {
     io.ReadWriteCloser
 	Addr() string
@@ -0,0 +1,74 @@
+package amproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var AMProxyHeartbeatMissed = fmt.Errorf("connection missed too many heartbeats")
+
+type RTTStats struct {
+	Samples int           `json:"samples"`
+	Last    time.Duration `json:"last"`
+	Min     time.Duration `json:"min"`
+	Max     time.Duration `json:"max"`
+	Avg     time.Duration `json:"avg"`
+}
+
+func (r *RTTStats) add(rtt time.Duration) {
+	if r.Samples == 0 || rtt < r.Min {
+		r.Min = rtt
+	}
+	if rtt > r.Max {
+		r.Max = rtt
+	}
+
+	r.Last = rtt
+	r.Avg = (r.Avg*time.Duration(r.Samples) + rtt) / time.Duration(r.Samples+1)
+	r.Samples++
+}
+
+func (r *RTTStats) String() string {
+	return fmt.Sprintf("samples=%d last=%s min=%s max=%s avg=%s", r.Samples, r.Last, r.Min, r.Max, r.Avg)
+}
+
+// heartbeat is the ping state for one side of a proxied connection.  It is
+// only touched from the connection lifecycle goroutine
+type heartbeat struct {
+	seq    uint32
+	sent   time.Time
+	missed int
+	rtt    RTTStats
+}
+
+// received is called for any packet from the peer, any traffic at all proves
+// that the other side is still around
+func (h *heartbeat) received() {
+	h.missed = 0
+}
+
+func (h *heartbeat) ping(version uint8, now time.Time) packet.Packet {
+	h.seq++
+	h.sent = now
+	h.missed++
+
+	pkt := packet.CreatePing(h.seq, now)
+	return pkt.WithVersion(version)
+}
+
+func (h *heartbeat) pong(pkt *packet.Packet, now time.Time) (time.Duration, bool) {
+	beat, err := packet.Decode[packet.Heartbeat](pkt)
+	if err != nil || beat.Seq != h.seq {
+		return 0, false
+	}
+
+	rtt := now.Sub(h.sent)
+	h.rtt.add(rtt)
+	return rtt, true
+}
+
+func (h *heartbeat) dead(limit int) bool {
+	return limit > 0 && h.missed >= limit
+}
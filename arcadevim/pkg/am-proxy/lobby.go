@@ -0,0 +1,170 @@
+package amproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+var AMProxyLobbiesDisabled = fmt.Errorf("private lobbies are not enabled")
+var AMProxyLobbyNotFound = fmt.Errorf("no lobby exists for that join code")
+var AMProxyLobbyFull = fmt.Errorf("the lobby is full")
+
+const LOBBY_CODE_SIZE = 6
+
+// no 0/O or 1/I so codes can be read out loud.  32 characters keeps the
+// random bytes evenly spread over the alphabet
+const lobbyCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// how many codes are tried before giving up on finding an unused one
+const lobbyCodeAttempts = 5
+
+func newLobbyCode() string {
+	code := make([]byte, LOBBY_CODE_SIZE)
+	_, err := rand.Read(code)
+	assert.NoError(err, "unable to read random bytes for a lobby code")
+
+	for i, b := range code {
+		code[i] = lobbyCodeAlphabet[int(b)%len(lobbyCodeAlphabet)]
+	}
+	return string(code)
+}
+
+// WithLobbies enables private lobbies, without a store clients cannot create
+// or join them
+func (m *AMProxy) WithLobbies(lobbies gameserverstats.LobbyStore) *AMProxy {
+	m.lobbies = lobbies
+	return m
+}
+
+// createLobby starts a private game server for the client and hands it the
+// join code for it.  Private servers are never shared so there is no queue
+func (m *AMProxy) createLobby(ctx context.Context, w *AMConnectionWrapper) (*GameConnectionInfo, error) {
+	if m.lobbies == nil {
+		return nil, AMProxyLobbiesDisabled
+	}
+
+	req := w.match
+	req.Private = true
+	info, err := m.match.createPrivate(ctx, w.clientId, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a lobby nobody can ever join the server
+	created := false
+	defer func() {
+		if !created {
+			m.match.destroyUnused(info.Id)
+		}
+	}()
+
+	lobby := gameserverstats.Lobby{
+		GameServerId: info.Id,
+		Owner:        w.clientId,
+		CreatedMS:    time.Now().UnixMilli(),
+	}
+
+	m.lobbyMutex.Lock()
+	defer m.lobbyMutex.Unlock()
+
+	for range lobbyCodeAttempts {
+		lobby.Code = newLobbyCode()
+		existing, err := m.lobbies.GetLobby(lobby.Code)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			break
+		}
+		lobby.Code = ""
+	}
+
+	if lobby.Code == "" {
+		return nil, errors.Join(AMProxyNoCapacity, fmt.Errorf("unable to find an unused lobby code"))
+	}
+
+	if err := m.lobbies.CreateLobby(lobby); err != nil {
+		return nil, err
+	}
+
+	created = true
+	m.lobbyMembers[lobby.Code] = 1
+	w.mutex.Lock()
+	w.lobby = lobby.Code
+	w.mutex.Unlock()
+
+	m.logger.Info("lobby created", "lobby", lobby.String())
+	return info, nil
+}
+
+func (m *AMProxy) joinLobby(ctx context.Context, w *AMConnectionWrapper, code string) (*GameConnectionInfo, error) {
+	if m.lobbies == nil {
+		return nil, AMProxyLobbiesDisabled
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.lobbyMutex.Lock()
+	lobby, err := m.lobbies.GetLobby(code)
+	if err != nil || lobby == nil {
+		m.lobbyMutex.Unlock()
+		if err == nil {
+			err = AMProxyLobbyNotFound
+		}
+		return nil, err
+	}
+
+	if m.config.ServerCapacity > 0 && m.lobbyMembers[code] >= m.config.ServerCapacity {
+		m.lobbyMutex.Unlock()
+		return nil, AMProxyLobbyFull
+	}
+	m.lobbyMembers[code]++
+	m.lobbyMutex.Unlock()
+
+	w.mutex.Lock()
+	w.lobby = code
+	w.mutex.Unlock()
+
+	addr, err := m.servers.GetConnectionString(lobby.GameServerId)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("joined lobby", "id", w.clientId, "lobby", lobby.String())
+	return &GameConnectionInfo{
+		Id:       lobby.GameServerId,
+		Addr:     addr,
+		Strategy: "lobby",
+	}, nil
+}
+
+// leaveLobby removes the lobby once its last member is gone, the private
+// server idles out on its own
+func (m *AMProxy) leaveLobby(w *AMConnectionWrapper) {
+	w.mutex.Lock()
+	code := w.lobby
+	w.mutex.Unlock()
+
+	if code == "" {
+		return
+	}
+
+	m.lobbyMutex.Lock()
+	defer m.lobbyMutex.Unlock()
+
+	m.lobbyMembers[code]--
+	if m.lobbyMembers[code] > 0 {
+		return
+	}
+
+	delete(m.lobbyMembers, code)
+	err := m.lobbies.DeleteLobby(code)
+	m.logger.Info("lobby empty, removing it", "code", code, "error", err)
+}
@@ -0,0 +1,167 @@
+package amproxy_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var errLobbyStore = fmt.Errorf("lobby store is down")
+
+// brokenLobbies cannot store new lobbies
+type brokenLobbies struct {
+	gameserverstats.LobbyStore
+}
+
+func (b brokenLobbies) CreateLobby(lobby gameserverstats.Lobby) error {
+	return errLobbyStore
+}
+
+// destroyingGameServers remembers every server it was asked to destroy
+type destroyingGameServers struct {
+	fakeGameServers
+	destroyed []string
+}
+
+func (d *destroyingGameServers) Destroy(ctx context.Context, id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.destroyed = append(d.destroyed, id)
+	return nil
+}
+
+func lobbyExists(lobbies gameserverstats.LobbyStore, code string) bool {
+	lobby, err := lobbies.GetLobby(code)
+	return err == nil && lobby != nil
+}
+
+func sendAuth(t *testing.T, proxy *amproxy.AMProxy, pkt packet.Packet) (net.Conn, *packet.PacketFramer) {
+	client, framer := addPipeConnection(t, proxy)
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+	return client, framer
+}
+
+func requireAuthResponse(t *testing.T, framer *packet.PacketFramer) packet.ServerAuthResponse {
+	pkt := nextPacket(t, framer)
+	require.Equal(t, packet.PacketServerAuthResponse, pkt.Type())
+	rsp, err := packet.Decode[packet.ServerAuthResponse](pkt)
+	require.NoError(t, err)
+	return rsp
+}
+
+func TestLobbyCreateAndJoin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobbies := gameserverstats.NewMemory()
+	servers := &fakeGameServers{capacity: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+	proxy.WithLobbies(lobbies)
+
+	owner, ownerFramer := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "tetris", ""))
+	created := requireAuthResponse(t, ownerFramer)
+	require.Equal(t, "0", created.GameId)
+	require.Len(t, created.Lobby, amproxy.LOBBY_CODE_SIZE)
+
+	lobby, err := lobbies.GetLobby(created.Lobby)
+	require.NoError(t, err)
+	require.Equal(t, "0", lobby.GameServerId)
+	require.Equal(t, "00000000000000000000000000000000", lobby.Owner)
+
+	// the private server is never handed out by matchmaking
+	_, publicFramer := sendAuth(t, &proxy, packet.CreateMatchClientAuth(make([]byte, 16), "tetris", ""))
+	require.Equal(t, "1", requireAuthResponse(t, publicFramer).GameId)
+
+	friend, friendFramer := sendAuth(t, &proxy, packet.CreateJoinLobbyClientAuth(make([]byte, 16), created.Lobby))
+	joined := requireAuthResponse(t, friendFramer)
+	require.Equal(t, "0", joined.GameId)
+	require.Equal(t, created.Lobby, joined.Lobby)
+
+	owner.Close()
+	require.Eventually(t, func() bool {
+		return len(proxy.Connections()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.True(t, lobbyExists(lobbies, created.Lobby))
+
+	// the last one out removes the lobby
+	friend.Close()
+	require.Eventually(t, func() bool {
+		return !lobbyExists(lobbies, created.Lobby)
+	}, time.Second, 5*time.Millisecond)
+
+	_, lateFramer := sendAuth(t, &proxy, packet.CreateJoinLobbyClientAuth(make([]byte, 16), created.Lobby))
+	requireErrorPacket(t, lateFramer, amproxy.AMProxyLobbyNotFound)
+}
+
+func TestLobbyDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, queueConfig())
+
+	_, framer := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "", ""))
+	requireErrorPacket(t, framer, amproxy.AMProxyLobbiesDisabled)
+}
+
+func TestLobbyCreateFailedDestroysServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &destroyingGameServers{fakeGameServers: fakeGameServers{capacity: true}}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+	proxy.WithLobbies(brokenLobbies{gameserverstats.NewMemory()})
+
+	_, framer := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "tetris", ""))
+	requireErrorPacket(t, framer, errLobbyStore)
+
+	servers.mutex.Lock()
+	defer servers.mutex.Unlock()
+	require.Equal(t, []string{"0"}, servers.destroyed)
+}
+
+func TestLobbyCreateClientLeft(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &brokenGameServers{fakeGameServers: fakeGameServers{capacity: true}, hang: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+	proxy.WithLobbies(gameserverstats.NewMemory())
+
+	// the client is gone before its private server is ready
+	client, _ := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "", ""))
+	require.Eventually(t, func() bool {
+		servers.mutex.Lock()
+		defer servers.mutex.Unlock()
+		return len(servers.servers) == 1
+	}, time.Second, time.Millisecond)
+	client.Close()
+
+	servers.requireDestroyed(t, "0")
+}
+
+func TestLobbyFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.ServerCapacity = 2
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, config)
+	proxy.WithLobbies(gameserverstats.NewMemory())
+
+	_, ownerFramer := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "", ""))
+	created := requireAuthResponse(t, ownerFramer)
+
+	_, friendFramer := sendAuth(t, &proxy, packet.CreateJoinLobbyClientAuth(make([]byte, 16), created.Lobby))
+	require.Equal(t, created.GameId, requireAuthResponse(t, friendFramer).GameId)
+
+	_, lateFramer := sendAuth(t, &proxy, packet.CreateJoinLobbyClientAuth(make([]byte, 16), created.Lobby))
+	requireErrorPacket(t, lateFramer, amproxy.AMProxyLobbyFull)
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
 )
 
@@ -17,102 +20,307 @@ type MatchMakingServer struct {
 	logger   *slog.Logger
 	listener net.Listener
 	ready    bool
+	config   AMProxyConfig
+	selector ServerSelector
 
-	waitingForServer bool
+	// servers are created with the lifetime of the matchmaker, not of the
+	// client that caused them to be created
+	ctx context.Context
 
-	mutex             sync.Mutex
-	wait              sync.WaitGroup
-	lastCreatedGameId string
+	mutex sync.Mutex
+
+	// at most one server is created at a time per game type and region
+	creating map[gameserverstats.MatchRequest]*serverCreation
+
+	// clients waiting on capacity, one queue per game type and region
+	queues map[gameserverstats.MatchRequest]*matchQueue
+
+	// game servers that no longer receive new clients
+	draining map[string]bool
+
+	// seats held on a game server for parties that are still arriving
+	reserved map[string]int
+	parties  map[string]*party
 }
 
-func (m *MatchMakingServer) startWaiting() bool {
+// serverCreation is shared with everyone asking for the same match while the
+// server is being created, the result is only readable once done is closed
+type serverCreation struct {
+	done   chan struct{}
+	gameId string
+	err    error
+}
+
+// startCreating returns true when the caller is the one that has to create
+// the server
+func (m *MatchMakingServer) startCreating(req gameserverstats.MatchRequest) (*serverCreation, bool) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if !m.waitingForServer {
-		m.waitingForServer = true
-		m.wait = sync.WaitGroup{}
-		m.wait.Add(1)
-		return true
+	if creation, ok := m.creating[req]; ok {
+		return creation, false
 	}
 
-	return false
+	creation := &serverCreation{done: make(chan struct{})}
+	m.creating[req] = creation
+	return creation, true
 }
 
-func (m *MatchMakingServer) stopWaiting() {
+func (m *MatchMakingServer) stopCreating(req gameserverstats.MatchRequest, creation *serverCreation) {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	delete(m.creating, req)
+	m.mutex.Unlock()
 
-	if !m.waitingForServer {
-		return
+	close(creation.done)
+}
+
+// waitForReady gives the server ServerReadyTimeoutMS to become ready.  The
+// GameServer is expected to turn the deadline into an ErrReadyTimeout but a
+// bare deadline is wrapped here too so clients always get the same error
+func (m *MatchMakingServer) waitForReady(ctx context.Context, gameId string) error {
+	if m.config.ServerReadyTimeoutMS > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(m.config.ServerReadyTimeoutMS))
+		defer cancel()
 	}
 
-	m.wait.Done()
-	m.waitingForServer = false
+	err := m.servers.WaitForReady(ctx, gameId)
+	if errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, servermanagement.ErrReadyTimeout) {
+		err = fmt.Errorf("%w: %s", servermanagement.ErrReadyTimeout, gameId)
+	}
+	return err
 }
 
-func (m *MatchMakingServer) createAndWait(ctx context.Context) string {
-	m.logger.Info("going to create and wait for new game server")
-	if !m.startWaiting() {
-		m.logger.Info("already waiting on server")
-		m.wait.Wait()
-		m.logger.Info("waited for server to be created", "id", m.lastCreatedGameId)
-		return m.lastCreatedGameId
+func (m *MatchMakingServer) createAndWait(req gameserverstats.MatchRequest) (string, error) {
+	m.logger.Info("going to create and wait for new game server", "request", req.String())
+	creation, create := m.startCreating(req)
+	if !create {
+		m.logger.Info("already waiting on server", "request", req.String())
+		<-creation.done
+		m.logger.Info("waited for server to be created", "id", creation.gameId, "error", creation.err)
+		return creation.gameId, creation.err
 	}
 
 	// TODO messaging goes way better...
 	// TODO horizontal scaling can be quite difficult for the current method
-	gameId, err := m.servers.CreateNewServer(ctx)
+	gameId, err := m.servers.CreateNewServer(m.ctx, req)
+
+	// the error is shared with everyone that was waiting on this creation
+	if err != nil {
+		m.logger.Warn("unable to create a new game server", "error", err, "request", req.String())
+		creation.err = errors.Join(AMProxyNoCapacity, err)
+		m.stopCreating(req, creation)
+		return "", creation.err
+	}
 
-	// seee i hate this method.. it feels very prone to failure...
-	m.lastCreatedGameId = gameId
+	m.logger.Info("waiting for server", "id", gameId)
+	err = m.waitForReady(m.ctx, gameId)
+	m.logger.Info("server created", "id", gameId, "error", err)
+	creation.gameId = gameId
+	creation.err = err
 
+	m.stopCreating(req, creation)
 	if err != nil {
-		// TODO If there are no more servers available to create (max server count)
-		// then the queue needs to begin
-		assert.Never("unimplemented")
+		m.destroyUnused(gameId)
+		return "", err
+	}
 
-        // i am thinking that i am going to have to share the error across the
-        // connections
+	m.capacityChanged()
+	return gameId, nil
+}
+
+// createPrivate starts a server that only the caller knows about, it is
+// never shared with anyone else asking for the same match.  The server is
+// destroyed when ctx finishes before it is ready
+func (m *MatchMakingServer) createPrivate(ctx context.Context, connId string, req gameserverstats.MatchRequest) (*GameConnectionInfo, error) {
+	m.logger.Info("creating private game server", "id", connId, "request", req.String())
+	gameId, err := m.servers.CreateNewServer(m.ctx, req)
+	if err != nil {
+		m.logger.Warn("unable to create a private game server", "error", err, "request", req.String())
+		return nil, errors.Join(AMProxyNoCapacity, err)
 	}
 
-	m.logger.Info("waiting for server", "id", gameId)
-	err = m.servers.WaitForReady(ctx, gameId)
-	m.logger.Info("server created", "id", gameId)
-	assert.NoError(err, "i need to be able to handle the issue of failing to create server or the server cannot ready")
+	err = m.waitForReady(ctx, gameId)
+	if err != nil {
+		m.logger.Warn("private game server never became ready", "id", connId, "gameId", gameId, "error", err)
+		m.destroyUnused(gameId)
+		return nil, err
+	}
+
+	gs, err := m.servers.GetConnectionString(gameId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GameConnectionInfo{
+		Id:       gameId,
+		Addr:     gs,
+		Strategy: "private",
+	}, nil
+}
+
+// destroyUnused tears down a server that was never handed out.  A server
+// still starting when the matchmaker shuts down is destroyed too, so this
+// does not stop with the matchmaker context
+func (m *MatchMakingServer) destroyUnused(gameId string) {
+	destroyer, ok := m.servers.(GameServerDestroyer)
+	if !ok {
+		m.logger.Warn("game servers cannot be destroyed, leaving unused server to the reaper", "gameId", gameId, "servers", m.servers.String())
+		return
+	}
+
+	if err := destroyer.Destroy(context.WithoutCancel(m.ctx), gameId); err != nil {
+		m.logger.Error("unable to destroy unused game server", "gameId", gameId, "error", err)
+	}
+}
+
+func (m *MatchMakingServer) Drain(gameId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.logger.Warn("draining game server", "id", gameId)
+	m.draining[gameId] = true
+}
+
+func (m *MatchMakingServer) Undrain(gameId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.logger.Warn("no longer draining game server", "id", gameId)
+	delete(m.draining, gameId)
+}
+
+func (m *MatchMakingServer) Draining() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make([]string, 0, len(m.draining))
+	for id := range m.draining {
+		out = append(out, id)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// candidatesLocked are the servers that have room for seats more clients, a
+// server with seats reserved for a party only counts the seats left over
+func (m *MatchMakingServer) candidatesLocked(servers []gameserverstats.GameServerConfig, seats int) []gameserverstats.GameServerConfig {
+	return slices.DeleteFunc(servers, func(gs gameserverstats.GameServerConfig) bool {
+		if m.draining[gs.Id] {
+			return true
+		}
+		capacity := m.config.ServerCapacity
+		return capacity > 0 && gs.Connections+m.reserved[gs.Id]+seats > capacity
+	})
+}
+
+// selectServer picks a server for seats clients.  More than one seat is a
+// party and the seats are reserved until the party releases them
+func (m *MatchMakingServer) selectServer(connId string, req gameserverstats.MatchRequest, seats int) (string, error) {
+	servers := m.servers.ListServers(req)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	gameId, err := m.selector.Select(connId, m.candidatesLocked(servers, seats))
+	if err == nil && seats > 1 {
+		m.reserved[gameId] += seats
+	}
+	return gameId, err
+}
+
+func (m *MatchMakingServer) reserve(gameId string, seats int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reserved[gameId] += seats
+}
 
-	m.stopWaiting()
-	return gameId
+func (m *MatchMakingServer) unreserve(gameId string, seats int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.unreserveLocked(gameId, seats)
+}
+
+func (m *MatchMakingServer) unreserveLocked(gameId string, seats int) {
+	m.reserved[gameId] -= seats
+	assert.Assert(m.reserved[gameId] >= 0, "more seats were released than reserved", "id", gameId, "seats", seats)
+	if m.reserved[gameId] == 0 {
+		delete(m.reserved, gameId)
+	}
+}
+
+// findServer either hands back a server with room for seats clients or
+// creates one.  When neither is possible AMProxyNoCapacity is returned
+func (m *MatchMakingServer) findServer(connId string, req gameserverstats.MatchRequest, seats int) (string, error) {
+	gameId, err := m.selectServer(connId, req, seats)
+
+	m.logger.Info("getting best server", "gameId", gameId, "error", err, "id", connId, "request", req.String(), "seats", seats, "strategy", m.selector.Name())
+	if errors.Is(err, servermanagement.NoBestServer) {
+		gameId, err = m.createAndWait(req)
+		if err == nil && seats > 1 {
+			m.reserve(gameId, seats)
+		}
+		return gameId, err
+	} else if err != nil {
+		m.logger.Error("getting best server error", "error", err, "id", connId)
+		return "", err
+	}
+
+	return gameId, nil
 }
 
 type GameConnectionInfo struct {
     Id string
     Addr string
+
+    // the name of the ServerSelector that picked this server
+    Strategy string
 }
 
 // TODO(v1) create no garbage ([]byte...)
-func (m *MatchMakingServer) matchmake(ctx context.Context, conn AMConnection) (*GameConnectionInfo, error) {
-    connId := conn.Id()
-	gameId, err := m.servers.GetBestServer()
+// ctx is the lifetime of the client, if it finishes while queued the client
+// is removed from the queue
+func (m *MatchMakingServer) matchmake(ctx context.Context, conn AMConnection, connId string, req gameserverstats.MatchRequest) (*GameConnectionInfo, error) {
+	return m.matchmakeSeats(ctx, conn, connId, req, 1)
+}
 
-	m.logger.Info("getting best server", "gameId", gameId, "error", err, "id", connId)
-	if errors.Is(err, servermanagement.NoBestServer) {
-		gameId = m.createAndWait(ctx)
-	} else if err != nil {
-		m.logger.Error("getting best server error", "error", err, "id", connId)
+func (m *MatchMakingServer) matchmakeSeats(ctx context.Context, conn AMConnection, connId string, req gameserverstats.MatchRequest, seats int) (*GameConnectionInfo, error) {
+	// nobody gets to skip the people already waiting on the same match
+	var gameId string
+	err := AMProxyNoCapacity
+	if !m.queued(req) {
+		gameId, err = m.findServer(connId, req, seats)
+	}
+
+	if errors.Is(err, AMProxyNoCapacity) {
+		m.logger.Warn("no capacity, queueing client", "id", connId, "request", req.String(), "seats", seats)
+		gameId, err = m.enqueue(ctx, conn, connId, req, seats)
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
+	// the server can close between being picked and being connected to
 	gs, err := m.servers.GetConnectionString(gameId)
-	assert.NoError(err, "game server id somehow wasn't found", "id", connId)
+	if err != nil {
+		m.logger.Warn("selected game server is gone", "gameId", gameId, "id", connId, "error", err)
+
+		// the party never gets placed so it has no seats to release
+		if seats > 1 {
+			m.unreserve(gameId, seats)
+		}
+		return nil, err
+	}
 	assert.Assert(gs != "", "game server gameString did not produce a host:port pair", "id", gameId, "id", connId)
 
 	// TODO probably better to just get a full server information
-	m.logger.Info("game server selected", "host:port", gs, "id", connId)
+	m.logger.Info("game server selected", "host:port", gs, "id", connId, "strategy", m.selector.Name())
 
     return &GameConnectionInfo{
         Id: gameId,
         Addr: gs,
+        Strategy: m.selector.Name(),
     }, nil
 }
 
@@ -121,19 +329,54 @@ func (m *MatchMakingServer) Close() {
     //... hmm
 }
 
-func NewMatchMakingServer(servers GameServer) *MatchMakingServer {
-	return &MatchMakingServer{
+func NewMatchMakingServer(ctx context.Context, servers GameServer, config AMProxyConfig) *MatchMakingServer {
+	selection := config.ServerSelection
+	if selection == "" {
+		selection = SelectFillFirst
+	}
+
+	assert.Assert(config.PartyTimeoutMS >= 0, "party timeout cannot be negative", "partyTimeoutMS", config.PartyTimeoutMS)
+	if config.PartyTimeoutMS == 0 {
+		config.PartyTimeoutMS = DefaultPartyTimeoutMS
+	}
+
+	logger := slog.Default().With("area", "MatchMakingServer")
+	logger.Info("server selection", "strategy", selection)
+
+	m := &MatchMakingServer{
         servers: servers,
-		logger:           slog.Default().With("area", "MatchMakingServer"),
-		waitingForServer: false,
+		config:           config,
+		selector:         NewServerSelector(selection),
+		ctx:              ctx,
+		logger:           logger,
 		ready:            false,
 		mutex:            sync.Mutex{},
+		creating:         map[gameserverstats.MatchRequest]*serverCreation{},
+		queues:           map[gameserverstats.MatchRequest]*matchQueue{},
+		draining:         map[string]bool{},
+		reserved:         map[string]int{},
+		parties:          map[string]*party{},
+	}
+
+	if watcher, ok := servers.(GameServerWatcher); ok {
+		go m.watchServers(watcher)
+	}
+	return m
+}
+
+func (m *MatchMakingServer) watchServers(watcher GameServerWatcher) {
+	for e := range watcher.Watch(m.ctx) {
+		if e.FreedCapacity() {
+			m.logger.Info("game server has room", "id", e.Current.Id, "connections", e.Current.Connections)
+			m.capacityChanged()
+		}
 	}
 }
 
 func (m *MatchMakingServer) String() string {
 	return fmt.Sprintf(`-------- MatchMaking --------
 connected: %v
+strategy: %s
 %s
-`, m.listener != nil, m.servers.String())
+`, m.listener != nil, m.selector.Name(), m.servers.String())
 }
@@ -0,0 +1,154 @@
+package amproxy_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+// brokenGameServers creates servers that never become usable
+type brokenGameServers struct {
+	fakeGameServers
+
+	// blocks until the matchmaker gives up on the server
+	hang    bool
+	waitErr error
+	connErr error
+
+	destroyed []string
+}
+
+func (b *brokenGameServers) Destroy(ctx context.Context, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.destroyed = append(b.destroyed, id)
+	return nil
+}
+
+func (b *brokenGameServers) requireDestroyed(t *testing.T, ids ...string) {
+	require.Eventually(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return slices.Equal(ids, b.destroyed)
+	}, time.Second, time.Millisecond)
+}
+
+func (b *brokenGameServers) WaitForReady(ctx context.Context, id string) error {
+	if b.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return b.waitErr
+}
+
+func (b *brokenGameServers) GetConnectionString(id string) (string, error) {
+	if b.connErr != nil {
+		return "", b.connErr
+	}
+	return b.fakeGameServers.GetConnectionString(id)
+}
+
+func TestMatchMakingReadyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.ServerReadyTimeoutMS = 20
+	servers := &brokenGameServers{fakeGameServers: fakeGameServers{capacity: true}, hang: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, config)
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireErrorPacket(t, framer, fmt.Errorf("%w: 0", servermanagement.ErrReadyTimeout))
+	servers.requireDestroyed(t, "0")
+}
+
+func TestMatchMakingPrivateReadyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.ServerReadyTimeoutMS = 20
+	servers := &brokenGameServers{fakeGameServers: fakeGameServers{capacity: true}, hang: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, config)
+	proxy.WithLobbies(gameserverstats.NewMemory())
+
+	_, framer := sendAuth(t, &proxy, packet.CreateLobbyClientAuth(make([]byte, 16), "", ""))
+	requireErrorPacket(t, framer, fmt.Errorf("%w: 0", servermanagement.ErrReadyTimeout))
+	servers.requireDestroyed(t, "0")
+}
+
+func TestMatchMakingServerClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := fmt.Errorf("%w: 0", servermanagement.ErrServerClosed)
+	servers := &brokenGameServers{fakeGameServers: fakeGameServers{capacity: true}, waitErr: closed}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireErrorPacket(t, framer, closed)
+}
+
+func TestMatchMakingServerNotFound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	missing := fmt.Errorf("%w: 0", servermanagement.ErrServerNotFound)
+	servers := &brokenGameServers{fakeGameServers: fakeGameServers{capacity: true}, connErr: missing}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireErrorPacket(t, framer, missing)
+}
+
+// watchedGameServers tells the matchmaker when a server frees up
+type watchedGameServers struct {
+	fakeGameServers
+	events chan gameserverstats.GameServerEvent
+}
+
+func (w *watchedGameServers) Watch(ctx context.Context) <-chan gameserverstats.GameServerEvent {
+	return w.events
+}
+
+func TestMatchMakingWatchServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.QueueRetryIntervalMS = 60_000
+	servers := &watchedGameServers{events: make(chan gameserverstats.GameServerEvent, 1)}
+	defer close(servers.events)
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, config)
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireQueuePosition(t, framer, 1)
+
+	servers.setCapacity(true)
+	servers.events <- gameserverstats.GameServerEvent{
+		Previous: &gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady, Connections: 2},
+		Current:  gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady, Connections: 1},
+	}
+
+	select {
+	case pkt := <-framer.C:
+		for packet.IsQueueStatus(pkt) {
+			pkt = nextPacket(t, framer)
+		}
+		require.Equal(t, "0", packet.ServerAuthGameId(pkt))
+	case <-time.After(time.Second):
+		require.FailNow(t, "queued client was not retried when a server freed up")
+	}
+}
@@ -0,0 +1,147 @@
+package amproxy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+// TrafficStats counts the packets read off of one side of established
+// connections, heartbeats included
+type TrafficStats struct {
+	Bytes   int                       `json:"bytes"`
+	Packets [packet.MAX_TYPE_SIZE]int `json:"packets"`
+}
+
+func (t *TrafficStats) add(pkt *packet.Packet) {
+	t.Bytes += pkt.Size()
+	t.Packets[pkt.Type()]++
+}
+
+// upper bounds, in seconds, of the matchmaking latency buckets
+var latencyBuckets = [...]float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// LatencyHistogram is the time from a client authenticating to it being
+// placed on a game server, queue time included
+type LatencyHistogram struct {
+	Buckets [len(latencyBuckets)]int `json:"buckets"`
+	Count   int                      `json:"count"`
+	Sum     time.Duration            `json:"sum"`
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	h.Count++
+	h.Sum += d
+
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.Buckets[i]++
+			break
+		}
+	}
+}
+
+// MetricsWriter is anything else that is scraped along with the proxy, like
+// the autoscaler of the game servers
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer)
+}
+
+func (m *AMProxy) WithMetrics(writers ...MetricsWriter) *AMProxy {
+	m.metrics = append(m.metrics, writers...)
+	return m
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, s := range samples {
+		if s.labels == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatFloat(s.value))
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, formatFloat(s.value))
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func single(v int) metricSample {
+	return metricSample{value: float64(v)}
+}
+
+func trafficSamples(direction string, t *TrafficStats) []metricSample {
+	samples := []metricSample{}
+	for i, count := range t.Packets {
+		if count == 0 {
+			continue
+		}
+		labels := fmt.Sprintf(`from="%s",type="%s"`, direction, packet.TypeName(packet.PacketType(i)))
+		samples = append(samples, metricSample{labels: labels, value: float64(count)})
+	}
+	return samples
+}
+
+// WriteMetrics writes the proxy stats in the prometheus text format
+func (m *AMProxy) WriteMetrics(w io.Writer) {
+	stats := m.Stats()
+
+	writeMetric(w, "amproxy_connections_active", "gauge", "Client connections currently held by the proxy.", single(stats.ActiveConnections))
+	writeMetric(w, "amproxy_connections_total", "counter", "Client connections admitted by the proxy.", single(stats.TotalConnections))
+	writeMetric(w, "amproxy_connection_errors_total", "counter", "Connections removed because of an error.", single(stats.Errors))
+	writeMetric(w, "amproxy_connections_rejected_total", "counter", "Connections refused by admission control.",
+		metricSample{labels: `reason="denied"`, value: float64(stats.RejectedDenied)},
+		metricSample{labels: `reason="capacity"`, value: float64(stats.RejectedCapacity)},
+		metricSample{labels: `reason="per_ip"`, value: float64(stats.RejectedPerIP)},
+		metricSample{labels: `reason="rate_limit"`, value: float64(stats.RejectedRateLimit)},
+	)
+	writeMetric(w, "amproxy_sessions_total", "counter", "Session resume events.",
+		metricSample{labels: `event="parked"`, value: float64(stats.SessionsParked)},
+		metricSample{labels: `event="resumed"`, value: float64(stats.SessionsResumed)},
+		metricSample{labels: `event="expired"`, value: float64(stats.SessionsExpired)},
+	)
+
+	writeMetric(w, "amproxy_bytes_total", "counter", "Bytes read from established connections.",
+		metricSample{labels: `from="client"`, value: float64(stats.FromClient.Bytes)},
+		metricSample{labels: `from="game_server"`, value: float64(stats.FromGameServer.Bytes)},
+	)
+	packets := append(trafficSamples("client", &stats.FromClient), trafficSamples("game_server", &stats.FromGameServer)...)
+	writeMetric(w, "amproxy_packets_total", "counter", "Packets read from established connections by type.", packets...)
+
+	writeMetric(w, "amproxy_rtt_seconds", "gauge", "Average heartbeat round trip time.",
+		metricSample{labels: `side="client"`, value: stats.ClientRTT.Avg.Seconds()},
+		metricSample{labels: `side="game_server"`, value: stats.GameServerRTT.Avg.Seconds()},
+	)
+
+	latency := []metricSample{}
+	cumulative := 0
+	for i, le := range latencyBuckets {
+		cumulative += stats.Matchmaking.Buckets[i]
+		latency = append(latency, metricSample{labels: fmt.Sprintf(`le="%s"`, formatFloat(le)), value: float64(cumulative)})
+	}
+	latency = append(latency, metricSample{labels: `le="+Inf"`, value: float64(stats.Matchmaking.Count)})
+	writeMetric(w, "amproxy_matchmaking_seconds", "histogram", "Time from authenticating to being placed on a game server.")
+	for _, s := range latency {
+		fmt.Fprintf(w, "amproxy_matchmaking_seconds_bucket{%s} %s\n", s.labels, formatFloat(s.value))
+	}
+	fmt.Fprintf(w, "amproxy_matchmaking_seconds_sum %s\n", formatFloat(stats.Matchmaking.Sum.Seconds()))
+	fmt.Fprintf(w, "amproxy_matchmaking_seconds_count %d\n", stats.Matchmaking.Count)
+
+	writeMetric(w, "amproxy_queue_depth", "gauge", "Clients waiting in the matchmaking queue.", single(m.QueueLength()))
+	writeMetric(w, "amproxy_servers_draining", "gauge", "Game servers that no longer receive new clients.", single(len(m.match.Draining())))
+
+	for _, metrics := range m.metrics {
+		metrics.WriteMetrics(w)
+	}
+}
@@ -2,9 +2,12 @@ package amproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"sync"
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
@@ -58,6 +61,12 @@ type AMTCPProxy struct {
 	logger   *slog.Logger
 	listener net.Listener
 	ready    chan struct{}
+	admin    *http.Server
+
+	// guards the listener and the drain progress
+	mutex   sync.Mutex
+	drain   DrainProgress
+	drained chan struct{}
 }
 
 func NewTCPProxy(proxy *AMProxy, port uint16) AMTCPProxy {
@@ -67,13 +76,16 @@ func NewTCPProxy(proxy *AMProxy, port uint16) AMTCPProxy {
 		logger: ll,
 		proxy:  proxy,
 		ready:  make(chan struct{}, 1),
+
+		mutex:   sync.Mutex{},
+		drained: make(chan struct{}),
 	}
 }
 
 func NewConnection(conn net.Conn) AMConnection {
 	return &AMTCPConnection{
 		conn:    conn,
-		connStr: conn.LocalAddr().String(),
+		connStr: conn.RemoteAddr().String(),
 	}
 }
 
@@ -95,6 +107,25 @@ func (a *AMTCPProxy) WaitForReady(ctx context.Context) {
     }
 }
 
+func (a *AMTCPProxy) runAdmin(host string, port int) {
+	if host == "" {
+		host = DefaultAdminHost
+	}
+	portStr := fmt.Sprintf("%s:%d", host, port)
+	l, err := net.Listen("tcp4", portStr)
+	assert.NoError(err, "unable to create admin listener")
+
+	a.admin = &http.Server{Handler: a.AdminHandler()}
+	a.logger.Info("admin api started", "host:port", portStr)
+
+	go func() {
+		err := a.admin.Serve(l)
+		if !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("admin api stopped", "error", err)
+		}
+	}()
+}
+
 func (a *AMTCPProxy) Run(ctx context.Context) {
 	// TODO validate that 0.0.0.0 works with docker
 	portStr := fmt.Sprintf("0.0.0.0:%d", a.port)
@@ -104,7 +135,13 @@ func (a *AMTCPProxy) Run(ctx context.Context) {
 	assert.NoError(err, "unable to create proxy connection")
 	a.logger.Info("server started", "host:port", portStr)
 
+	a.mutex.Lock()
 	a.listener = l
+	a.mutex.Unlock()
+
+	if a.proxy.config.AdminPort > 0 {
+		a.runAdmin(a.proxy.config.AdminHost, a.proxy.config.AdminPort)
+	}
 
 	ch := make(chan net.Conn, 10)
 	go listen(l, ch)
@@ -126,6 +163,7 @@ outer:
                     if err != nil {
                         a.logger.Error("unable to write error packet into connection", "err", err)
                     }
+                    conn.Close()
                 }
 			}()
 		case <-ctx.Done():
@@ -134,10 +172,21 @@ outer:
 	}
 }
 
-func (a *AMTCPProxy) Close() {
+func (a *AMTCPProxy) closeListener() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
 	if a.listener != nil {
 		a.listener.Close()
 	}
+}
+
+func (a *AMTCPProxy) Close() {
+	a.closeListener()
+
+	if a.admin != nil {
+		a.admin.Close()
+	}
 
 	a.proxy.Close()
 }
@@ -0,0 +1,189 @@
+package amproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+var AMProxyPartyFull = fmt.Errorf("the party is already full")
+var AMProxyPartyMismatch = fmt.Errorf("party members must ask for the same party size, game type and region")
+var AMProxyPartyTooLarge = fmt.Errorf("the party does not fit on a game server")
+var AMProxyPartyDisbanded = fmt.Errorf("the party was disbanded before it found a game server")
+var AMProxyPartyEmpty = fmt.Errorf("a party needs at least one member")
+var AMProxyPartiesDisabled = fmt.Errorf("parties need a server capacity to hold their seats")
+
+// party is a group of clients that are placed on the same game server.  The
+// first member to arrive matchmakes for everyone and the seats stay reserved
+// on the server until every member has arrived or the party times out.
+//
+// everything but the channels is guarded by the MatchMakingServer mutex
+type party struct {
+	code string
+	size int
+	req  gameserverstats.MatchRequest
+
+	members int
+	expired bool
+	timer   *time.Timer
+
+	// closed once info or err is set
+	placed chan struct{}
+	info   *GameConnectionInfo
+	err    error
+
+	// closed once the members can go to the game server
+	released   chan struct{}
+	isReleased bool
+}
+
+func (p *party) isPlaced() bool {
+	return p.info != nil || p.err != nil
+}
+
+// joinParty returns true when the caller is the first member and has to
+// matchmake for the party
+func (m *MatchMakingServer) joinParty(code string, size int, req gameserverstats.MatchRequest) (*party, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if p, ok := m.parties[code]; ok {
+		if p.size != size || p.req != req {
+			return nil, false, AMProxyPartyMismatch
+		}
+		if p.members >= p.size {
+			return nil, false, AMProxyPartyFull
+		}
+
+		p.members++
+		m.releaseIfReadyLocked(p)
+		return p, false, nil
+	}
+
+	p := &party{
+		code:     code,
+		size:     size,
+		req:      req,
+		members:  1,
+		placed:   make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	p.timer = time.AfterFunc(time.Millisecond*time.Duration(m.config.PartyTimeoutMS), func() {
+		m.expireParty(p)
+	})
+	m.parties[code] = p
+
+	return p, true, nil
+}
+
+func (m *MatchMakingServer) leaveParty(p *party) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p.members--
+}
+
+func (m *MatchMakingServer) placeParty(p *party, info *GameConnectionInfo, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	p.info = info
+	p.err = err
+	close(p.placed)
+
+	if err != nil {
+		m.releaseLocked(p)
+		return
+	}
+	m.releaseIfReadyLocked(p)
+}
+
+func (m *MatchMakingServer) expireParty(p *party) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !p.isReleased {
+		m.logger.Warn("party timed out", "code", p.code, "members", p.members, "size", p.size)
+	}
+	p.expired = true
+	m.releaseIfReadyLocked(p)
+}
+
+func (m *MatchMakingServer) releaseIfReadyLocked(p *party) {
+	if !p.isPlaced() {
+		return
+	}
+	if p.members < p.size && !p.expired {
+		return
+	}
+	m.releaseLocked(p)
+}
+
+func (m *MatchMakingServer) releaseLocked(p *party) {
+	if p.isReleased {
+		return
+	}
+
+	p.isReleased = true
+	p.timer.Stop()
+	close(p.released)
+
+	// a late member starts a party of its own
+	if m.parties[p.code] == p {
+		delete(m.parties, p.code)
+	}
+
+	// a party of one is matchmade like everyone else and holds no seats.  A
+	// party that failed to be placed had its seats given back by matchmaking
+	if p.info != nil && p.size > 1 {
+		m.unreserveLocked(p.info.Id, p.size)
+	}
+
+	m.logger.Info("party released", "code", p.code, "members", p.members, "size", p.size, "error", p.err)
+}
+
+// matchmakeParty places every client with the same party code on one game
+// server.  The client is held until the whole party has arrived or the party
+// timed out, whichever comes first
+func (m *MatchMakingServer) matchmakeParty(ctx context.Context, conn AMConnection, connId string, req gameserverstats.MatchRequest, code string, size int) (*GameConnectionInfo, error) {
+	if size < 1 {
+		return nil, AMProxyPartyEmpty
+	}
+	// without a capacity strangers could take the seats of the members still
+	// on their way
+	if size > 1 && m.config.ServerCapacity == 0 {
+		return nil, AMProxyPartiesDisabled
+	}
+	if m.config.ServerCapacity > 0 && size > m.config.ServerCapacity {
+		return nil, AMProxyPartyTooLarge
+	}
+
+	p, leader, err := m.joinParty(code, size, req)
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Info("joined party", "id", connId, "code", code, "leader", leader, "size", size)
+
+	if leader {
+		info, err := m.matchmakeSeats(ctx, conn, connId, req, size)
+		if err != nil && ctx.Err() != nil {
+			err = AMProxyPartyDisbanded
+		}
+		m.placeParty(p, info, err)
+	}
+
+	for _, wait := range []chan struct{}{p.placed, p.released} {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			m.leaveParty(p)
+			return nil, ctx.Err()
+		}
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.info, nil
+}
@@ -0,0 +1,175 @@
+package amproxy_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+func partyConfig() amproxy.AMProxyConfig {
+	config := queueConfig()
+	config.ServerCapacity = 4
+	config.PartyTimeoutMS = 5000
+	return config
+}
+
+func joinParty(t *testing.T, proxy *amproxy.AMProxy, code string, size int) *packet.PacketFramer {
+	client, framer := addPipeConnection(t, proxy)
+	pkt := packet.CreatePartyClientAuth(make([]byte, 16), "", "", code, size)
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+	return framer
+}
+
+func requireNoPacket(t *testing.T, framer *packet.PacketFramer) {
+	select {
+	case pkt := <-framer.C:
+		require.FailNow(t, "expected the proxy to hold the client", "packet", pkt.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func requireGameId(t *testing.T, framer *packet.PacketFramer, gameId string) {
+	pkt := nextPacket(t, framer)
+	require.Equal(t, packet.PacketServerAuthResponse, pkt.Type())
+	require.Equal(t, gameId, packet.ServerAuthGameId(pkt))
+}
+
+func TestMatchMakingParty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, partyConfig())
+
+	friends := []*packet.PacketFramer{
+		joinParty(t, &proxy, "friends", 3),
+		joinParty(t, &proxy, "friends", 3),
+	}
+	requireNoPacket(t, friends[0])
+	requireNoPacket(t, friends[1])
+
+	// three seats are held on the first server so the next party can't fit
+	rivals := []*packet.PacketFramer{
+		joinParty(t, &proxy, "rivals", 2),
+		joinParty(t, &proxy, "rivals", 2),
+	}
+	for _, framer := range rivals {
+		requireGameId(t, framer, "1")
+	}
+
+	friends = append(friends, joinParty(t, &proxy, "friends", 3))
+	for _, framer := range friends {
+		requireGameId(t, framer, "0")
+	}
+
+	require.Eventually(t, func() bool {
+		conns := proxy.Connections()
+		return len(conns) == 5 && conns[0].Party == "friends" && conns[2].Party == "rivals"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMatchMakingPartyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := partyConfig()
+	config.PartyTimeoutMS = 50
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, config)
+
+	framer := joinParty(t, &proxy, "friends", 3)
+	requireGameId(t, framer, "0")
+
+	// the party is gone, a late member gets a party of its own
+	requireGameId(t, joinParty(t, &proxy, "friends", 3), "0")
+}
+
+func TestMatchMakingPartyRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a party stays open until it has a server, queueing the leader keeps it
+	// open while the rest of the members show up
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{}, pipeFactory, partyConfig())
+
+	requireErrorPacket(t, joinParty(t, &proxy, "huge", 5), amproxy.AMProxyPartyTooLarge)
+	requireErrorPacket(t, joinParty(t, &proxy, "nobody", 0), amproxy.AMProxyPartyEmpty)
+
+	requireQueuePosition(t, joinParty(t, &proxy, "friends", 2), 1)
+	requireErrorPacket(t, joinParty(t, &proxy, "friends", 3), amproxy.AMProxyPartyMismatch)
+
+	requireQueuePosition(t, joinParty(t, &proxy, "solo", 1), 2)
+	requireErrorPacket(t, joinParty(t, &proxy, "solo", 1), amproxy.AMProxyPartyFull)
+}
+
+// goneGameServers lose the first servers between being picked and being
+// connected to
+type goneGameServers struct {
+	fakeGameServers
+	gone int
+}
+
+func (g *goneGameServers) GetConnectionString(id string) (string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.gone > 0 {
+		g.gone--
+		return "", servermanagement.ErrServerNotFound
+	}
+	return fmt.Sprintf("fake:%s", id), nil
+}
+
+func TestMatchMakingPartyServerGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &goneGameServers{fakeGameServers: fakeGameServers{capacity: true}, gone: 1}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, partyConfig())
+
+	requireErrorPacket(t, joinParty(t, &proxy, "friends", 4), servermanagement.ErrServerNotFound)
+
+	// the seats of the failed party are free again, the next party fits on
+	// the same server
+	friends := []*packet.PacketFramer{}
+	for range 4 {
+		friends = append(friends, joinParty(t, &proxy, "friends", 4))
+	}
+	for _, framer := range friends {
+		requireGameId(t, framer, "0")
+	}
+}
+
+func TestMatchMakingPartyNeedsCapacity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := partyConfig()
+	config.ServerCapacity = 0
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, config)
+
+	requireErrorPacket(t, joinParty(t, &proxy, "friends", 2), amproxy.AMProxyPartiesDisabled)
+
+	// a party of one holds no seats
+	requireGameId(t, joinParty(t, &proxy, "alone", 1), "0")
+}
+
+func TestMatchMakingPartyTimeoutDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// an unset timeout waits the default instead of expiring right away
+	config := partyConfig()
+	config.PartyTimeoutMS = 0
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, pipeFactory, config)
+
+	framer := joinParty(t, &proxy, "friends", 2)
+	requireNoPacket(t, framer)
+
+	requireGameId(t, joinParty(t, &proxy, "friends", 2), "0")
+	requireGameId(t, framer, "0")
+}
@@ -0,0 +1,69 @@
+package amproxy
+
+import (
+	"time"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+// WithPlayerSessions records which game server every client was placed on,
+// for how long and why it left
+func (m *AMProxy) WithPlayerSessions(players gameserverstats.PlayerSessionStore) *AMProxy {
+	m.players = players
+	return m
+}
+
+// disconnected keeps the first reason the connection is given for closing,
+// whatever closes it afterwards is a consequence of it
+func (a *AMConnectionWrapper) disconnected(reason string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.disconnectReason == "" {
+		a.disconnectReason = reason
+	}
+}
+
+// closeReason is the reason carried by a close connection packet, fallback
+// when the sender gave none
+func closeReason(pkt *packet.Packet, fallback string) string {
+	closing, err := packet.Decode[packet.CloseConnection](pkt)
+	if err != nil || closing.Reason == "" {
+		return fallback
+	}
+	return closing.Reason
+}
+
+func (m *AMProxy) startPlayerSession(w *AMConnectionWrapper) {
+	if m.players == nil {
+		return
+	}
+
+	session := gameserverstats.NewPlayerSession(w.clientId, m.config.ProxyId, w.gsId, gameserverstats.SourceProxy)
+	id, err := m.players.StartPlayerSession(session)
+	if err != nil {
+		m.logger.Error("unable to record player session", "client", w.clientId, "server-id", w.gsId, "error", err)
+		return
+	}
+	w.playerSession = id
+}
+
+func (m *AMProxy) endPlayerSession(w *AMConnectionWrapper) {
+	if m.players == nil || w.playerSession == 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	reason := w.disconnectReason
+	w.mutex.Unlock()
+
+	if reason == "" {
+		reason = "connection closed"
+	}
+
+	err := m.players.EndPlayerSession(w.playerSession, time.Now().UnixMilli(), reason)
+	if err != nil {
+		m.logger.Error("unable to end player session", "client", w.clientId, "server-id", w.gsId, "error", err)
+	}
+}
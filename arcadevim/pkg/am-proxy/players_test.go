@@ -0,0 +1,151 @@
+package amproxy_test
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+func playerConfig() amproxy.AMProxyConfig {
+	config := queueConfig()
+	config.ProxyId = "proxy-0"
+	return config
+}
+
+func requireEnded(t *testing.T, players *gameserverstats.Memory, clientId string) gameserverstats.PlayerSession {
+	var sessions []gameserverstats.PlayerSession
+	require.Eventually(t, func() bool {
+		var err error
+		sessions, err = players.GetPlayerSessions(clientId)
+		require.NoError(t, err)
+		return len(sessions) == 1 && !sessions[0].Connected()
+	}, time.Second, time.Millisecond)
+	return sessions[0]
+}
+
+func TestAMProxyPlayerSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	players := gameserverstats.NewMemory()
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, playerConfig())
+	proxy.WithPlayerSessions(players)
+
+	id := []byte("0123456789abcdef")
+	clientId := hex.EncodeToString(id)
+
+	client, framer := addPipeConnection(t, &proxy)
+	auth := packet.CreateClientAuth(id)
+	_, err := auth.Into(client)
+	require.NoError(t, err)
+	gameId := packet.ServerAuthGameId(nextPacket(t, framer))
+
+	// the game server is told which client it was handed
+	game := <-games.framers
+	forwarded, err := packet.Decode[packet.ClientAuth](nextPacket(t, game))
+	require.NoError(t, err)
+	require.Equal(t, [packet.CLIENT_ID_SIZE]byte(id), forwarded.Id)
+
+	sessions, err := players.GetPlayerSessions(clientId)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.True(t, sessions[0].Connected())
+
+	closing := packet.CreateCloseConnectionWithReason("bye")
+	_, err = closing.Into(client)
+	require.NoError(t, err)
+
+	session := requireEnded(t, players, clientId)
+	require.Equal(t, "proxy-0", session.Proxy)
+	require.Equal(t, gameId, session.GameServerId)
+	require.Equal(t, gameserverstats.SourceProxy, session.Source)
+	require.Equal(t, "bye", session.Reason)
+	require.GreaterOrEqual(t, session.DisconnectedMS, session.ConnectedMS)
+}
+
+func TestAMProxyPlayerSessionKicked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	players := gameserverstats.NewMemory()
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, playerConfig())
+	proxy.WithPlayerSessions(players)
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	nextPacket(t, framer)
+	games.next(t)
+
+	conns := proxy.Connections()
+	require.Len(t, conns, 1)
+	require.NoError(t, proxy.Kick(conns[0].Id))
+
+	session := requireEnded(t, players, conns[0].ClientId)
+	require.Equal(t, amproxy.AMProxyKicked.Error(), session.Reason)
+}
+
+func TestAMProxyPlayerSessionClientLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	players := gameserverstats.NewMemory()
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, playerConfig())
+	proxy.WithPlayerSessions(players)
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	nextPacket(t, framer)
+	games.next(t)
+
+	clientId := proxy.Connections()[0].ClientId
+	client.Close()
+
+	session := requireEnded(t, players, clientId)
+	require.Equal(t, "client connection lost", session.Reason)
+}
+
+func TestAMProxyBadPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	players := gameserverstats.NewMemory()
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{capacity: true}, games.factory, playerConfig())
+	proxy.WithPlayerSessions(players)
+
+	bad, badFramer := addPipeConnection(t, &proxy)
+	authenticate(t, bad)
+	nextPacket(t, badFramer)
+	games.next(t)
+	badId := proxy.Connections()[0].ClientId
+
+	good, goodFramer := addPipeConnection(t, &proxy)
+	auth := packet.CreateClientAuth([]byte("0123456789abcdef"))
+	_, err := auth.Into(good)
+	require.NoError(t, err)
+	nextPacket(t, goodFramer)
+	games.next(t)
+
+	// only the connection that sent the ping is dropped
+	ping := packet.PacketFromParts(packet.PacketPing, packet.EncodingJSON, []byte("not a heartbeat"))
+	_, err = ping.Into(bad)
+	require.NoError(t, err)
+
+	session := requireEnded(t, players, badId)
+	require.NotEmpty(t, session.Reason)
+	require.Len(t, proxy.Connections(), 1)
+
+	ping = packet.CreatePing(1, time.Now())
+	_, err = ping.Into(good)
+	require.NoError(t, err)
+	require.Equal(t, packet.PacketPong, nextPacket(t, goodFramer).Type())
+}
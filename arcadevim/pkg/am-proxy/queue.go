@@ -0,0 +1,333 @@
+package amproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var AMProxyNoCapacity = fmt.Errorf("no game server capacity available")
+var AMProxyQueueTimeout = fmt.Errorf("timed out waiting in the matchmaking queue")
+
+// how much a new sample moves the time it takes a ticket to leave the queue
+const queueEtaWeight = 0.2
+
+type queueResult struct {
+	gameId string
+	err    error
+}
+
+type queueTicket struct {
+	id       string
+	req      gameserverstats.MatchRequest
+	seats    int
+	enqueued time.Time
+	result   chan queueResult
+	queue    *matchQueue
+}
+
+// matchQueue is the FIFO of clients waiting on capacity for one game type
+// and region.  The queue is only ever served from the head so that no client
+// can be starved, a game type that is out of capacity only holds up the
+// clients that asked for it
+type matchQueue struct {
+	mutex   sync.Mutex
+	tickets []*queueTicket
+	running bool
+	wake    chan struct{}
+
+	dequeueEvery time.Duration
+	lastDequeue  time.Time
+}
+
+func newMatchQueue() *matchQueue {
+	return &matchQueue{
+		mutex:   sync.Mutex{},
+		tickets: []*queueTicket{},
+		running: false,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// push returns true when the caller is responsible for starting the queue
+func (q *matchQueue) push(ticket *queueTicket) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.tickets = append(q.tickets, ticket)
+	if q.running {
+		return false
+	}
+
+	q.running = true
+	return true
+}
+
+func (q *matchQueue) head() *queueTicket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.tickets) == 0 {
+		return nil
+	}
+	return q.tickets[0]
+}
+
+// stop will only stop the queue if there is nothing left in it
+func (q *matchQueue) stop() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.tickets) > 0 {
+		return false
+	}
+
+	q.running = false
+	return true
+}
+
+func (q *matchQueue) remove(ticket *queueTicket) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	idx := slices.Index(q.tickets, ticket)
+	if idx == -1 {
+		return false
+	}
+
+	q.tickets = slices.Delete(q.tickets, idx, idx+1)
+	return true
+}
+
+// pop removes a ticket that has been matched and feeds the eta estimate
+func (q *matchQueue) pop(ticket *queueTicket, now time.Time) bool {
+	if !q.remove(ticket) {
+		return false
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// only count the time the ticket was actually waiting on others, an
+	// empty queue shouldn't make the next person think it's a long wait
+	sample := now.Sub(ticket.enqueued)
+	if !q.lastDequeue.IsZero() && q.lastDequeue.After(ticket.enqueued) {
+		sample = now.Sub(q.lastDequeue)
+	}
+
+	if q.dequeueEvery == 0 {
+		q.dequeueEvery = sample
+	} else {
+		q.dequeueEvery = time.Duration(float64(q.dequeueEvery)*(1-queueEtaWeight) + float64(sample)*queueEtaWeight)
+	}
+	q.lastDequeue = now
+
+	return true
+}
+
+func (q *matchQueue) status(ticket *queueTicket) (packet.QueueStatus, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	idx := slices.Index(q.tickets, ticket)
+	if idx == -1 {
+		return packet.QueueStatus{}, false
+	}
+
+	position := idx + 1
+	return packet.QueueStatus{
+		Position: position,
+		ETAMS:    (q.dequeueEvery * time.Duration(position)).Milliseconds(),
+	}, true
+}
+
+func (q *matchQueue) drain() []*queueTicket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tickets := q.tickets
+	q.tickets = []*queueTicket{}
+	q.running = false
+	return tickets
+}
+
+func (q *matchQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.tickets)
+}
+
+func (q *matchQueue) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *MatchMakingServer) capacityChanged() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, q := range m.queues {
+		q.wakeUp()
+	}
+}
+
+// QueueLength is the number of clients waiting across every queue
+func (m *MatchMakingServer) QueueLength() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	length := 0
+	for _, q := range m.queues {
+		length += q.Len()
+	}
+	return length
+}
+
+// queued is true when clients are already waiting on the same match
+func (m *MatchMakingServer) queued(req gameserverstats.MatchRequest) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	q, ok := m.queues[req]
+	return ok && q.Len() > 0
+}
+
+// pushTicket puts the ticket into the queue of its request, true when the
+// caller is responsible for starting the queue
+func (m *MatchMakingServer) pushTicket(ticket *queueTicket) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	q, ok := m.queues[ticket.req]
+	if !ok {
+		q = newMatchQueue()
+		m.queues[ticket.req] = q
+	}
+
+	ticket.queue = q
+	return q.push(ticket)
+}
+
+// stopQueue forgets the queue of req once nobody is left in it
+func (m *MatchMakingServer) stopQueue(req gameserverstats.MatchRequest, q *matchQueue) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !q.stop() {
+		return false
+	}
+	delete(m.queues, req)
+	return true
+}
+
+func (m *MatchMakingServer) sendQueueStatus(conn AMConnection, ticket *queueTicket) error {
+	status, ok := ticket.queue.status(ticket)
+	if !ok {
+		return nil
+	}
+
+	pkt := packet.MustEncode(packet.PacketQueueStatus, status)
+	_, err := pkt.Into(conn)
+	return err
+}
+
+func (m *MatchMakingServer) leaveQueue(ticket *queueTicket, reason error) (string, error) {
+	if ticket.queue.remove(ticket) {
+		m.logger.Warn("client left the queue", "id", ticket.id, "reason", reason, "waited", time.Since(ticket.enqueued))
+		return "", reason
+	}
+
+	// the queue already matched us, the result is on its way
+	res := <-ticket.result
+	return res.gameId, res.err
+}
+
+func (m *MatchMakingServer) enqueue(ctx context.Context, conn AMConnection, connId string, req gameserverstats.MatchRequest, seats int) (string, error) {
+	ticket := &queueTicket{
+		id:       connId,
+		req:      req,
+		seats:    seats,
+		enqueued: time.Now(),
+		result:   make(chan queueResult, 1),
+	}
+
+	if m.pushTicket(ticket) {
+		go m.runQueue(req, ticket.queue)
+	}
+
+	statusTicker := time.NewTicker(time.Millisecond * time.Duration(max(m.config.QueueStatusIntervalMS, 1)))
+	defer statusTicker.Stop()
+
+	var timeout <-chan time.Time
+	if m.config.QueueTimeoutMS > 0 {
+		timer := time.NewTimer(time.Millisecond * time.Duration(m.config.QueueTimeoutMS))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if err := m.sendQueueStatus(conn, ticket); err != nil {
+		return m.leaveQueue(ticket, err)
+	}
+
+	for {
+		select {
+		case res := <-ticket.result:
+			m.logger.Info("client left the queue matched", "id", ticket.id, "gameId", res.gameId, "error", res.err, "waited", time.Since(ticket.enqueued))
+			return res.gameId, res.err
+		case <-statusTicker.C:
+			if err := m.sendQueueStatus(conn, ticket); err != nil {
+				return m.leaveQueue(ticket, err)
+			}
+		case <-timeout:
+			return m.leaveQueue(ticket, AMProxyQueueTimeout)
+		case <-ctx.Done():
+			return m.leaveQueue(ticket, ctx.Err())
+		}
+	}
+}
+
+func (m *MatchMakingServer) runQueue(req gameserverstats.MatchRequest, q *matchQueue) {
+	m.logger.Info("queue started", "request", req.String())
+	retry := time.NewTicker(time.Millisecond * time.Duration(max(m.config.QueueRetryIntervalMS, 1)))
+	defer retry.Stop()
+
+	for {
+		ticket := q.head()
+		if ticket == nil {
+			if m.stopQueue(req, q) {
+				m.logger.Info("queue empty, stopping", "request", req.String())
+				return
+			}
+			continue
+		}
+
+		gameId, err := m.findServer(ticket.id, ticket.req, ticket.seats)
+		if err == nil || !errors.Is(err, AMProxyNoCapacity) {
+			if q.pop(ticket, time.Now()) {
+				ticket.result <- queueResult{gameId: gameId, err: err}
+			} else if err == nil && ticket.seats > 1 {
+				// the party gave up while its seats were being found
+				m.unreserve(gameId, ticket.seats)
+			}
+			continue
+		}
+
+		select {
+		case <-retry.C:
+		case <-q.wake:
+		case <-m.ctx.Done():
+			for _, t := range q.drain() {
+				t.result <- queueResult{err: m.ctx.Err()}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package amproxy_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+var errAtMaxServers = fmt.Errorf("at max servers")
+
+type fakeGameServers struct {
+	mutex    sync.Mutex
+	capacity bool
+	servers  []gameserverstats.GameServerConfig
+}
+
+func (f *fakeGameServers) setCapacity(capacity bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.capacity = capacity
+}
+
+func (f *fakeGameServers) ListServers(req gameserverstats.MatchRequest) []gameserverstats.GameServerConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	out := []gameserverstats.GameServerConfig{}
+	for _, gs := range f.servers {
+		if req.Matches(&gs) {
+			out = append(out, gs)
+		}
+	}
+	return out
+}
+
+func (f *fakeGameServers) CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.capacity {
+		return "", errAtMaxServers
+	}
+	visibility := gameserverstats.VisibilityPublic
+	if req.Private {
+		visibility = gameserverstats.VisibilityPrivate
+	}
+
+	id := fmt.Sprintf("%d", len(f.servers))
+	f.servers = append(f.servers, gameserverstats.GameServerConfig{
+		Id:         id,
+		State:      gameserverstats.GSStateReady,
+		GameType:   req.GameType,
+		Region:     req.Region,
+		Visibility: visibility,
+	})
+	return id, nil
+}
+
+func (f *fakeGameServers) WaitForReady(ctx context.Context, id string) error {
+	return nil
+}
+
+func (f *fakeGameServers) GetConnectionString(id string) (string, error) {
+	return fmt.Sprintf("fake:%s", id), nil
+}
+
+func (f *fakeGameServers) String() string {
+	return "fakeGameServers"
+}
+
+func pipeFactory(addr string) (amproxy.AMConnection, error) {
+	game, proxySide := net.Pipe()
+	go func() {
+		framer := packet.NewPacketFramer()
+		go packet.FrameWithReader(&framer, game)
+		for range framer.C {
+		}
+	}()
+	return amproxy.NewConnection(proxySide), nil
+}
+
+func queueConfig() amproxy.AMProxyConfig {
+	return amproxy.AMProxyConfig{
+		AuthTimeoutMS:         1000,
+		QueueTimeoutMS:        1000,
+		QueueStatusIntervalMS: 10,
+		QueueRetryIntervalMS:  10,
+	}
+}
+
+func authenticate(t *testing.T, client net.Conn) {
+	pkt := packet.CreateClientAuth(make([]byte, 16))
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+}
+
+func nextPacket(t *testing.T, framer *packet.PacketFramer) *packet.Packet {
+	select {
+	case pkt := <-framer.C:
+		return pkt
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected a packet from the proxy")
+	}
+	return nil
+}
+
+func requireQueuePosition(t *testing.T, framer *packet.PacketFramer, position int) {
+	pkt := nextPacket(t, framer)
+	require.Equal(t, packet.PacketQueueStatus, pkt.Type())
+	status, err := packet.Decode[packet.QueueStatus](pkt)
+	require.NoError(t, err)
+	require.Equal(t, position, status.Position)
+}
+
+func TestMatchMakingQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &fakeGameServers{}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+
+	first, firstFramer := addPipeConnection(t, &proxy)
+	authenticate(t, first)
+	requireQueuePosition(t, firstFramer, 1)
+
+	second, secondFramer := addPipeConnection(t, &proxy)
+	authenticate(t, second)
+	requireQueuePosition(t, secondFramer, 2)
+	require.Equal(t, 2, proxy.QueueLength())
+
+	servers.setCapacity(true)
+
+	for _, framer := range []*packet.PacketFramer{firstFramer, secondFramer} {
+		pkt := nextPacket(t, framer)
+		for packet.IsQueueStatus(pkt) {
+			pkt = nextPacket(t, framer)
+		}
+		require.Equal(t, "0", packet.ServerAuthGameId(pkt))
+	}
+	require.Equal(t, 0, proxy.QueueLength())
+}
+
+func TestMatchMakingQueueTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.QueueTimeoutMS = 50
+	config.QueueStatusIntervalMS = 1000
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{}, pipeFactory, config)
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireQueuePosition(t, framer, 1)
+	requireErrorPacket(t, framer, amproxy.AMProxyQueueTimeout)
+	require.Equal(t, 0, proxy.QueueLength())
+}
+
+func TestMatchMakingQueueDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := amproxy.NewAMProxy(ctx, &fakeGameServers{}, pipeFactory, queueConfig())
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	requireQueuePosition(t, framer, 1)
+
+	client.Close()
+	require.Eventually(t, func() bool {
+		return proxy.QueueLength() == 0 && proxy.Stats().ActiveConnections == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMatchMakingGameTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := queueConfig()
+	config.DefaultRegion = "us-east"
+	servers := &fakeGameServers{capacity: true}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, config)
+
+	matched := func(gameType string, region string) string {
+		client, framer := addPipeConnection(t, &proxy)
+		pkt := packet.CreateMatchClientAuth(make([]byte, 16), gameType, region)
+		_, err := pkt.Into(client)
+		require.NoError(t, err)
+
+		rsp := nextPacket(t, framer)
+		require.Equal(t, packet.PacketServerAuthResponse, rsp.Type())
+		return packet.ServerAuthGameId(rsp)
+	}
+
+	require.Equal(t, "0", matched("tetris", ""))
+	require.Equal(t, "1", matched("snake", ""))
+	require.Equal(t, "0", matched("tetris", "us-east"))
+	require.Equal(t, "2", matched("tetris", "eu-west"))
+
+	require.Equal(t, []gameserverstats.MatchRequest{
+		{GameType: "tetris", Region: "us-east"},
+		{GameType: "snake", Region: "us-east"},
+		{GameType: "tetris", Region: "eu-west"},
+	}, []gameserverstats.MatchRequest{
+		{GameType: servers.servers[0].GameType, Region: servers.servers[0].Region},
+		{GameType: servers.servers[1].GameType, Region: servers.servers[1].Region},
+		{GameType: servers.servers[2].GameType, Region: servers.servers[2].Region},
+	})
+
+	require.Eventually(t, func() bool {
+		conns := proxy.Connections()
+		return len(conns) == 4 && conns[1].GameType == "snake" && conns[1].Region == "us-east"
+	}, time.Second, 5*time.Millisecond)
+}
+
+// fullGameServers is out of capacity for one game type only
+type fullGameServers struct {
+	fakeGameServers
+	full string
+}
+
+func (f *fullGameServers) CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error) {
+	if req.GameType == f.full {
+		return "", errAtMaxServers
+	}
+	return f.fakeGameServers.CreateNewServer(ctx, req)
+}
+
+func TestMatchMakingQueuePerGameType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &fullGameServers{fakeGameServers: fakeGameServers{capacity: true}, full: "tetris"}
+	proxy := amproxy.NewAMProxy(ctx, servers, pipeFactory, queueConfig())
+
+	waiting, waitingFramer := addPipeConnection(t, &proxy)
+	pkt := packet.CreateMatchClientAuth(make([]byte, 16), "tetris", "")
+	_, err := pkt.Into(waiting)
+	require.NoError(t, err)
+	requireQueuePosition(t, waitingFramer, 1)
+
+	// a full game type does not hold up one with room
+	client, framer := addPipeConnection(t, &proxy)
+	pkt = packet.CreateMatchClientAuth(make([]byte, 16), "snake", "")
+	_, err = pkt.Into(client)
+	require.NoError(t, err)
+	rsp := nextPacket(t, framer)
+	require.Equal(t, packet.PacketServerAuthResponse, rsp.Type())
+	require.Equal(t, "0", packet.ServerAuthGameId(rsp))
+	require.Equal(t, 1, proxy.QueueLength())
+}
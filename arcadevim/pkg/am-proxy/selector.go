@@ -0,0 +1,137 @@
+package amproxy
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"sync"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+const (
+	SelectFillFirst      = "fill-first"
+	SelectLeastLoaded    = "least-loaded"
+	SelectRoundRobin     = "round-robin"
+	SelectConsistentHash = "consistent-hash"
+)
+
+// ServerSelector picks which of the candidate game servers a client goes to.
+// candidates are the ready servers that still have room, when there are none
+// servermanagement.NoBestServer is returned
+type ServerSelector interface {
+	Name() string
+	Select(clientId string, candidates []gameserverstats.GameServerConfig) (string, error)
+}
+
+func NewServerSelector(name string) ServerSelector {
+	switch name {
+	case SelectFillFirst:
+		return &FillFirstSelector{}
+	case SelectLeastLoaded:
+		return &LeastLoadedSelector{}
+	case SelectRoundRobin:
+		return &RoundRobinSelector{mutex: sync.Mutex{}}
+	case SelectConsistentHash:
+		return &ConsistentHashSelector{}
+	}
+
+	assert.Never("unknown server selection strategy", "name", name)
+	return nil
+}
+
+// FillFirstSelector packs clients onto the most loaded server, this keeps
+// the fleet small and lets empty servers idle out
+type FillFirstSelector struct{}
+
+func (f *FillFirstSelector) Name() string {
+	return SelectFillFirst
+}
+
+func (f *FillFirstSelector) Select(clientId string, candidates []gameserverstats.GameServerConfig) (string, error) {
+	if len(candidates) == 0 {
+		return "", servermanagement.NoBestServer
+	}
+
+	best := slices.MaxFunc(candidates, func(a, b gameserverstats.GameServerConfig) int {
+		return cmp.Compare(a.Load, b.Load)
+	})
+	return best.Id, nil
+}
+
+type LeastLoadedSelector struct{}
+
+func (l *LeastLoadedSelector) Name() string {
+	return SelectLeastLoaded
+}
+
+func (l *LeastLoadedSelector) Select(clientId string, candidates []gameserverstats.GameServerConfig) (string, error) {
+	if len(candidates) == 0 {
+		return "", servermanagement.NoBestServer
+	}
+
+	best := slices.MinFunc(candidates, func(a, b gameserverstats.GameServerConfig) int {
+		return cmp.Compare(a.Load, b.Load)
+	})
+	return best.Id, nil
+}
+
+type RoundRobinSelector struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (r *RoundRobinSelector) Name() string {
+	return SelectRoundRobin
+}
+
+func (r *RoundRobinSelector) Select(clientId string, candidates []gameserverstats.GameServerConfig) (string, error) {
+	if len(candidates) == 0 {
+		return "", servermanagement.NoBestServer
+	}
+
+	// the candidate order comes from the database, sort it so the rotation
+	// is stable between calls
+	ids := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.Id)
+	}
+	slices.Sort(ids)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := ids[r.next%len(ids)]
+	r.next++
+	return id, nil
+}
+
+// ConsistentHashSelector sends the same client to the same server for as long
+// as that server is a candidate.  It uses rendezvous hashing so that a server
+// coming or going only moves the clients that hashed to it
+type ConsistentHashSelector struct{}
+
+func (c *ConsistentHashSelector) Name() string {
+	return SelectConsistentHash
+}
+
+func rendezvousScore(clientId string, serverId string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(clientId))
+	h.Write([]byte{0})
+	h.Write([]byte(serverId))
+	return h.Sum64()
+}
+
+func (c *ConsistentHashSelector) Select(clientId string, candidates []gameserverstats.GameServerConfig) (string, error) {
+	if len(candidates) == 0 {
+		return "", servermanagement.NoBestServer
+	}
+
+	best := slices.MaxFunc(candidates, func(a, b gameserverstats.GameServerConfig) int {
+		return cmp.Compare(rendezvousScore(clientId, a.Id), rendezvousScore(clientId, b.Id))
+	})
+	return best.Id, nil
+}
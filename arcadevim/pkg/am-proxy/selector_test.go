@@ -0,0 +1,90 @@
+package amproxy_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+var candidates = []gameserverstats.GameServerConfig{
+	{Id: "b", Load: 0.5},
+	{Id: "a", Load: 0.1},
+	{Id: "c", Load: 0.8},
+}
+
+func TestSelectorsNoCandidates(t *testing.T) {
+	for _, name := range []string{
+		amproxy.SelectFillFirst,
+		amproxy.SelectLeastLoaded,
+		amproxy.SelectRoundRobin,
+		amproxy.SelectConsistentHash,
+	} {
+		selector := amproxy.NewServerSelector(name)
+		require.Equal(t, name, selector.Name())
+
+		_, err := selector.Select("client", []gameserverstats.GameServerConfig{})
+		require.ErrorIs(t, err, servermanagement.NoBestServer, name)
+	}
+}
+
+func TestSelectorLoad(t *testing.T) {
+	id, err := amproxy.NewServerSelector(amproxy.SelectFillFirst).Select("client", candidates)
+	require.NoError(t, err)
+	require.Equal(t, "c", id)
+
+	id, err = amproxy.NewServerSelector(amproxy.SelectLeastLoaded).Select("client", candidates)
+	require.NoError(t, err)
+	require.Equal(t, "a", id)
+}
+
+func TestSelectorRoundRobin(t *testing.T) {
+	selector := amproxy.NewServerSelector(amproxy.SelectRoundRobin)
+
+	ids := []string{}
+	for range 4 {
+		id, err := selector.Select("client", candidates)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	require.Equal(t, []string{"a", "b", "c", "a"}, ids)
+}
+
+func TestSelectorConsistentHash(t *testing.T) {
+	selector := amproxy.NewServerSelector(amproxy.SelectConsistentHash)
+
+	first, err := selector.Select("client-69", candidates)
+	require.NoError(t, err)
+	for range 10 {
+		id, err := selector.Select("client-69", candidates)
+		require.NoError(t, err)
+		require.Equal(t, first, id)
+	}
+
+	// removing a server the client isn't on must not move the client
+	remaining := []gameserverstats.GameServerConfig{}
+	removed := false
+	for _, c := range candidates {
+		if c.Id != first && !removed {
+			removed = true
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+
+	id, err := selector.Select("client-69", remaining)
+	require.NoError(t, err)
+	require.Equal(t, first, id)
+
+	spread := map[string]bool{}
+	for i := range 64 {
+		id, err := selector.Select(fmt.Sprintf("client-%d", i), candidates)
+		require.NoError(t, err)
+		spread[id] = true
+	}
+	require.Len(t, spread, len(candidates))
+}
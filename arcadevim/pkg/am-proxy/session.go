@@ -0,0 +1,75 @@
+package amproxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var AMProxySessionNotFound = fmt.Errorf("session not found or has expired")
+
+type SessionToken = [packet.SESSION_TOKEN_SIZE]byte
+
+// sessionStore maps the tokens handed out in the server auth response to the
+// connection that can be resumed with them.  A token is good for one resume,
+// the resumed connection is handed a new one
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[SessionToken]*AMConnectionWrapper
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		mutex:    sync.Mutex{},
+		sessions: map[SessionToken]*AMConnectionWrapper{},
+	}
+}
+
+func newSessionToken() SessionToken {
+	token := SessionToken{}
+	_, err := rand.Read(token[:])
+	assert.NoError(err, "unable to read random bytes for a session token")
+	return token
+}
+
+func (s *sessionStore) create(w *AMConnectionWrapper) SessionToken {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := newSessionToken()
+	for _, ok := s.sessions[token]; ok; _, ok = s.sessions[token] {
+		token = newSessionToken()
+	}
+
+	s.sessions[token] = w
+	return token
+}
+
+// take removes the session so that only one connection can ever claim it
+func (s *sessionStore) take(token SessionToken) *AMConnectionWrapper {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+
+	delete(s.sessions, token)
+	return w
+}
+
+func (s *sessionStore) remove(token SessionToken) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *sessionStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.sessions)
+}
@@ -0,0 +1,186 @@
+package amproxy_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	amproxy "github.com/khulnasoft/next.vim/arcadevim/pkg/am-proxy"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+// gameConns hands the game server side of every connection the proxy makes
+// to the test
+type gameConns struct {
+	mutex   sync.Mutex
+	created int
+	framers chan *packet.PacketFramer
+	closed  chan struct{}
+}
+
+func newGameConns() *gameConns {
+	return &gameConns{
+		mutex:   sync.Mutex{},
+		framers: make(chan *packet.PacketFramer, 10),
+		closed:  make(chan struct{}, 10),
+	}
+}
+
+func (g *gameConns) factory(addr string) (amproxy.AMConnection, error) {
+	g.mutex.Lock()
+	g.created++
+	g.mutex.Unlock()
+
+	game, proxySide := net.Pipe()
+	framer := packet.NewPacketFramer()
+	go func() {
+		packet.FrameWithReader(&framer, game)
+		g.closed <- struct{}{}
+	}()
+	g.framers <- &framer
+
+	return amproxy.NewConnection(proxySide), nil
+}
+
+// next is the game server side of the next connection, the client auth the
+// proxy forwards to the game server is consumed
+func (g *gameConns) next(t *testing.T) *packet.PacketFramer {
+	var framer *packet.PacketFramer
+	select {
+	case framer = <-g.framers:
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected the proxy to connect to the game server")
+	}
+
+	require.Equal(t, packet.PacketClientAuth, nextPacket(t, framer).Type())
+	return framer
+}
+
+func (g *gameConns) Created() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.created
+}
+
+func sessionConfig(graceMS int64) amproxy.AMProxyConfig {
+	config := queueConfig()
+	config.SessionGraceMS = graceMS
+	return config
+}
+
+func requireSession(t *testing.T, framer *packet.PacketFramer) packet.ServerAuthResponse {
+	pkt := nextPacket(t, framer)
+	require.Equal(t, packet.PacketServerAuthResponse, pkt.Type())
+	rsp, err := packet.Decode[packet.ServerAuthResponse](pkt)
+	require.NoError(t, err)
+	require.True(t, rsp.Accepted)
+	require.True(t, rsp.HasSession())
+	return rsp
+}
+
+func resume(t *testing.T, client net.Conn, session [packet.SESSION_TOKEN_SIZE]byte) {
+	pkt := packet.CreateClientResume(session)
+	_, err := pkt.Into(client)
+	require.NoError(t, err)
+}
+
+func TestAMProxySessionResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &fakeGameServers{capacity: true}
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, servers, games.factory, sessionConfig(1000))
+
+	first, firstFramer := addPipeConnection(t, &proxy)
+	authenticate(t, first)
+	session := requireSession(t, firstFramer)
+	game := games.next(t)
+
+	// the client drops without saying goodbye
+	first.Close()
+	require.Eventually(t, func() bool {
+		return proxy.Stats().SessionsParked == 1
+	}, time.Second, time.Millisecond)
+
+	second, secondFramer := addPipeConnection(t, &proxy)
+	resume(t, second, session.Session)
+	resumed := requireSession(t, secondFramer)
+	require.Equal(t, session.GameId, resumed.GameId)
+	require.NotEqual(t, session.Session, resumed.Session)
+
+	// same game connection, both directions
+	msg := packet.CreateMessage("still here")
+	_, err := msg.Into(second)
+	require.NoError(t, err)
+	require.Equal(t, "still here", mustDecodeMessage(t, nextPacket(t, game)))
+
+	require.Equal(t, 1, games.Created())
+	require.Equal(t, 1, proxy.Stats().SessionsResumed)
+	require.Equal(t, 1, proxy.Stats().ActiveConnections)
+
+	// a token only resumes once
+	third, thirdFramer := addPipeConnection(t, &proxy)
+	resume(t, third, session.Session)
+	requireErrorPacket(t, thirdFramer, amproxy.AMProxySessionNotFound)
+}
+
+func TestAMProxySessionExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &fakeGameServers{capacity: true}
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, servers, games.factory, sessionConfig(50))
+
+	first, firstFramer := addPipeConnection(t, &proxy)
+	authenticate(t, first)
+	session := requireSession(t, firstFramer)
+	games.next(t)
+
+	first.Close()
+	select {
+	case <-games.closed:
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected the game connection to close once the grace window passed")
+	}
+	require.Equal(t, 1, proxy.Stats().SessionsExpired)
+
+	second, secondFramer := addPipeConnection(t, &proxy)
+	resume(t, second, session.Session)
+	requireErrorPacket(t, secondFramer, amproxy.AMProxySessionNotFound)
+}
+
+func TestAMProxySessionDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := &fakeGameServers{capacity: true}
+	games := newGameConns()
+	proxy := amproxy.NewAMProxy(ctx, servers, games.factory, sessionConfig(0))
+
+	client, framer := addPipeConnection(t, &proxy)
+	authenticate(t, client)
+	pkt := nextPacket(t, framer)
+	rsp, err := packet.Decode[packet.ServerAuthResponse](pkt)
+	require.NoError(t, err)
+	require.False(t, rsp.HasSession())
+	games.next(t)
+
+	client.Close()
+	select {
+	case <-games.closed:
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected the game connection to close with the client")
+	}
+}
+
+func mustDecodeMessage(t *testing.T, pkt *packet.Packet) string {
+	require.Equal(t, packet.PacketMessage, pkt.Type())
+	msg, err := packet.Decode[string](pkt)
+	require.NoError(t, err)
+	return msg
+}
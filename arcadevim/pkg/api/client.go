@@ -3,7 +3,9 @@ package api
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"strconv"
@@ -12,7 +14,6 @@ import (
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
-	"github.com/khulnasoft/next.vim/arcadevim/pkg/utils"
 )
 
 type ClientState int
@@ -31,6 +32,8 @@ func ClientStateToString(state ClientState) string {
 		return "initialized"
 	case CSConnecting:
 		return "connecting"
+	case CSAuthenticating:
+		return "authenticating"
 	case CSConnected:
 		return "connected"
 	case CSDisconnected:
@@ -41,6 +44,8 @@ func ClientStateToString(state ClientState) string {
 	return ""
 }
 
+var ClientRejected = errors.New("server rejected the client")
+
 type hostAndPort struct {
 	host string
 	port uint16
@@ -59,6 +64,29 @@ type Client struct {
 	id       [16]byte
 	framer   packet.PacketFramer
 	ServerId string
+
+	QueuePosition int
+
+	// what to be matched into, empty lets the proxy decide
+	GameType string
+	Region   string
+
+	// clients with the same party code land on the same game server
+	Party     string
+	PartySize int
+
+	// either start a private lobby or join one by its code.  LobbyCode is
+	// the code of the lobby once connected
+	CreateLobby bool
+	JoinLobby   string
+	LobbyCode   string
+
+	// why the proxy closed the connection, if it said
+	CloseReason string
+
+	// handed out by the proxy when the session can be resumed after the
+	// connection drops
+	session packet.ServerAuthResponse
 }
 
 func (c *Client) String() string {
@@ -119,7 +147,7 @@ func (d *Client) Write(data []byte) error {
 	return err
 }
 
-func (d *Client) Connect(ctx context.Context) error {
+func (d *Client) dial() net.Conn {
 	d.State = CSConnecting
 	d.logger.Info("client connecting to match making")
 	connStr := fmt.Sprintf("%s:%d", d.Host, d.Port)
@@ -130,44 +158,132 @@ func (d *Client) Connect(ctx context.Context) error {
 
 	// TODO emit event?
 	d.State = CSAuthenticating
+	return conn
+}
 
-	pkt := packet.CreateClientAuth(d.id[:])
+func (d *Client) Connect(ctx context.Context) error {
+	conn := d.dial()
+	auth := packet.CreateMatchClientAuth(d.id[:], d.GameType, d.Region)
+	if d.CreateLobby {
+		auth = packet.CreateLobbyClientAuth(d.id[:], d.GameType, d.Region)
+	} else if d.JoinLobby != "" {
+		auth = packet.CreateJoinLobbyClientAuth(d.id[:], d.JoinLobby)
+	} else if d.Party != "" {
+		auth = packet.CreatePartyClientAuth(d.id[:], d.GameType, d.Region, d.Party, d.PartySize)
+	}
+	return d.handshake(ctx, conn, auth)
+}
+
+func (d *Client) CanResume() bool {
+	return d.session.HasSession()
+}
 
-	// TODO handle framer errors?
-	go packet.FrameWithReader(&d.framer, conn)
+// Resume reconnects to the same game server after the connection dropped
+func (d *Client) Resume(ctx context.Context) error {
+	assert.Assert(d.CanResume(), "the proxy did not hand out a session to resume")
+
+	d.closed = false
+	d.framer = packet.NewPacketFramer()
+	conn := d.dial()
+	return d.handshake(ctx, conn, packet.CreateClientResume(d.session.Session))
+}
+
+func (d *Client) handshake(ctx context.Context, conn net.Conn, pkt packet.Packet) error {
+	frameErr := make(chan error, 1)
+	go func() {
+		frameErr <- packet.FrameWithReader(&d.framer, conn)
+	}()
 
 	pkt.Into(conn)
 	rsp, ok := <-d.framer.C
 
 	assert.Assert(ok, "expected channel to remain open")
 	assert.Assert(rsp != nil, "expected a packet")
+
+	// the proxy tells us where we are while we wait on a server
+	for packet.IsQueueStatus(rsp) {
+		status, err := packet.Decode[packet.QueueStatus](rsp)
+		assert.NoError(err, "unable to decode the queue status")
+		d.logger.Info("waiting in queue", "position", status.Position, "etaMS", status.ETAMS)
+		d.QueuePosition = status.Position
+
+		rsp, ok = <-d.framer.C
+		assert.Assert(ok, "expected channel to remain open")
+	}
+
+	if rsp.Type() == packet.PacketError {
+		msg, err := packet.Decode[string](rsp)
+		assert.NoError(err, "unable to decode the error packet")
+		d.logger.Error("server rejected client", "error", msg)
+		d.State = CSDisconnected
+		conn.Close()
+		return errors.Join(ClientRejected, errors.New(msg))
+	}
 	assert.Assert(rsp.Type() == packet.PacketServerAuthResponse, "expected a auth response back")
 
-    ////////////// wait
-	assert.Assert(rsp.Data()[0] == 1, "should be authenticated")
+	authRsp, err := packet.Decode[packet.ServerAuthResponse](rsp)
+	assert.NoError(err, "unable to decode the auth response")
+	assert.Assert(authRsp.Accepted, "should be authenticated")
 
 	d.logger.Info("auth response", "rsp", rsp)
 	d.conn = conn
-	d.ready <- struct{}{}
-    d.ServerId = packet.ServerAuthGameId(rsp)
+	d.ServerId = authRsp.GameId
+	d.LobbyCode = authRsp.Lobby
+	d.session = authRsp
+	d.State = CSConnected
+
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
 
-	ctxReader := utils.NewContextReader(ctx)
-	go ctxReader.Read(conn)
+	go d.handlePackets(ctx, frameErr)
 
-	go func() {
-		for bytes := range ctxReader.Out {
-			d.logger.Error("message received", "data", string(bytes))
-		}
-
-		if err, ok := <-ctxReader.Err; ok && !d.closed {
-			d.logger.Error("error with client", "error", err)
-		}
+	return nil
+}
 
+func (d *Client) handlePackets(ctx context.Context, frameErr chan error) {
+	defer func() {
 		d.State = CSDisconnected
 		d.done <- struct{}{}
 	}()
 
-	return nil
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-frameErr:
+			if !errors.Is(err, io.EOF) && !d.closed {
+				d.logger.Error("error with client", "error", err)
+			}
+			return
+		case pkt := <-d.framer.C:
+			if packet.IsPing(pkt) {
+				ping, err := packet.Decode[packet.Heartbeat](pkt)
+				if err != nil {
+					d.logger.Error("unable to decode ping", "packet", pkt.String(), "error", err)
+					continue
+				}
+
+				pong := packet.CreatePong(ping, pkt.Version())
+				if _, err := pong.Into(d.conn); err != nil && !d.closed {
+					d.logger.Error("unable to pong", "error", err)
+				}
+				continue
+			}
+
+			if packet.IsCloseConnection(pkt) {
+				closeConn, err := packet.Decode[packet.CloseConnection](pkt)
+				assert.NoError(err, "unable to decode the close connection")
+				d.logger.Warn("server closed the connection", "reason", closeConn.Reason)
+				d.CloseReason = closeConn.Reason
+				d.closed = true
+				d.conn.Close()
+				return
+			}
+			d.logger.Error("message received", "packet", pkt.String())
+		}
+	}
 }
 
 func (d *Client) WaitForDone() {
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"net"
@@ -25,14 +26,18 @@ func getId() int {
 type GameServerRunner struct {
 	done     bool
 	doneChan     chan struct{}
-	db       gameserverstats.GSSRetriever
+	db       gameserverstats.GameServerReporter
 	stats    gameserverstats.GameServerConfig
 	listener net.Listener
 	logger   *slog.Logger
 	mutex    sync.Mutex
+
+	// the stats row is written at least this often so the server is not
+	// reaped as stale
+	heartbeatMS int64
 }
 
-func NewGameServerRunner(db gameserverstats.GSSRetriever, stats gameserverstats.GameServerConfig) *GameServerRunner {
+func NewGameServerRunner(db gameserverstats.GameServerReporter, stats gameserverstats.GameServerConfig) *GameServerRunner {
 	logger := slog.Default().With("area", "GameServer")
 	logger.Warn("new dummy game server", "ID", os.Getenv("ID"))
 
@@ -43,7 +48,15 @@ func NewGameServerRunner(db gameserverstats.GSSRetriever, stats gameserverstats.
         done: false,
 		doneChan:   make(chan struct{}, 1),
 		mutex:  sync.Mutex{},
+		heartbeatMS: gameserverstats.DefaultHeartbeatIntervalMS,
+	}
+}
+
+func (g *GameServerRunner) WithHeartbeat(ms int64) *GameServerRunner {
+	if ms > 0 {
+		g.heartbeatMS = ms
 	}
+	return g
 }
 
 func (g *GameServerRunner) innerListenForConnections(listener net.Listener) <-chan net.Conn {
@@ -81,21 +94,75 @@ func (g *GameServerRunner) incConnections(amount int) {
 
 }
 
+// handlePacket answers the packet and returns why the client left once the
+// connection is done
+func (g *GameServerRunner) handlePacket(conn net.Conn, pkt *packet.Packet, session *int64) (string, bool) {
+    g.logger.Info("packet received", "packet", pkt.String())
+    switch pkt.Type() {
+    case packet.PacketClientAuth:
+        // the proxy tells us who the client is before anything else
+        auth, err := packet.Decode[packet.ClientAuth](pkt)
+        if err != nil {
+            g.logger.Error("malformed client auth", "error", err)
+            break
+        }
+        g.endPlayerSession(*session, "client authenticated again")
+        *session = g.startPlayerSession(hex.EncodeToString(auth.Id[:]), conn.RemoteAddr().String())
+    case packet.PacketCloseConnection:
+        g.logger.Info("client sent close command")
+        reason := "client closed connection"
+        if closing, err := packet.Decode[packet.CloseConnection](pkt); err == nil && closing.Reason != "" {
+            reason = closing.Reason
+        }
+        return reason, true
+    case packet.PacketPing:
+        ping, err := packet.Decode[packet.Heartbeat](pkt)
+        if err != nil {
+            g.logger.Error("unable to decode ping", "packet", pkt.String(), "error", err)
+            return err.Error(), true
+        }
+
+        pong := packet.CreatePong(ping, pkt.Version())
+        if _, err := pong.Into(conn); err != nil {
+            g.logger.Error("unable to pong", "error", err)
+            return err.Error(), true
+        }
+    }
+    return "", false
+}
+
 func (g *GameServerRunner) handleConnection(ctx context.Context, conn net.Conn, id int) {
 	g.incConnections(1)
     defer g.incConnections(-1)
 
     framer := packet.NewPacketFramer()
-    go packet.FrameWithReader(&framer, conn)
+    closed := make(chan struct{})
+    go func() {
+        packet.FrameWithReader(&framer, conn)
+        close(closed)
+    }()
+
+    var session int64
+    reason := "game server shutting down"
+    defer func() { g.endPlayerSession(session, reason) }()
 
     for {
         select {
         case <-ctx.Done():
             return
+        case <-closed:
+            // the packets read before the connection closed still count
+            for len(framer.C) > 0 {
+                if why, done := g.handlePacket(conn, <-framer.C, &session); done {
+                    reason = why
+                    return
+                }
+            }
+            reason = "connection lost"
+            return
         case pkt := <-framer.C:
-            g.logger.Info("packet received", "packet", pkt.String())
-            if packet.IsCloseConnection(pkt) {
-                g.logger.Info("client sent close command")
+            if why, done := g.handlePacket(conn, pkt, &session); done {
+                reason = why
                 return
             }
         }
@@ -122,6 +189,7 @@ func (g *GameServerRunner) Run(outerCtx context.Context) error {
 	g.stats.State = gameserverstats.GSStateReady
 	err = g.db.Update(g.stats)
 	assert.NoError(err, "unable to save the stats of the dummy game server on connection")
+	g.recordTransition("listening")
 
 	g.logger.Warn("dummy-server#Run running...")
 
@@ -173,6 +241,7 @@ outer:
 	g.stats.State = gameserverstats.GSStateClosed
 	err = g.db.Update(g.stats)
 	assert.NoError(err, "unable to save the stats of the dummy game server on close")
+	g.recordTransition("shutting down")
 
     // lint requires me to do this despite it not being correct...
     cancel()
@@ -181,7 +250,9 @@ outer:
 
 func (g *GameServerRunner) handleStatUpdating(ctx context.Context) {
     timer := time.NewTicker(time.Millisecond * 200)
+    heartbeat := time.Millisecond * time.Duration(g.heartbeatMS)
     prev := g.stats
+    lastWrite := time.Now()
 
     outer:
     for {
@@ -190,22 +261,55 @@ func (g *GameServerRunner) handleStatUpdating(ctx context.Context) {
             break outer
         case <-timer.C:
             next := g.stats
-            if !next.Equal(&prev) {
+            if !next.Equal(&prev) || time.Since(lastWrite) >= heartbeat {
                 err := g.db.Update(next)
                 assert.NoError(err, "failed to update stats", "stats", next)
                 prev = next
+                lastWrite = time.Now()
             }
         }
     }
 
 }
 
+// recordTransition adds the current state to the lifecycle of the server
+func (g *GameServerRunner) recordTransition(reason string) {
+	event := gameserverstats.NewLifecycleEvent(g.stats, gameserverstats.SourceGameServer, reason)
+	if err := g.db.RecordLifecycleEvent(event); err != nil {
+		g.logger.Error("unable to record transition", "reason", reason, "error", err)
+	}
+}
+
+// startPlayerSession records the client the proxy placed on this server, 0
+// when it could not be recorded
+func (g *GameServerRunner) startPlayerSession(clientId string, proxy string) int64 {
+	session := gameserverstats.NewPlayerSession(clientId, proxy, g.stats.Id, gameserverstats.SourceGameServer)
+	id, err := g.db.StartPlayerSession(session)
+	if err != nil {
+		g.logger.Error("unable to record player session", "client", clientId, "error", err)
+		return 0
+	}
+	return id
+}
+
+func (g *GameServerRunner) endPlayerSession(id int64, reason string) {
+	if id == 0 {
+		return
+	}
+
+	err := g.db.EndPlayerSession(id, time.Now().UnixMilli(), reason)
+	if err != nil {
+		g.logger.Error("unable to end player session", "id", id, "error", err)
+	}
+}
+
 func (g *GameServerRunner) closeDown() {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
 
     g.stats.State = gameserverstats.GSStateClosed
     g.db.Update(g.stats)
+    g.recordTransition("idle timeout")
     g.logger.Info("setting state to closed", "stats", g.stats)
 }
 
@@ -217,8 +321,14 @@ func (g *GameServerRunner) ready() {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
 
+    // an idle server that gets a connection stays idle, there is nothing to
+    // record for it
+    changed := g.stats.State != gameserverstats.GSStateIdle
     g.stats.State = gameserverstats.GSStateIdle
     g.db.Update(g.stats)
+    if changed {
+        g.recordTransition("new connection")
+    }
     g.logger.Info("setting state to ready", "stats", g.stats)
 }
 
@@ -228,6 +338,7 @@ func (g *GameServerRunner) idle() {
 
     g.stats.State = gameserverstats.GSStateIdle
     g.db.Update(g.stats)
+    g.recordTransition("no connections")
     g.logger.Info("setting state to idle", "stats", g.stats)
 }
 
@@ -0,0 +1,221 @@
+package controlplane
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+// how long a game server waits on the matchmaker to accept its connection
+const dialTimeout = time.Second * 5
+
+// AddrFromEnv is where the matchmaker listens for game servers, empty when
+// game servers write to the database themselves
+func AddrFromEnv() string {
+	return os.Getenv("CONTROL_PLANE")
+}
+
+// TokenFromEnv is the secret game servers register with, the listener and
+// every game server have to agree on it
+func TokenFromEnv() string {
+	return os.Getenv("CONTROL_PLANE_TOKEN")
+}
+
+// Client is the game server side of the control plane, it stands in for the
+// stats database.  The first Update registers the server, every later one is
+// a stats update and doubles as the heartbeat
+type Client struct {
+	addr   string
+	token  string
+	logger *slog.Logger
+
+	// guards everything below, reports from different goroutines go out one
+	// at a time
+	mutex      sync.Mutex
+	conn       net.Conn
+	config     gameserverstats.GameServerConfig
+	registered bool
+	nextKey    int64
+}
+
+func NewClient(addr string, token string) *Client {
+	return &Client{
+		addr:   addr,
+		token:  token,
+		logger: slog.Default().With("area", "ControlPlaneClient"),
+	}
+}
+
+func (c *Client) dial() error {
+	conn, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	// the listener only talks back to say why it is hanging up
+	framer := packet.NewPacketFramer()
+	go func() {
+		packet.FrameWithReader(&framer, conn)
+		close(framer.C)
+	}()
+	go func() {
+		for pkt := range framer.C {
+			c.logger.Error("control plane rejected a report", "packet", pkt.String())
+		}
+	}()
+
+	c.conn = conn
+	return nil
+}
+
+func (c *Client) write(pkt packet.Packet) error {
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return err
+		}
+
+		// a new connection has to register before it can report anything
+		if pkt.Type() != packet.PacketServerRegister {
+			register := c.register()
+			if _, err := register.Into(c.conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := pkt.Into(c.conn)
+	return err
+}
+
+func (c *Client) register() packet.Packet {
+	return packet.MustEncode(packet.PacketServerRegister, Register{
+		Token:  c.token,
+		Config: c.config,
+	})
+}
+
+// send writes the packet, a connection that broke is dialed again once
+func (c *Client) send(pkt packet.Packet) error {
+	err := c.write(pkt)
+	if err == nil {
+		return nil
+	}
+
+	c.logger.Warn("control plane connection lost, reconnecting", "addr", c.addr, "error", err)
+	c.close()
+
+	err = c.write(pkt)
+	if err != nil {
+		c.close()
+	}
+	return err
+}
+
+func (c *Client) Update(stats gameserverstats.GameServerConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.registered && stats.Id != c.config.Id {
+		return ErrWrongServer
+	}
+
+	c.config = stats
+	pkt := packet.MustEncode(packet.PacketServerStats, stats)
+	if !c.registered {
+		pkt = c.register()
+	}
+
+	if err := c.send(pkt); err != nil {
+		return err
+	}
+
+	c.registered = true
+	return nil
+}
+
+func (c *Client) RecordLifecycleEvent(event gameserverstats.LifecycleEvent) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.registered {
+		return ErrNotRegistered
+	}
+	return c.send(packet.MustEncode(packet.PacketServerLifecycle, event))
+}
+
+// StartPlayerSession returns the key of the session on this client, the
+// matchmaker keeps track of where it was stored
+func (c *Client) StartPlayerSession(session gameserverstats.PlayerSession) (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.registered {
+		return 0, ErrNotRegistered
+	}
+
+	c.nextKey++
+	key := c.nextKey
+	err := c.send(packet.MustEncode(packet.PacketServerPlayerSession, PlayerSessionUpdate{
+		Key:     key,
+		Session: session,
+	}))
+	if err != nil {
+		return 0, err
+	}
+	return key, nil
+}
+
+func (c *Client) EndPlayerSession(id int64, atMS int64, reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.registered {
+		return ErrNotRegistered
+	}
+
+	return c.send(packet.MustEncode(packet.PacketServerPlayerSession, PlayerSessionUpdate{
+		Key: id,
+		Session: gameserverstats.PlayerSession{
+			GameServerId:   c.config.Id,
+			DisconnectedMS: atMS,
+			Reason:         reason,
+		},
+	}))
+}
+
+// Deregister tells the matchmaker the server is gone for good and hangs up
+func (c *Client) Deregister(reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.registered {
+		return ErrNotRegistered
+	}
+
+	err := c.send(packet.MustEncode(packet.PacketServerDeregister, Deregister{
+		Id:     c.config.Id,
+		Reason: reason,
+	}))
+	c.registered = false
+	c.close()
+	return err
+}
+
+func (c *Client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.close()
+	return nil
+}
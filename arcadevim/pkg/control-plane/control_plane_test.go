@@ -0,0 +1,249 @@
+package controlplane_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/api"
+	controlplane "github.com/khulnasoft/next.vim/arcadevim/pkg/control-plane"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+const token = "shared secret"
+
+func listen(t *testing.T, ctx context.Context, stats gameserverstats.GSSRetriever, port int) string {
+	listener := controlplane.NewListener(stats, uint16(port), token)
+	go listener.Run(ctx)
+	listener.WaitForReady(ctx)
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func startListener(t *testing.T, ctx context.Context, stats gameserverstats.GSSRetriever) string {
+	port, err := api.GetFreePort()
+	require.NoError(t, err)
+	return listen(t, ctx, stats, port)
+}
+
+func requireServer(t *testing.T, stats gameserverstats.GSSRetriever, id string, state gameserverstats.State) {
+	require.Eventually(t, func() bool {
+		config := stats.GetById(id)
+		return config != nil && config.State == state
+	}, time.Second, time.Millisecond)
+}
+
+func TestControlPlaneReports(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	client := controlplane.NewClient(startListener(t, ctx, stats), token)
+	defer client.Close()
+
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady, Host: "10.0.0.1", Port: 42069}
+	require.NoError(t, client.Update(config))
+	requireServer(t, stats, "0", gameserverstats.GSStateReady)
+
+	config.Connections = 1
+	config.ConnectionsAdded = 1
+	require.NoError(t, client.Update(config))
+	require.NoError(t, client.RecordLifecycleEvent(gameserverstats.NewLifecycleEvent(config, gameserverstats.SourceGameServer, "new connection")))
+
+	key, err := client.StartPlayerSession(gameserverstats.NewPlayerSession("aa", "proxy-0", "0", gameserverstats.SourceGameServer))
+	require.NoError(t, err)
+	require.NoError(t, client.EndPlayerSession(key, time.Now().UnixMilli(), "client closed connection"))
+
+	require.Eventually(t, func() bool {
+		sessions, err := stats.GetPlayerSessions("aa")
+		require.NoError(t, err)
+		return len(sessions) == 1 && sessions[0].Reason == "client closed connection"
+	}, time.Second, time.Millisecond)
+
+	events, err := stats.GetLifecycleEvents("0")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "new connection", events[0].Reason)
+
+	stored := stats.GetById("0")
+	require.Equal(t, "10.0.0.1", stored.Host)
+	require.Equal(t, 1, stored.Connections)
+
+	require.NoError(t, client.Deregister("shutting down"))
+	requireServer(t, stats, "0", gameserverstats.GSStateClosed)
+}
+
+func TestControlPlaneRegisterFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	addr := startListener(t, ctx, stats)
+
+	client := controlplane.NewClient(addr, token)
+	require.ErrorIs(t, client.RecordLifecycleEvent(gameserverstats.LifecycleEvent{GameServerId: "0"}), controlplane.ErrNotRegistered)
+
+	conn, err := net.Dial("tcp4", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	framer := packet.NewPacketFramer()
+	go packet.FrameWithReader(&framer, conn)
+
+	pkt := packet.MustEncode(packet.PacketServerStats, gameserverstats.GameServerConfig{Id: "0"})
+	_, err = pkt.Into(conn)
+	require.NoError(t, err)
+
+	requireRejected(t, &framer, controlplane.ErrNotRegistered)
+	require.Nil(t, stats.GetById("0"))
+}
+
+func requireRejected(t *testing.T, framer *packet.PacketFramer, expected error) {
+	select {
+	case rsp := <-framer.C:
+		require.Equal(t, packet.PacketError, rsp.Type())
+		msg, err := packet.Decode[string](rsp)
+		require.NoError(t, err)
+		require.Equal(t, expected.Error(), msg)
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected the listener to reject the report")
+	}
+}
+
+func register(t *testing.T, addr string, register controlplane.Register) *packet.PacketFramer {
+	conn, err := net.Dial("tcp4", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	framer := packet.NewPacketFramer()
+	go packet.FrameWithReader(&framer, conn)
+
+	pkt := packet.MustEncode(packet.PacketServerRegister, register)
+	_, err = pkt.Into(conn)
+	require.NoError(t, err)
+	return &framer
+}
+
+func TestControlPlaneRequiresToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	addr := startListener(t, ctx, stats)
+
+	framer := register(t, addr, controlplane.Register{
+		Token:  "guessed",
+		Config: gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady},
+	})
+	requireRejected(t, framer, controlplane.ErrUnauthorized)
+	require.Nil(t, stats.GetById("0"))
+}
+
+func TestControlPlaneIdOwnedByLiveSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	addr := startListener(t, ctx, stats)
+
+	client := controlplane.NewClient(addr, token)
+	require.NoError(t, client.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}))
+	requireServer(t, stats, "0", gameserverstats.GSStateReady)
+
+	// a second connection cannot take the server over while the first lives
+	framer := register(t, addr, controlplane.Register{
+		Token:  token,
+		Config: gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateClosed},
+	})
+	requireRejected(t, framer, controlplane.ErrAlreadyRegistered)
+	require.Equal(t, gameserverstats.GSStateReady, stats.GetById("0").State)
+
+	// once it is gone the id is free again
+	require.NoError(t, client.Close())
+	require.Eventually(t, func() bool {
+		other := controlplane.NewClient(addr, token)
+		defer other.Close()
+		if other.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateIdle}) != nil {
+			return false
+		}
+		return stats.GetById("0").State == gameserverstats.GSStateIdle
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestControlPlaneOnlyReportsAboutItself(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	client := controlplane.NewClient(startListener(t, ctx, stats), token)
+	defer client.Close()
+
+	require.NoError(t, client.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}))
+	require.ErrorIs(t, client.Update(gameserverstats.GameServerConfig{Id: "1"}), controlplane.ErrWrongServer)
+}
+
+func TestControlPlaneConnectionLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := gameserverstats.NewMemory()
+	client := controlplane.NewClient(startListener(t, ctx, stats), token)
+
+	require.NoError(t, client.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}))
+	_, err := client.StartPlayerSession(gameserverstats.NewPlayerSession("aa", "proxy-0", "0", gameserverstats.SourceGameServer))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		sessions, err := stats.GetPlayerSessions("aa")
+		require.NoError(t, err)
+		return len(sessions) == 1
+	}, time.Second, time.Millisecond)
+
+	// gone without deregistering, the reaper closes the server if it never
+	// comes back
+	require.NoError(t, client.Close())
+	require.Eventually(t, func() bool {
+		sessions, err := stats.GetPlayerSessions("aa")
+		require.NoError(t, err)
+		return sessions[0].Reason == "game server connection lost"
+	}, time.Second, time.Millisecond)
+	require.Equal(t, gameserverstats.GSStateReady, stats.GetById("0").State)
+}
+
+func TestControlPlaneReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port, err := api.GetFreePort()
+	require.NoError(t, err)
+
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	first := gameserverstats.NewMemory()
+	listener := controlplane.NewListener(first, uint16(port), token)
+	stopped := make(chan error, 1)
+	go func() { stopped <- listener.Run(firstCtx) }()
+	listener.WaitForReady(firstCtx)
+
+	client := controlplane.NewClient(fmt.Sprintf("127.0.0.1:%d", port), token)
+	defer client.Close()
+
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}
+	require.NoError(t, client.Update(config))
+	requireServer(t, first, "0", gameserverstats.GSStateReady)
+
+	// the matchmaker restarts, the server registers again with the next
+	// report
+	firstCancel()
+	require.NoError(t, <-stopped)
+	second := gameserverstats.NewMemory()
+	listen(t, ctx, second, port)
+
+	config.State = gameserverstats.GSStateIdle
+	require.Eventually(t, func() bool {
+		client.Update(config)
+		config := second.GetById("0")
+		return config != nil && config.State == gameserverstats.GSStateIdle
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,273 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+// Listener is the matchmaker side of the control plane.  Game servers connect
+// to it and everything they report is written into the stats, so they never
+// need the database themselves.  Anyone who can reach the port could report
+// on behalf of any server, so registering takes the shared token
+type Listener struct {
+	port   uint16
+	token  []byte
+	stats  gameserverstats.GSSRetriever
+	logger *slog.Logger
+	ready  chan struct{}
+
+	// the session that owns every registered id, a second connection cannot
+	// take over a server while the first is still alive
+	mutex   sync.Mutex
+	servers map[string]*session
+}
+
+func NewListener(stats gameserverstats.GSSRetriever, port uint16, token string) *Listener {
+	assert.Assert(len(token) > 0, "control plane listener requires a token")
+	return &Listener{
+		port:    port,
+		token:   []byte(token),
+		stats:   stats,
+		logger:  slog.Default().With("area", "ControlPlane"),
+		ready:   make(chan struct{}, 1),
+		servers: map[string]*session{},
+	}
+}
+
+func (l *Listener) WaitForReady(ctx context.Context) {
+	select {
+	case <-l.ready:
+	case <-ctx.Done():
+	}
+}
+
+func (l *Listener) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", l.port))
+	if err != nil {
+		return err
+	}
+
+	l.logger.Info("control plane listening", "port", l.port)
+	l.ready <- struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go l.handle(ctx, conn)
+	}
+}
+
+// session is what the listener knows about one game server connection
+type session struct {
+	config       gameserverstats.GameServerConfig
+	registered   bool
+	deregistered bool
+
+	// the keys of the game server to the player sessions in the stats
+	players map[int64]int64
+}
+
+func (l *Listener) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	framer := packet.NewPacketFramer()
+	closed := make(chan struct{})
+	go func() {
+		packet.FrameWithReader(&framer, conn)
+		close(closed)
+	}()
+
+	s := &session{players: map[int64]int64{}}
+	defer l.lost(s)
+
+	for {
+		var pkt *packet.Packet
+		select {
+		case <-ctx.Done():
+			return
+		case pkt = <-framer.C:
+		case <-closed:
+			// the packets read before the connection closed still count
+			if len(framer.C) == 0 {
+				return
+			}
+			pkt = <-framer.C
+		}
+
+		done, err := l.handlePacket(s, pkt)
+		if err != nil {
+			l.logger.Error("game server report failed", "id", s.config.Id, "addr", conn.RemoteAddr(), "packet", pkt.String(), "error", err)
+			rsp := packet.CreateErrorPacket(err)
+			rsp.Into(conn)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// handlePacket returns true once the game server has deregistered
+func (l *Listener) handlePacket(s *session, pkt *packet.Packet) (bool, error) {
+	if !s.registered && pkt.Type() != packet.PacketServerRegister {
+		return false, ErrNotRegistered
+	}
+
+	switch pkt.Type() {
+	case packet.PacketServerRegister:
+		if s.registered {
+			return false, fmt.Errorf("game server %s is already registered", s.config.Id)
+		}
+
+		register, err := packet.Decode[Register](pkt)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(register.Token), l.token) != 1 {
+			return false, ErrUnauthorized
+		}
+		if err := l.claim(s, register.Config.Id); err != nil {
+			return false, err
+		}
+
+		l.logger.Info("game server registered", "config", register.Config.String())
+		s.config = register.Config
+		s.registered = true
+		return false, l.stats.Update(register.Config)
+
+	case packet.PacketServerStats:
+		config, err := packet.Decode[gameserverstats.GameServerConfig](pkt)
+		if err != nil {
+			return false, err
+		}
+		if config.Id != s.config.Id {
+			return false, ErrWrongServer
+		}
+
+		s.config = config
+		return false, l.stats.Update(config)
+
+	case packet.PacketServerDeregister:
+		dereg, err := packet.Decode[Deregister](pkt)
+		if err != nil {
+			return false, err
+		}
+		if dereg.Id != s.config.Id {
+			return false, ErrWrongServer
+		}
+
+		l.logger.Info("game server deregistered", "id", dereg.Id, "reason", dereg.Reason)
+		s.deregistered = true
+		s.config.State = gameserverstats.GSStateClosed
+		return true, l.stats.Update(s.config)
+
+	case packet.PacketServerLifecycle:
+		event, err := packet.Decode[gameserverstats.LifecycleEvent](pkt)
+		if err != nil {
+			return false, err
+		}
+		if event.GameServerId != s.config.Id {
+			return false, ErrWrongServer
+		}
+		return false, l.stats.RecordLifecycleEvent(event)
+
+	case packet.PacketServerPlayerSession:
+		update, err := packet.Decode[PlayerSessionUpdate](pkt)
+		if err != nil {
+			return false, err
+		}
+		return false, l.playerSession(s, update)
+	}
+
+	return false, fmt.Errorf("unexpected control plane packet %s", packet.TypeName(pkt.Type()))
+}
+
+// claim makes s the owner of id, it is released once the connection is gone
+func (l *Listener) claim(s *session, id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.servers[id]; ok {
+		return ErrAlreadyRegistered
+	}
+	l.servers[id] = s
+	return nil
+}
+
+func (l *Listener) release(s *session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s.registered && l.servers[s.config.Id] == s {
+		delete(l.servers, s.config.Id)
+	}
+}
+
+func (l *Listener) playerSession(s *session, update PlayerSessionUpdate) error {
+	if !update.Ended() {
+		if update.Session.GameServerId != s.config.Id {
+			return ErrWrongServer
+		}
+
+		id, err := l.stats.StartPlayerSession(update.Session)
+		if err != nil {
+			return err
+		}
+		s.players[update.Key] = id
+		return nil
+	}
+
+	id, ok := s.players[update.Key]
+	if !ok {
+		l.logger.Warn("game server ended an unknown player session", "id", s.config.Id, "key", update.Key)
+		return nil
+	}
+
+	delete(s.players, update.Key)
+	return l.stats.EndPlayerSession(id, update.Session.DisconnectedMS, update.Session.Reason)
+}
+
+// lost releases the id and ends the player sessions the connection still had
+// open.  A server that went away without deregistering stops heartbeating and
+// is left to the reaper, it is free to reconnect and register again until then
+func (l *Listener) lost(s *session) {
+	l.release(s)
+	if len(s.players) == 0 {
+		return
+	}
+
+	reason := "game server connection lost"
+	if s.deregistered {
+		reason = "game server deregistered"
+	}
+
+	now := time.Now().UnixMilli()
+	var errs []error
+	for _, id := range s.players {
+		errs = append(errs, l.stats.EndPlayerSession(id, now, reason))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		l.logger.Error("unable to end player sessions of lost game server", "id", s.config.Id, "error", err)
+	}
+}
@@ -0,0 +1,47 @@
+package controlplane
+
+import (
+	"fmt"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+var ErrNotRegistered = fmt.Errorf("game server has to register before reporting")
+var ErrWrongServer = fmt.Errorf("game server can only report about itself")
+var ErrUnauthorized = fmt.Errorf("game server token is not valid")
+var ErrAlreadyRegistered = fmt.Errorf("game server id is registered on another connection")
+
+// Register is the first thing a game server sends.  Token is the secret the
+// matchmaker shares with every game server it spawns
+type Register struct {
+	Token  string                           `json:"token"`
+	Config gameserverstats.GameServerConfig `json:"config"`
+}
+
+// Deregister is the last thing a game server sends, the server is closed and
+// no longer expected to heartbeat
+type Deregister struct {
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// PlayerSessionUpdate starts the session under Key, or ends it once
+// DisconnectedMS is set.  Keys are picked by the game server and are only
+// good for the connection they were sent on
+type PlayerSessionUpdate struct {
+	Key     int64                         `json:"key"`
+	Session gameserverstats.PlayerSession `json:"session"`
+}
+
+func (p *PlayerSessionUpdate) Ended() bool {
+	return !p.Session.Connected()
+}
+
+func init() {
+	packet.Register[Register](packet.PacketServerRegister, packet.JSONCodec{})
+	packet.Register[gameserverstats.GameServerConfig](packet.PacketServerStats, packet.JSONCodec{})
+	packet.Register[Deregister](packet.PacketServerDeregister, packet.JSONCodec{})
+	packet.Register[gameserverstats.LifecycleEvent](packet.PacketServerLifecycle, packet.JSONCodec{})
+	packet.Register[PlayerSessionUpdate](packet.PacketServerPlayerSession, packet.JSONCodec{})
+}
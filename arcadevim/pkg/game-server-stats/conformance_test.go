@@ -0,0 +1,440 @@
+package gameserverstats_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+// store is everything a backend has to do the same way as every other
+type store interface {
+	gameserverstats.GSSRetriever
+	gameserverstats.LobbyStore
+	GetConfigByHostAndPort(host string, port uint16) (*gameserverstats.GameServerConfig, error)
+}
+
+type backend struct {
+	name string
+	open func(t *testing.T) store
+}
+
+var backends = []backend{
+	{
+		name: "sqlite",
+		open: func(t *testing.T) store {
+			path := filepath.Join(t.TempDir(), "conformance.db")
+			sqlite := gameserverstats.NewSqlite(gameserverstats.EnsureSqliteURI(path))
+			sqlite.SetSqliteModes()
+			t.Cleanup(func() { sqlite.Close() })
+			return sqlite
+		},
+	},
+	{
+		name: "memory",
+		open: func(t *testing.T) store {
+			return gameserverstats.NewMemory()
+		},
+	},
+}
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, stats store)
+	}{
+		{"Update", conformUpdate},
+		{"Totals", conformTotals},
+		{"Utilization", conformUtilization},
+		{"Watch", conformWatch},
+		{"Lobbies", conformLobbies},
+		{"ConcurrentUpdates", conformConcurrentUpdates},
+		{"Samples", conformSamples},
+		{"Downsample", conformDownsample},
+		{"Stale", conformStale},
+		{"Lifecycle", conformLifecycle},
+		{"PlayerSessions", conformPlayerSessions},
+	}
+
+	for _, b := range backends {
+		for _, test := range tests {
+			t.Run(b.name+"/"+test.name, func(t *testing.T) {
+				test.run(t, b.open(t))
+			})
+		}
+	}
+}
+
+func conformUpdate(t *testing.T, stats store) {
+	require.Nil(t, stats.GetById("0"))
+
+	config := gameserverstats.GameServerConfig{
+		Id:          "0",
+		State:       gameserverstats.GSStateInitializing,
+		Connections: 2,
+		Load:        0.25,
+		Host:        "0.0.0.0",
+		Port:        42069,
+		GameType:    "vim-arcade",
+		Region:      "eu",
+		Visibility:  gameserverstats.VisibilityPrivate,
+	}
+	require.NoError(t, stats.Update(config))
+
+	found := stats.GetById("0")
+	require.NotNil(t, found)
+	require.Positive(t, found.LastUpdateMS)
+	found.LastUpdateMS = 0
+	require.Equal(t, config, *found)
+
+	config.State = gameserverstats.GSStateReady
+	config.Connections = 3
+	require.NoError(t, stats.Update(config))
+	found = stats.GetById("0")
+	require.Equal(t, gameserverstats.GSStateReady, found.State)
+	require.Equal(t, 3, found.Connections)
+	require.Equal(t, 1, stats.GetServerCount())
+
+	byAddr, err := stats.GetConfigByHostAndPort("0.0.0.0", 42069)
+	require.NoError(t, err)
+	require.Equal(t, "0", byAddr.Id)
+	byAddr, err = stats.GetConfigByHostAndPort("0.0.0.0", 1)
+	require.NoError(t, err)
+	require.Nil(t, byAddr)
+
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "1", State: gameserverstats.GSStateClosed}))
+	all, err := stats.GetAllGameServerConfigs()
+	require.NoError(t, err)
+	ids := []string{}
+	for _, c := range all {
+		ids = append(ids, c.Id)
+	}
+	require.ElementsMatch(t, []string{"0", "1"}, ids)
+}
+
+func conformTotals(t *testing.T, stats store) {
+	require.Equal(t, 0, stats.GetServerCount())
+	require.Equal(t, gameserverstats.GameServecConfigConnectionStats{}, stats.GetTotalConnectionCount())
+
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "0", Connections: 2, ConnectionsAdded: 5, ConnectionsRemoved: 3}))
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "1", Connections: 1, ConnectionsAdded: 1}))
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "2", State: gameserverstats.GSStateClosed, ConnectionsAdded: 4, ConnectionsRemoved: 4}))
+
+	require.Equal(t, 3, stats.GetServerCount())
+	require.Equal(t, gameserverstats.GameServecConfigConnectionStats{
+		Connections:        3,
+		ConnectionsAdded:   10,
+		ConnectionsRemoved: 7,
+	}, stats.GetTotalConnectionCount())
+}
+
+func conformUtilization(t *testing.T, stats store) {
+	servers := []gameserverstats.GameServerConfig{
+		{Id: "low", State: gameserverstats.GSStateReady, Load: 0.2},
+		{Id: "busy", State: gameserverstats.GSStateReady, Load: 0.8},
+		{Id: "mid", State: gameserverstats.GSStateReady, Load: 0.5},
+		{Id: "full", State: gameserverstats.GSStateReady, Load: 0.95},
+		{Id: "idle", State: gameserverstats.GSStateIdle, Load: 0.1},
+		{Id: "starting", State: gameserverstats.GSStateInitializing},
+		{Id: "closed", State: gameserverstats.GSStateClosed},
+		{Id: "private", State: gameserverstats.GSStateReady, Load: 0.3, Visibility: gameserverstats.VisibilityPrivate},
+	}
+	for _, s := range servers {
+		require.NoError(t, stats.Update(s))
+	}
+
+	ids := []string{}
+	for _, s := range stats.GetServersByUtilization(0.9) {
+		ids = append(ids, s.Id)
+	}
+	require.Equal(t, []string{"busy", "mid", "low"}, ids)
+	require.Empty(t, stats.GetServersByUtilization(0.1))
+}
+
+func conformWatch(t *testing.T, stats store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := stats.Watch(ctx)
+
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateInitializing}
+	require.NoError(t, stats.Update(config))
+	e := nextEvent(t, events)
+	require.Nil(t, e.Previous)
+	require.Equal(t, "0", e.Current.Id)
+
+	require.NoError(t, stats.Update(config))
+	requireNoEvent(t, events)
+
+	config.State = gameserverstats.GSStateReady
+	require.NoError(t, stats.Update(config))
+	e = nextEvent(t, events)
+	require.Equal(t, gameserverstats.GSStateInitializing, e.Previous.State)
+	require.True(t, e.FreedCapacity())
+}
+
+func conformLobbies(t *testing.T, stats store) {
+	lobby, err := stats.GetLobby("ABCD")
+	require.NoError(t, err)
+	require.Nil(t, lobby)
+
+	created := gameserverstats.Lobby{Code: "ABCD", GameServerId: "0", Owner: "theprimeagen", CreatedMS: 1000}
+	require.NoError(t, stats.CreateLobby(created))
+	require.Error(t, stats.CreateLobby(created))
+
+	lobby, err = stats.GetLobby("ABCD")
+	require.NoError(t, err)
+	require.Equal(t, created, *lobby)
+
+	require.NoError(t, stats.DeleteLobby("ABCD"))
+	require.NoError(t, stats.DeleteLobby("ABCD"))
+	lobby, err = stats.GetLobby("ABCD")
+	require.NoError(t, err)
+	require.Nil(t, lobby)
+}
+
+func conformConcurrentUpdates(t *testing.T, stats store) {
+	wait := sync.WaitGroup{}
+	for i := range 8 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for conns := range 10 {
+				config := gameserverstats.GameServerConfig{
+					Id:          fmt.Sprintf("%d", i),
+					State:       gameserverstats.GSStateReady,
+					Connections: conns + 1,
+				}
+				require.NoError(t, stats.Update(config))
+				stats.GetServersByUtilization(1)
+			}
+		}()
+	}
+	wait.Wait()
+
+	require.Equal(t, 8, stats.GetServerCount())
+	require.Equal(t, 80, stats.GetTotalConnectionCount().Connections)
+}
+
+func update(t *testing.T, stats store, id string, state gameserverstats.State, connections int, load float32) {
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{
+		Id:               id,
+		State:            state,
+		Connections:      connections,
+		ConnectionsAdded: connections,
+		Load:             load,
+		GameType:         "vim-arcade",
+	}))
+}
+
+func conformSamples(t *testing.T, stats store) {
+	update(t, stats, "0", gameserverstats.GSStateReady, 2, 0.2)
+	update(t, stats, "1", gameserverstats.GSStateReady, 4, 0.4)
+	update(t, stats, "closed", gameserverstats.GSStateClosed, 0, 0)
+	require.NoError(t, stats.RecordSamples(1000))
+
+	update(t, stats, "0", gameserverstats.GSStateReady, 3, 0.3)
+	update(t, stats, "1", gameserverstats.GSStateClosed, 0, 0)
+	require.NoError(t, stats.RecordSamples(2000))
+
+	samples, err := stats.GetServerSamples("0", 0, 3000)
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	require.Equal(t, int64(1000), samples[0].SampledMS)
+	require.Equal(t, 2, samples[0].Connections)
+	require.Equal(t, int64(2000), samples[1].SampledMS)
+	require.Equal(t, 3, samples[1].Connections)
+	require.Equal(t, 3, samples[1].ConnectionsAdded)
+	require.Equal(t, gameserverstats.GSStateReady, samples[1].State)
+	require.Equal(t, "vim-arcade", samples[1].GameType)
+	require.Zero(t, samples[1].ResolutionMS)
+
+	// to is not included
+	samples, err = stats.GetServerSamples("0", 1000, 2000)
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+
+	samples, err = stats.GetServerSamples("closed", 0, 3000)
+	require.NoError(t, err)
+	require.Empty(t, samples)
+
+	fleet, err := stats.GetFleetSamples(0, 3000)
+	require.NoError(t, err)
+	require.Len(t, fleet, 2)
+	require.Equal(t, int64(1000), fleet[0].SampledMS)
+	require.Equal(t, 2, fleet[0].Servers)
+	require.Equal(t, 6, fleet[0].Connections)
+	require.InDelta(t, 0.3, fleet[0].Load, 0.0001)
+	require.Equal(t, 1, fleet[1].Servers)
+	require.Equal(t, 3, fleet[1].Connections)
+
+	pruned, err := stats.PruneSamples(2000)
+	require.NoError(t, err)
+	require.Equal(t, 2, pruned)
+	fleet, err = stats.GetFleetSamples(0, 3000)
+	require.NoError(t, err)
+	require.Len(t, fleet, 1)
+}
+
+func conformDownsample(t *testing.T, stats store) {
+	for i, connections := range []int{1, 2, 4, 8, 16} {
+		update(t, stats, "0", gameserverstats.GSStateReady, connections, float32(connections)/10)
+		require.NoError(t, stats.RecordSamples(int64(i+1)*1000))
+	}
+
+	// 4500 only covers whole buckets so 4000 is left alone
+	require.NoError(t, stats.DownsampleSamples(4500, 2000))
+	samples, err := stats.GetServerSamples("0", 0, 10_000)
+	require.NoError(t, err)
+	require.Len(t, samples, 4)
+
+	require.Equal(t, int64(0), samples[0].SampledMS)
+	require.Equal(t, int64(2000), samples[0].ResolutionMS)
+	require.Equal(t, 1, samples[0].Connections)
+
+	require.Equal(t, int64(2000), samples[1].SampledMS)
+	require.Equal(t, int64(2000), samples[1].ResolutionMS)
+	require.Equal(t, 3, samples[1].Connections)
+	require.Equal(t, 4, samples[1].ConnectionsAdded)
+	require.InDelta(t, 0.3, samples[1].Load, 0.0001)
+
+	require.Equal(t, int64(4000), samples[2].SampledMS)
+	require.Zero(t, samples[2].ResolutionMS)
+	require.Equal(t, int64(5000), samples[3].SampledMS)
+
+	// downsampled samples are never downsampled again
+	require.NoError(t, stats.DownsampleSamples(4500, 2000))
+	again, err := stats.GetServerSamples("0", 0, 10_000)
+	require.NoError(t, err)
+	require.Equal(t, samples, again)
+}
+
+func withStaleAfter(stats store, ms int64) {
+	switch s := stats.(type) {
+	case *gameserverstats.Sqlite:
+		s.WithStaleAfter(ms)
+	case *gameserverstats.Memory:
+		s.WithStaleAfter(ms)
+	}
+}
+
+func conformStale(t *testing.T, stats store) {
+	withStaleAfter(stats, 50)
+
+	update(t, stats, "quiet", gameserverstats.GSStateReady, 1, 0.1)
+	update(t, stats, "closed", gameserverstats.GSStateClosed, 0, 0)
+	require.Len(t, stats.GetServersByUtilization(1), 1)
+
+	time.Sleep(100 * time.Millisecond)
+	update(t, stats, "heartbeat", gameserverstats.GSStateReady, 1, 0.1)
+
+	// a stale server is never matched into, even before it is closed
+	servers := stats.GetServersByUtilization(1)
+	require.Len(t, servers, 1)
+	require.Equal(t, "heartbeat", servers[0].Id)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := stats.Watch(ctx)
+
+	closed, err := stats.CloseStaleServers(time.Now().UnixMilli() - 50)
+	require.NoError(t, err)
+	require.Len(t, closed, 1)
+	require.Equal(t, "quiet", closed[0].Id)
+	require.Equal(t, gameserverstats.GSStateClosed, closed[0].State)
+	require.Equal(t, gameserverstats.GSStateClosed, stats.GetById("quiet").State)
+	require.Equal(t, gameserverstats.GSStateReady, stats.GetById("heartbeat").State)
+
+	e := nextEvent(t, events)
+	require.Equal(t, "quiet", e.Current.Id)
+	require.Equal(t, gameserverstats.GSStateClosed, e.Current.State)
+
+	closed, err = stats.CloseStaleServers(time.Now().UnixMilli() - 50)
+	require.NoError(t, err)
+	require.Empty(t, closed)
+}
+
+func conformLifecycle(t *testing.T, stats store) {
+	events, err := stats.GetLifecycleEvents("0")
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateInitializing}
+	record := func(atMS int64, source string, reason string) {
+		event := gameserverstats.NewLifecycleEvent(config, source, reason)
+		event.AtMS = atMS
+		require.NoError(t, stats.RecordLifecycleEvent(event))
+	}
+
+	record(1000, gameserverstats.SourceSupervisor, "started")
+	config.State = gameserverstats.GSStateReady
+	record(2000, gameserverstats.SourceGameServer, "listening")
+	config.Connections = 2
+	config.ConnectionsAdded = 2
+	config.State = gameserverstats.GSStateClosed
+	// recorded late by another process but happened first
+	record(1500, gameserverstats.SourceReaper, "no heartbeat")
+	require.NoError(t, stats.RecordLifecycleEvent(gameserverstats.LifecycleEvent{GameServerId: "1", AtMS: 1200}))
+
+	events, err = stats.GetLifecycleEvents("0")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	reasons := []string{}
+	for _, e := range events {
+		require.Equal(t, "0", e.GameServerId)
+		require.NotZero(t, e.Id)
+		reasons = append(reasons, e.Reason)
+	}
+	require.Equal(t, []string{"started", "no heartbeat", "listening"}, reasons)
+
+	require.Equal(t, gameserverstats.SourceReaper, events[1].Source)
+	require.Equal(t, gameserverstats.GSStateClosed, events[1].State)
+	require.Equal(t, 2, events[1].Connections)
+	require.Equal(t, 2, events[1].ConnectionsAdded)
+	require.Equal(t, gameserverstats.GSStateReady, events[2].State)
+}
+
+func conformPlayerSessions(t *testing.T, stats store) {
+	sessions, err := stats.GetPlayerSessions("aa")
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	start := func(clientId string, gameServerId string, source string, atMS int64) int64 {
+		session := gameserverstats.NewPlayerSession(clientId, "proxy-0", gameServerId, source)
+		session.ConnectedMS = atMS
+		id, err := stats.StartPlayerSession(session)
+		require.NoError(t, err)
+		require.NotZero(t, id)
+		return id
+	}
+
+	first := start("aa", "0", gameserverstats.SourceProxy, 1000)
+	second := start("aa", "1", gameserverstats.SourceProxy, 3000)
+	start("bb", "0", gameserverstats.SourceGameServer, 1500)
+
+	require.NoError(t, stats.EndPlayerSession(first, 2500, "client closed connection"))
+	// the first disconnect wins
+	require.NoError(t, stats.EndPlayerSession(first, 2800, "connection closed"))
+
+	sessions, err = stats.GetPlayerSessions("aa")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	require.Equal(t, first, sessions[0].Id)
+	require.Equal(t, "0", sessions[0].GameServerId)
+	require.Equal(t, "proxy-0", sessions[0].Proxy)
+	require.Equal(t, gameserverstats.SourceProxy, sessions[0].Source)
+	require.False(t, sessions[0].Connected())
+	require.Equal(t, int64(2500), sessions[0].DisconnectedMS)
+	require.Equal(t, "client closed connection", sessions[0].Reason)
+	require.Equal(t, 1500*time.Millisecond, sessions[0].Duration(time.UnixMilli(9000)))
+
+	require.Equal(t, second, sessions[1].Id)
+	require.True(t, sessions[1].Connected())
+	require.Equal(t, 6000*time.Millisecond, sessions[1].Duration(time.UnixMilli(9000)))
+}
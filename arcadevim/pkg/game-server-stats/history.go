@@ -0,0 +1,183 @@
+package gameserverstats
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sample is a game server config at one point in time
+type Sample struct {
+	GameServerId string `db:"game_server_id"`
+	SampledMS    int64  `db:"sampled_at"`
+
+	// 0 for a raw sample, otherwise the size of the bucket that was averaged
+	// into this sample, SampledMS is the start of the bucket
+	ResolutionMS int64 `db:"resolution"`
+
+	State              State   `db:"state"`
+	Connections        int     `db:"connections"`
+	ConnectionsAdded   int     `db:"connections_added"`
+	ConnectionsRemoved int     `db:"connections_removed"`
+	Load               float32 `db:"load"`
+
+	GameType string `db:"game_type"`
+	Region   string `db:"region"`
+}
+
+// FleetSample is every sampled game server added up
+type FleetSample struct {
+	SampledMS   int64   `db:"sampled_at"`
+	Servers     int     `db:"servers"`
+	Connections int     `db:"connections"`
+	Load        float32 `db:"load"`
+}
+
+// SampleStore keeps the history of the game servers.  Ranges include fromMS
+// and exclude toMS and come back oldest first
+type SampleStore interface {
+	// RecordSamples takes a sample of every game server that is not closed
+	RecordSamples(atMS int64) error
+	GetServerSamples(id string, fromMS int64, toMS int64) ([]Sample, error)
+	GetFleetSamples(fromMS int64, toMS int64) ([]FleetSample, error)
+
+	// DownsampleSamples averages raw samples older than beforeMS into one
+	// sample per server every resolutionMS
+	DownsampleSamples(beforeMS int64, resolutionMS int64) error
+	// PruneSamples deletes every sample older than beforeMS
+	PruneSamples(beforeMS int64) (int, error)
+}
+
+func sampleOf(config GameServerConfig, atMS int64) Sample {
+	return Sample{
+		GameServerId:       config.Id,
+		SampledMS:          atMS,
+		State:              config.State,
+		Connections:        config.Connections,
+		ConnectionsAdded:   config.ConnectionsAdded,
+		ConnectionsRemoved: config.ConnectionsRemoved,
+		Load:               config.Load,
+		GameType:           config.GameType,
+		Region:             config.Region,
+	}
+}
+
+// a bucket never straddles the cutoff, otherwise part of it would be
+// downsampled now and the rest into a second sample later
+func downsampleCutoff(beforeMS int64, resolutionMS int64) int64 {
+	return beforeMS - beforeMS%resolutionMS
+}
+
+type SamplerParams struct {
+	IntervalMS int64
+
+	// samples older than this are deleted
+	RetentionMS int64
+
+	// raw samples older than this are averaged into one sample per
+	// DownsampleResolutionMS
+	DownsampleAfterMS      int64
+	DownsampleResolutionMS int64
+
+	// how often retention and downsampling run
+	MaintenanceIntervalMS int64
+}
+
+func readInt64(key string) int64 {
+	v, _ := strconv.ParseInt(os.Getenv(key), 10, 64)
+	return v
+}
+
+func SamplerParamsFromEnv() SamplerParams {
+	return SamplerParams{
+		IntervalMS:             readInt64("SAMPLE_INTERVAL_MS"),
+		RetentionMS:            readInt64("SAMPLE_RETENTION_MS"),
+		DownsampleAfterMS:      readInt64("SAMPLE_DOWNSAMPLE_AFTER_MS"),
+		DownsampleResolutionMS: readInt64("SAMPLE_DOWNSAMPLE_RESOLUTION_MS"),
+		MaintenanceIntervalMS:  readInt64("SAMPLE_MAINTENANCE_INTERVAL_MS"),
+	}
+}
+
+func (p SamplerParams) withDefaults() SamplerParams {
+	if p.IntervalMS <= 0 {
+		p.IntervalMS = 10_000
+	}
+	if p.RetentionMS <= 0 {
+		p.RetentionMS = (7 * 24 * time.Hour).Milliseconds()
+	}
+	if p.DownsampleAfterMS <= 0 {
+		p.DownsampleAfterMS = (24 * time.Hour).Milliseconds()
+	}
+	if p.DownsampleResolutionMS <= 0 {
+		p.DownsampleResolutionMS = (5 * time.Minute).Milliseconds()
+	}
+	if p.MaintenanceIntervalMS <= 0 {
+		p.MaintenanceIntervalMS = 60_000
+	}
+	return p
+}
+
+func (p SamplerParams) String() string {
+	return fmt.Sprintf("Interval=%d Retention=%d DownsampleAfter=%d DownsampleResolution=%d", p.IntervalMS, p.RetentionMS, p.DownsampleAfterMS, p.DownsampleResolutionMS)
+}
+
+// Sampler writes the game server history and keeps it from growing forever
+type Sampler struct {
+	stats  SampleStore
+	params SamplerParams
+	logger *slog.Logger
+}
+
+func NewSampler(stats SampleStore, params SamplerParams) *Sampler {
+	params = params.withDefaults()
+	return &Sampler{
+		stats:  stats,
+		params: params,
+		logger: slog.Default().With("area", "Sampler"),
+	}
+}
+
+func (s *Sampler) Run(ctx context.Context) {
+	s.logger.Info("sampling game servers", "params", s.params.String())
+
+	sample := time.NewTicker(time.Millisecond * time.Duration(s.params.IntervalMS))
+	defer sample.Stop()
+	maintain := time.NewTicker(time.Millisecond * time.Duration(s.params.MaintenanceIntervalMS))
+	defer maintain.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sample.C:
+			s.Record(now)
+		case now := <-maintain.C:
+			s.Maintain(now)
+		}
+	}
+}
+
+func (s *Sampler) Record(now time.Time) {
+	if err := s.stats.RecordSamples(now.UnixMilli()); err != nil {
+		s.logger.Error("unable to record samples", "error", err)
+	}
+}
+
+// Maintain downsamples old samples then deletes the ones past retention
+func (s *Sampler) Maintain(now time.Time) {
+	nowMS := now.UnixMilli()
+	err := s.stats.DownsampleSamples(nowMS-s.params.DownsampleAfterMS, s.params.DownsampleResolutionMS)
+	if err != nil {
+		s.logger.Error("unable to downsample samples", "error", err)
+	}
+
+	pruned, err := s.stats.PruneSamples(nowMS - s.params.RetentionMS)
+	if err != nil {
+		s.logger.Error("unable to prune samples", "error", err)
+	} else if pruned > 0 {
+		s.logger.Info("pruned samples", "count", pruned)
+	}
+}
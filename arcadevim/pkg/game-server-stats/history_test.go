@@ -0,0 +1,55 @@
+package gameserverstats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+func TestSamplerMaintain(t *testing.T) {
+	stats := gameserverstats.NewMemory()
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady, Connections: 1}))
+
+	sampler := gameserverstats.NewSampler(stats, gameserverstats.SamplerParams{
+		RetentionMS:            10_000,
+		DownsampleAfterMS:      4000,
+		DownsampleResolutionMS: 2000,
+	})
+
+	start := time.UnixMilli(0)
+	for i := range 12 {
+		sampler.Record(start.Add(time.Duration(i) * time.Second))
+	}
+
+	// 0-1s is past retention, 2-7s is downsampled and 8-11s stays raw
+	sampler.Maintain(start.Add(12 * time.Second))
+	samples, err := stats.GetServerSamples("0", 0, 20_000)
+	require.NoError(t, err)
+
+	raw := 0
+	for _, sample := range samples {
+		require.GreaterOrEqual(t, sample.SampledMS, int64(2000))
+		if sample.ResolutionMS == 0 {
+			raw++
+		}
+	}
+	require.Equal(t, 4, raw)
+	require.Len(t, samples, 7)
+}
+
+func TestSamplerRun(t *testing.T) {
+	stats := gameserverstats.NewMemory()
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gameserverstats.NewSampler(stats, gameserverstats.SamplerParams{IntervalMS: 5}).Run(ctx)
+
+	require.Eventually(t, func() bool {
+		fleet, err := stats.GetFleetSamples(0, time.Now().Add(time.Hour).UnixMilli())
+		return err == nil && len(fleet) >= 2
+	}, time.Second, 5*time.Millisecond)
+}
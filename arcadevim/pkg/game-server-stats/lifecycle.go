@@ -0,0 +1,52 @@
+package gameserverstats
+
+import (
+	"fmt"
+	"time"
+)
+
+// who saw a lifecycle transition happen
+const (
+	SourceGameServer = "game-server"
+	SourceSupervisor = "supervisor"
+	SourceReaper     = "reaper"
+)
+
+// LifecycleEvent is one state transition of a game server, with the
+// connections it had when it happened
+type LifecycleEvent struct {
+	Id           int64  `db:"id"`
+	GameServerId string `db:"game_server_id"`
+	AtMS         int64  `db:"at"`
+
+	Source string `db:"source"`
+	State  State  `db:"state"`
+	Reason string `db:"reason"`
+
+	Connections        int `db:"connections"`
+	ConnectionsAdded   int `db:"connections_added"`
+	ConnectionsRemoved int `db:"connections_removed"`
+}
+
+func NewLifecycleEvent(config GameServerConfig, source string, reason string) LifecycleEvent {
+	return LifecycleEvent{
+		GameServerId:       config.Id,
+		AtMS:               time.Now().UnixMilli(),
+		Source:             source,
+		State:              config.State,
+		Reason:             reason,
+		Connections:        config.Connections,
+		ConnectionsAdded:   config.ConnectionsAdded,
+		ConnectionsRemoved: config.ConnectionsRemoved,
+	}
+}
+
+func (e *LifecycleEvent) String() string {
+	return fmt.Sprintf("Lifecycle(%s): State=%s Source=%s Reason=%s Conns=%d", e.GameServerId, e.State, e.Source, e.Reason, e.Connections)
+}
+
+type LifecycleStore interface {
+	RecordLifecycleEvent(event LifecycleEvent) error
+	// every event of the server, oldest first
+	GetLifecycleEvents(id string) ([]LifecycleEvent, error)
+}
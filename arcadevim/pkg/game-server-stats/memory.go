@@ -0,0 +1,397 @@
+package gameserverstats
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+var MemoryLobbyExists = fmt.Errorf("lobby code is already in use")
+
+// Memory keeps game server stats in the process, no database needed.  Game
+// servers have to report to the same process so it is meant for single
+// process deployments and tests
+type Memory struct {
+	mutex   sync.RWMutex
+	configs map[string]GameServerConfig
+	lobbies map[string]Lobby
+	samples []Sample
+	events  []LifecycleEvent
+	players []PlayerSession
+
+	// rows without a heartbeat for this long are never matched into
+	staleAfterMS int64
+
+	watch *watchers
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		configs: map[string]GameServerConfig{},
+		lobbies: map[string]Lobby{},
+		watch:   newWatchers(),
+
+		staleAfterMS: DefaultStaleAfterMS,
+	}
+}
+
+// WithStaleAfter sets how long a server can go without a heartbeat before it
+// is no longer matched into
+func (m *Memory) WithStaleAfter(ms int64) *Memory {
+	if ms > 0 {
+		m.staleAfterMS = ms
+	}
+	return m
+}
+
+func (m *Memory) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// sorted by id so every read sees the same order
+func (m *Memory) all() []GameServerConfig {
+	configs := make([]GameServerConfig, 0, len(m.configs))
+	for _, c := range m.configs {
+		configs = append(configs, c)
+	}
+	slices.SortFunc(configs, func(a, b GameServerConfig) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return configs
+}
+
+func (m *Memory) GetById(id string) *GameServerConfig {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	config, ok := m.configs[id]
+	if !ok {
+		return nil
+	}
+	return &config
+}
+
+func (m *Memory) GetAllGameServerConfigs() ([]GameServerConfig, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.all(), nil
+}
+
+func (m *Memory) GetConfigByHostAndPort(host string, port uint16) (*GameServerConfig, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, c := range m.all() {
+		if c.Host == host && c.Port == int(port) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetServersByUtilization is every ready public server under maxLoad, the
+// busiest first
+func (m *Memory) GetServersByUtilization(maxLoad float64) []GameServerConfig {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var servers []GameServerConfig
+	freshMS := time.Now().UnixMilli() - m.staleAfterMS
+	for _, c := range m.all() {
+		if float64(c.Load) < maxLoad && c.State == GSStateReady && c.Visibility == VisibilityPublic && c.LastUpdateMS >= freshMS {
+			servers = append(servers, c)
+		}
+	}
+	slices.SortStableFunc(servers, func(a, b GameServerConfig) int {
+		return cmp.Compare(b.Load, a.Load)
+	})
+	return servers
+}
+
+func (m *Memory) Update(stat GameServerConfig) error {
+	stat.LastUpdateMS = time.Now().UnixMilli()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// published under the lock so watchers see updates in the order they
+	// were made
+	m.configs[stat.Id] = stat
+	m.watch.publish(stat)
+	return nil
+}
+
+func (m *Memory) CloseStaleServers(beforeMS int64) ([]GameServerConfig, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	closed := []GameServerConfig{}
+	for _, c := range m.all() {
+		if c.State != GSStateClosed && c.LastUpdateMS < beforeMS {
+			c.State = GSStateClosed
+			m.configs[c.Id] = c
+			m.watch.publish(c)
+			closed = append(closed, c)
+		}
+	}
+	return closed, nil
+}
+
+func (m *Memory) GetServerCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.configs)
+}
+
+func (m *Memory) GetTotalConnectionCount() GameServecConfigConnectionStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var counts GameServecConfigConnectionStats
+	for _, c := range m.configs {
+		counts.Connections += c.Connections
+		counts.ConnectionsAdded += c.ConnectionsAdded
+		counts.ConnectionsRemoved += c.ConnectionsRemoved
+	}
+	return counts
+}
+
+// Watch sends every change to a game server config until ctx is done
+func (m *Memory) Watch(ctx context.Context) <-chan GameServerEvent {
+	return m.watch.subscribe(ctx)
+}
+
+func (m *Memory) CreateLobby(lobby Lobby) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.lobbies[lobby.Code]; ok {
+		return fmt.Errorf("%w: %s", MemoryLobbyExists, lobby.Code)
+	}
+	m.lobbies[lobby.Code] = lobby
+	return nil
+}
+
+func (m *Memory) GetLobby(code string) (*Lobby, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	lobby, ok := m.lobbies[code]
+	if !ok {
+		return nil, nil
+	}
+	return &lobby, nil
+}
+
+func (m *Memory) DeleteLobby(code string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.lobbies, code)
+	return nil
+}
+
+func (m *Memory) RecordSamples(atMS int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, c := range m.all() {
+		if c.State != GSStateClosed {
+			m.samples = append(m.samples, sampleOf(c, atMS))
+		}
+	}
+	return nil
+}
+
+func inRange(sample Sample, fromMS int64, toMS int64) bool {
+	return sample.SampledMS >= fromMS && sample.SampledMS < toMS
+}
+
+func bySampled(a, b Sample) int {
+	return cmp.Compare(a.SampledMS, b.SampledMS)
+}
+
+func (m *Memory) GetServerSamples(id string, fromMS int64, toMS int64) ([]Sample, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	samples := []Sample{}
+	for _, sample := range m.samples {
+		if sample.GameServerId == id && inRange(sample, fromMS, toMS) {
+			samples = append(samples, sample)
+		}
+	}
+	slices.SortStableFunc(samples, bySampled)
+	return samples, nil
+}
+
+func (m *Memory) GetFleetSamples(fromMS int64, toMS int64) ([]FleetSample, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	type total struct {
+		FleetSample
+		load float64
+	}
+	totals := map[int64]*total{}
+	for _, sample := range m.samples {
+		if !inRange(sample, fromMS, toMS) {
+			continue
+		}
+		t, ok := totals[sample.SampledMS]
+		if !ok {
+			t = &total{FleetSample: FleetSample{SampledMS: sample.SampledMS}}
+			totals[sample.SampledMS] = t
+		}
+		t.Servers++
+		t.Connections += sample.Connections
+		t.load += float64(sample.Load)
+	}
+
+	samples := []FleetSample{}
+	for _, t := range totals {
+		t.Load = float32(t.load / float64(t.Servers))
+		samples = append(samples, t.FleetSample)
+	}
+	slices.SortFunc(samples, func(a, b FleetSample) int {
+		return cmp.Compare(a.SampledMS, b.SampledMS)
+	})
+	return samples, nil
+}
+
+func (m *Memory) DownsampleSamples(beforeMS int64, resolutionMS int64) error {
+	beforeMS = downsampleCutoff(beforeMS, resolutionMS)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	type bucket struct {
+		id    string
+		start int64
+	}
+	type total struct {
+		last        Sample
+		count       int
+		connections float64
+		load        float64
+	}
+
+	kept := []Sample{}
+	totals := map[bucket]*total{}
+	order := []bucket{}
+	for _, sample := range m.samples {
+		if sample.ResolutionMS != 0 || sample.SampledMS >= beforeMS {
+			kept = append(kept, sample)
+			continue
+		}
+
+		b := bucket{id: sample.GameServerId, start: sample.SampledMS - sample.SampledMS%resolutionMS}
+		t, ok := totals[b]
+		if !ok {
+			t = &total{}
+			totals[b] = t
+			order = append(order, b)
+		}
+		if t.count == 0 || sample.SampledMS > t.last.SampledMS {
+			t.last = sample
+		}
+		t.count++
+		t.connections += float64(sample.Connections)
+		t.load += float64(sample.Load)
+	}
+
+	for _, b := range order {
+		t := totals[b]
+		sample := t.last
+		sample.SampledMS = b.start
+		sample.ResolutionMS = resolutionMS
+		sample.Connections = int(math.Round(t.connections / float64(t.count)))
+		sample.Load = float32(t.load / float64(t.count))
+		kept = append(kept, sample)
+	}
+	m.samples = kept
+	return nil
+}
+
+func (m *Memory) PruneSamples(beforeMS int64) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	count := len(m.samples)
+	m.samples = slices.DeleteFunc(m.samples, func(sample Sample) bool {
+		return sample.SampledMS < beforeMS
+	})
+	return count - len(m.samples), nil
+}
+
+func (m *Memory) RecordLifecycleEvent(event LifecycleEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	event.Id = int64(len(m.events) + 1)
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *Memory) GetLifecycleEvents(id string) ([]LifecycleEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	events := []LifecycleEvent{}
+	for _, e := range m.events {
+		if e.GameServerId == id {
+			events = append(events, e)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b LifecycleEvent) int {
+		return cmp.Or(cmp.Compare(a.AtMS, b.AtMS), cmp.Compare(a.Id, b.Id))
+	})
+	return events, nil
+}
+
+func (m *Memory) StartPlayerSession(session PlayerSession) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session.Id = int64(len(m.players) + 1)
+	m.players = append(m.players, session)
+	return session.Id, nil
+}
+
+func (m *Memory) EndPlayerSession(id int64, atMS int64, reason string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if id <= 0 || id > int64(len(m.players)) {
+		return nil
+	}
+
+	session := &m.players[id-1]
+	if session.Connected() {
+		session.DisconnectedMS = atMS
+		session.Reason = reason
+	}
+	return nil
+}
+
+func (m *Memory) GetPlayerSessions(clientId string) ([]PlayerSession, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	sessions := []PlayerSession{}
+	for _, s := range m.players {
+		if s.ClientId == clientId {
+			sessions = append(sessions, s)
+		}
+	}
+	slices.SortStableFunc(sessions, func(a, b PlayerSession) int {
+		return cmp.Or(cmp.Compare(a.ConnectedMS, b.ConnectedMS), cmp.Compare(a.Id, b.Id))
+	})
+	return sessions, nil
+}
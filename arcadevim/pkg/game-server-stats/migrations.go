@@ -0,0 +1,182 @@
+package gameserverstats
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrSchemaTooNew = fmt.Errorf("database schema is newer than this build knows about")
+
+// every file is one migration, named <version>_<description>.sql.  Once a
+// migration is released it is never edited, changes go in a new file.
+// Statements are split on ; so keep them out of comments and strings
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// libsql stops running a multi statement query after the first one that
+// changes rows, so every statement is run on its own
+func splitStatements(query string) []string {
+	statements := []string{}
+	for _, statement := range strings.Split(query, ";") {
+		if strings.TrimSpace(statement) != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version: %w", entry.Name(), err)
+		}
+
+		query, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version:    version,
+			name:       entry.Name(),
+			statements: splitStatements(string(query)),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestSchemaVersion is the version every database is migrated to
+func LatestSchemaVersion() int {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+func schemaVersion(ctx context.Context, conn *sqlx.Conn) (int, error) {
+	var version int
+	err := conn.GetContext(ctx, &version, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`)
+	return version, err
+}
+
+// SchemaVersion is the last migration applied to the database
+func (s *Sqlite) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`)
+	return version, err
+}
+
+// Migrate brings the database up to the latest schema.  Databases made
+// before migrations existed are upgraded in place, their tables are left as
+// is and only the missing migrations run
+func (s *Sqlite) Migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := s.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        applied_at INTEGER NOT NULL
+    );`)
+	if err != nil {
+		return err
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if version == latest {
+		return nil
+	}
+
+	// IMMEDIATE takes the write lock up front so two processes never apply
+	// the same migration
+	if _, err = conn.ExecContext(ctx, `BEGIN IMMEDIATE;`); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, `ROLLBACK;`)
+		}
+	}()
+
+	version, err = schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("%w: database is at %d, latest is %d", ErrSchemaTooNew, version, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		s.logger.Warn("applying migration", "version", m.version, "name", m.name)
+		for _, statement := range m.statements {
+			if _, err = conn.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("migration %s failed: %w", m.name, err)
+			}
+		}
+		_, err = conn.ExecContext(ctx, `INSERT INTO schema_version (version, applied_at) VALUES (?, strftime('%s', 'now'));`, m.version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = conn.ExecContext(ctx, `COMMIT;`); err != nil {
+		return err
+	}
+	committed = true
+
+	return nil
+}
@@ -0,0 +1,16 @@
+-- the table every database had before migrations, IF NOT EXISTS lets those
+-- databases pick up from here.  it has to stay exactly what they have, every
+-- column added since goes in a later migration
+CREATE TABLE IF NOT EXISTS GameServerConfigs (
+    id TEXT PRIMARY KEY,
+    state TEXT,
+    connections INTEGER,
+    connections_added INTEGER,
+    connections_removed INTEGER,
+    last_updated INTERGER,
+    load REAL,
+    host TEXT,
+    port INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_load ON GameServerConfigs (load);
@@ -0,0 +1,5 @@
+-- which game a server runs and where, empty matches any request
+ALTER TABLE GameServerConfigs ADD COLUMN game_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE GameServerConfigs ADD COLUMN region TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_labels ON GameServerConfigs (game_type, region);
@@ -0,0 +1,2 @@
+-- private servers are only reachable through the join code of their lobby
+ALTER TABLE GameServerConfigs ADD COLUMN visibility INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+CREATE TABLE Lobbies (
+    code TEXT PRIMARY KEY,
+    game_server_id TEXT NOT NULL,
+    owner TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
@@ -0,0 +1,26 @@
+-- last_updated was declared INTERGER, sqlite can't change a column type so
+-- the table is rebuilt
+CREATE TABLE GameServerConfigs_new (
+    id TEXT PRIMARY KEY,
+    state TEXT,
+    connections INTEGER,
+    connections_added INTEGER,
+    connections_removed INTEGER,
+    last_updated INTEGER,
+    load REAL,
+    host TEXT,
+    port INTEGER,
+    game_type TEXT NOT NULL DEFAULT '',
+    region TEXT NOT NULL DEFAULT '',
+    visibility INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO GameServerConfigs_new (id, state, connections, connections_added, connections_removed, last_updated, load, host, port, game_type, region, visibility)
+SELECT id, state, connections, connections_added, connections_removed, last_updated, load, host, port, game_type, region, visibility
+FROM GameServerConfigs;
+
+DROP TABLE GameServerConfigs;
+ALTER TABLE GameServerConfigs_new RENAME TO GameServerConfigs;
+
+CREATE INDEX idx_load ON GameServerConfigs (load);
+CREATE INDEX idx_labels ON GameServerConfigs (game_type, region);
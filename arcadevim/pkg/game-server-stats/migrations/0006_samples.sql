@@ -0,0 +1,18 @@
+-- append only history of every game server, GameServerConfigs only keeps the
+-- latest row.  resolution is 0 for raw samples and the bucket size in ms for
+-- samples that were downsampled
+CREATE TABLE GameServerSamples (
+    game_server_id TEXT NOT NULL,
+    sampled_at INTEGER NOT NULL,
+    resolution INTEGER NOT NULL DEFAULT 0,
+    state INTEGER NOT NULL,
+    connections INTEGER NOT NULL,
+    connections_added INTEGER NOT NULL,
+    connections_removed INTEGER NOT NULL,
+    load REAL NOT NULL,
+    game_type TEXT NOT NULL DEFAULT '',
+    region TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_samples_time ON GameServerSamples (sampled_at);
+CREATE INDEX idx_samples_server ON GameServerSamples (game_server_id, sampled_at);
@@ -0,0 +1,2 @@
+-- last_updated was written in seconds, heartbeats are checked in ms
+UPDATE GameServerConfigs SET last_updated = last_updated * 1000 WHERE last_updated < 100000000000;
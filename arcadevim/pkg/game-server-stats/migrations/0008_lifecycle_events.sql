@@ -0,0 +1,15 @@
+-- every state change of every game server, GameServerConfigs only keeps the
+-- current state
+CREATE TABLE LifecycleEvents (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    game_server_id TEXT NOT NULL,
+    at INTEGER NOT NULL,
+    source TEXT NOT NULL,
+    state INTEGER NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    connections INTEGER NOT NULL DEFAULT 0,
+    connections_added INTEGER NOT NULL DEFAULT 0,
+    connections_removed INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_lifecycle_server ON LifecycleEvents (game_server_id, at);
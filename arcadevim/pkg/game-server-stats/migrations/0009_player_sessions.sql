@@ -0,0 +1,16 @@
+-- every stay of a client on a game server.  the proxy and the game server
+-- each record their own side of it, disconnected_at is 0 while the client is
+-- still connected
+CREATE TABLE PlayerSessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT NOT NULL,
+    proxy TEXT NOT NULL DEFAULT '',
+    game_server_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    connected_at INTEGER NOT NULL,
+    disconnected_at INTEGER NOT NULL DEFAULT 0,
+    disconnect_reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_player_sessions_client ON PlayerSessions (client_id, connected_at);
+CREATE INDEX idx_player_sessions_server ON PlayerSessions (game_server_id, connected_at);
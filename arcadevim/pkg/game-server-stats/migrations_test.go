@@ -0,0 +1,121 @@
+package gameserverstats_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	"github.com/stretchr/testify/require"
+)
+
+// the schema every database had before migrations
+const legacySchema = `
+CREATE TABLE GameServerConfigs (
+    id TEXT PRIMARY KEY,
+    state TEXT,
+    connections INTEGER,
+    connections_added INTEGER,
+    connections_removed INTEGER,
+    last_updated INTERGER,
+    load REAL,
+    host TEXT,
+    port INTEGER
+);
+CREATE INDEX idx_load ON GameServerConfigs (Load);
+INSERT INTO GameServerConfigs (id, state, connections, connections_added, connections_removed, last_updated, load, host, port)
+VALUES ('legacy', 1, 3, 4, 1, 1700000000, 0.5, '0.0.0.0', 42069)`
+
+func columnType(t *testing.T, path string, column string) string {
+	db, err := sqlx.Open("libsql", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var kind string
+	err = db.Get(&kind, `SELECT type FROM pragma_table_info('GameServerConfigs') WHERE name = ?;`, column)
+	require.NoError(t, err)
+	return kind
+}
+
+func indexes(t *testing.T, path string) []string {
+	db, err := sqlx.Open("libsql", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var names []string
+	err = db.Select(&names, `SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'GameServerConfigs' AND sql IS NOT NULL;`)
+	require.NoError(t, err)
+	return names
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	path := gameserverstats.EnsureSqliteURI(filepath.Join(t.TempDir(), "new.db"))
+	sqlite := gameserverstats.NewSqlite(path)
+	defer sqlite.Close()
+
+	version, err := sqlite.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, gameserverstats.LatestSchemaVersion(), version)
+	require.Equal(t, "INTEGER", columnType(t, path, "last_updated"))
+	require.ElementsMatch(t, []string{"idx_labels", "idx_load"}, indexes(t, path))
+
+	require.NoError(t, sqlite.Update(gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady}))
+	require.Equal(t, 1, sqlite.GetServerCount())
+
+	// opening it again has nothing to do
+	again := gameserverstats.NewSqlite(path)
+	defer again.Close()
+	require.NoError(t, again.Migrate())
+	require.Equal(t, 1, again.GetServerCount())
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := gameserverstats.EnsureSqliteURI(filepath.Join(t.TempDir(), "legacy.db"))
+	db, err := sqlx.Open("libsql", path)
+	require.NoError(t, err)
+	for _, statement := range strings.Split(legacySchema, ";") {
+		_, err = db.Exec(statement)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	sqlite := gameserverstats.NewSqlite(path)
+	defer sqlite.Close()
+
+	version, err := sqlite.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, gameserverstats.LatestSchemaVersion(), version)
+	require.Equal(t, "INTEGER", columnType(t, path, "last_updated"))
+
+	config := sqlite.GetById("legacy")
+	require.NotNil(t, config)
+	require.Equal(t, gameserverstats.GSStateReady, config.State)
+	require.Equal(t, 3, config.Connections)
+	// last_updated used to be written in seconds
+	require.Equal(t, int64(1700000000000), config.LastUpdateMS)
+	require.Equal(t, "", config.GameType)
+	require.Equal(t, "", config.Region)
+	require.Equal(t, gameserverstats.VisibilityPublic, config.Visibility)
+	require.ElementsMatch(t, []string{"idx_labels", "idx_load"}, indexes(t, path))
+
+	lobby := gameserverstats.Lobby{Code: "ABCD", GameServerId: "legacy", Owner: "theprimeagen"}
+	require.NoError(t, sqlite.CreateLobby(lobby))
+	found, err := sqlite.GetLobby("ABCD")
+	require.NoError(t, err)
+	require.Equal(t, "legacy", found.GameServerId)
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	path := gameserverstats.EnsureSqliteURI(filepath.Join(t.TempDir(), "newer.db"))
+	sqlite := gameserverstats.NewSqlite(path)
+	defer sqlite.Close()
+
+	db, err := sqlx.Open("libsql", path)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO schema_version (version, applied_at) VALUES (?, 0);`, gameserverstats.LatestSchemaVersion()+1)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, sqlite.Migrate(), gameserverstats.ErrSchemaTooNew)
+}
@@ -0,0 +1,62 @@
+package gameserverstats
+
+import (
+	"fmt"
+	"time"
+)
+
+// the proxy records the sessions of the clients going through it, the game
+// server records the ones it sees with SourceGameServer
+const SourceProxy = "proxy"
+
+// PlayerSession is one stay of a client on a game server.  ClientId is the
+// hex of the 16 byte id from the client auth
+type PlayerSession struct {
+	Id           int64  `db:"id"`
+	ClientId     string `db:"client_id"`
+	Proxy        string `db:"proxy"`
+	GameServerId string `db:"game_server_id"`
+	Source       string `db:"source"`
+
+	ConnectedMS int64 `db:"connected_at"`
+	// 0 while the client is still connected
+	DisconnectedMS int64  `db:"disconnected_at"`
+	Reason         string `db:"disconnect_reason"`
+}
+
+func NewPlayerSession(clientId string, proxy string, gameServerId string, source string) PlayerSession {
+	return PlayerSession{
+		ClientId:     clientId,
+		Proxy:        proxy,
+		GameServerId: gameServerId,
+		Source:       source,
+		ConnectedMS:  time.Now().UnixMilli(),
+	}
+}
+
+func (p *PlayerSession) Connected() bool {
+	return p.DisconnectedMS == 0
+}
+
+// Duration is how long the client has been on the server, up until now for
+// a client that is still connected
+func (p *PlayerSession) Duration(now time.Time) time.Duration {
+	end := p.DisconnectedMS
+	if p.Connected() {
+		end = now.UnixMilli()
+	}
+	return time.Duration(end-p.ConnectedMS) * time.Millisecond
+}
+
+func (p *PlayerSession) String() string {
+	return fmt.Sprintf("PlayerSession(%s): Server=%s Proxy=%s Source=%s Connected=%d Disconnected=%d Reason=%s", p.ClientId, p.GameServerId, p.Proxy, p.Source, p.ConnectedMS, p.DisconnectedMS, p.Reason)
+}
+
+type PlayerSessionStore interface {
+	// StartPlayerSession returns the id the session is ended with
+	StartPlayerSession(session PlayerSession) (int64, error)
+	// ending a session that already ended keeps the first disconnect
+	EndPlayerSession(id int64, atMS int64, reason string) error
+	// every session of the client, oldest first
+	GetPlayerSessions(clientId string) ([]PlayerSession, error)
+}
@@ -2,68 +2,47 @@ package gameserverstats
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/tursodatabase/go-libsql"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 )
 
-func checkTableExists(db *sqlx.DB) bool {
-    query := `SELECT name
-FROM sqlite_master
-WHERE type='table' AND name='GameServerConfigs';`
-
-    var tableName string
-    err := db.Get(&tableName, query)
-    assert.NoError(err, "error while checking for the table existing")
-    return tableName == "GameServerConfigs"
-}
-
-func deleteTable(db *sqlx.DB) error {
-    query := `DROP TABLE IF EXISTS GameServerConfigs;`
-    _, err := db.Exec(query)
-    return err
-}
-
-// createTable creates the GameServerConfigs table
-func (s *Sqlite) CreateGameServerConfigs() error {
-    // TODO validate this: apparently INTEGER for last_updated makes life
-    // easier for calculations??
-    query := `
-    CREATE TABLE GameServerConfigs (
-        id TEXT PRIMARY KEY,
-        state TEXT,
-        connections INTEGER,
-        connections_added INTEGER,
-        connections_removed INTEGER,
-        last_updated INTERGER,
-        load REAL,
-        host TEXT,
-        port INTEGER
-    );`
-
-    _, err := s.db.Exec(query)
-    if err != nil {
-        return err
-    }
-
-    var createLoadIndex = `CREATE INDEX idx_load ON GameServerConfigs (Load);`
-    _, err = s.db.Exec(createLoadIndex)
-
-    return err
-}
-
 type SqliteFile struct {
     Stats []GameServerConfig `json:"stats"`
 }
 
+// how often the database is checked for writes made by other processes when
+// polling is turned on
+const DefaultPollIntervalMS = 25
+
 type Sqlite struct {
     db *sqlx.DB
     logger *slog.Logger
+
+    // writes from this process take turns so watchers see them in the
+    // order they were made
+    writeMutex sync.Mutex
+
+    // rows without a heartbeat for this long are never matched into
+    staleAfterMS int64
+
+    // 0 only publishes the writes made through this Sqlite
+    pollIntervalMS int64
+
+    watch *watchers
+    watchOnce sync.Once
+    closeOnce sync.Once
+    done chan struct{}
 }
 
 func getLogger() *slog.Logger {
@@ -76,19 +55,160 @@ func ClearSQLiteFiles(path string) {
     os.Remove(fmt.Sprintf("%s-wal", path))
 }
 
+// how long a connection waits on a lock held by another connection or
+// process before failing with database is locked
+const busyTimeoutMS = 3000
+
+// busyConnector sets busy_timeout on every connection it opens.  A pragma only
+// applies to the connection it ran on, so setting it once leaves the rest of
+// the pool failing as soon as a game server process is writing
+type busyConnector struct {
+    driver.Connector
+}
+
+func (b busyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+    conn, err := b.Connector.Connect(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    queryer, ok := conn.(driver.QueryerContext)
+    if !ok {
+        return conn, nil
+    }
+
+    rows, err := queryer.QueryContext(ctx, fmt.Sprintf("PRAGMA busy_timeout=%d;", busyTimeoutMS), nil)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    rows.Close()
+    return conn, nil
+}
+
+func (b busyConnector) Close() error {
+    if closer, ok := b.Connector.(io.Closer); ok {
+        return closer.Close()
+    }
+    return nil
+}
+
+func openLibsql(path string) (*sqlx.DB, error) {
+    db, err := sql.Open("libsql", path)
+    if err != nil || !strings.HasPrefix(path, "file:") {
+        return sqlx.NewDb(db, "libsql"), err
+    }
+
+    // the connector of the driver is only reachable through an open db
+    libsql, ok := db.Driver().(driver.DriverContext)
+    if !ok {
+        return sqlx.NewDb(db, "libsql"), nil
+    }
+    db.Close()
+
+    connector, err := libsql.OpenConnector(path)
+    if err != nil {
+        return nil, err
+    }
+    return sqlx.NewDb(sql.OpenDB(busyConnector{connector}), "libsql"), nil
+}
+
 func NewSqlite(path string) *Sqlite {
     logger := getLogger()
-    db, err := sqlx.Open("libsql", path)
+    db, err := openLibsql(path)
     assert.NoError(err, "failed to open db")
     logger.Warn("New Sqlite", "path", path)
-    return &Sqlite{
+    s := &Sqlite{
         db: db,
         logger: logger,
+        watch: newWatchers(),
+        done: make(chan struct{}),
+        staleAfterMS: DefaultStaleAfterMS,
     }
+
+    err = s.Migrate()
+    assert.NoError(err, "failed to migrate db", "path", path)
+    return s
 }
 
 func (s *Sqlite) Close() error {
-    return s.db.Close()
+    err := error(nil)
+    s.closeOnce.Do(func() {
+        close(s.done)
+        err = s.db.Close()
+    })
+    return err
+}
+
+// Watch sends every change to a game server config until ctx is done.
+// Updates made through this Sqlite, the control plane included, are sent as
+// they are written.  Writes made by other processes are only seen with polling
+func (s *Sqlite) Watch(ctx context.Context) <-chan GameServerEvent {
+    s.watchOnce.Do(func() {
+        configs, err := s.allConfigs()
+        if err != nil {
+            s.logger.Error("unable to read configs to watch", "error", err)
+        }
+        s.watch.seed(configs)
+        if s.pollIntervalMS > 0 {
+            go s.feed()
+        }
+    })
+
+    return s.watch.subscribe(ctx)
+}
+
+func (s *Sqlite) allConfigs() ([]GameServerConfig, error) {
+    var configs []GameServerConfig
+    err := s.db.Select(&configs, `SELECT * FROM GameServerConfigs;`)
+    return configs, err
+}
+
+// feed publishes the writes of other connections.  data_version only moves
+// when another connection commits so the table is only read when needed
+func (s *Sqlite) feed() {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        <-s.done
+        cancel()
+    }()
+
+    conn, err := s.db.Connx(ctx)
+    if err != nil {
+        s.logger.Error("unable to open a connection to watch with", "error", err)
+        return
+    }
+    defer conn.Close()
+
+    ticker := time.NewTicker(time.Millisecond * time.Duration(s.pollIntervalMS))
+    defer ticker.Stop()
+
+    version := int64(-1)
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+        }
+
+        // without a data version every tick reads the table
+        var current int64
+        err := conn.QueryRowxContext(ctx, "PRAGMA data_version;").Scan(&current)
+        if err == nil && current == version {
+            continue
+        }
+        version = current
+
+        configs, err := s.allConfigs()
+        if err != nil {
+            s.logger.Error("unable to read configs for watchers", "error", err)
+            continue
+        }
+        for _, c := range configs {
+            s.watch.publish(c)
+        }
+    }
 }
 
 func (s *Sqlite) setPragma(name string, value string) {
@@ -100,7 +220,7 @@ func (s *Sqlite) setPragma(name string, value string) {
 }
 
 func (s *Sqlite) SetSqliteModes() {
-    s.setPragma("busy_timeout", "3000")
+    s.setPragma("busy_timeout", fmt.Sprintf("%d", busyTimeoutMS))
     s.setPragma("journal_mode", "WAL")
 }
 
@@ -130,14 +250,27 @@ FROM GameServerConfigs;`
 
 func (s *Sqlite) Update(stat GameServerConfig) error {
     s.logger.Info("Updating", "stat", stat)
-    query := `INSERT OR REPLACE INTO GameServerConfigs (id, state, connections, connections_added, connections_removed, load, host, port, last_updated)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, strftime('%s', 'now'));`
+    query := `INSERT OR REPLACE INTO GameServerConfigs (id, state, connections, connections_added, connections_removed, load, host, port, game_type, region, visibility, last_updated)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    // watchers see the heartbeat that was written, not the caller's
+    stat.LastUpdateMS = time.Now().UnixMilli()
 
     // TODO probably don't need to update every
-    res, err := s.db.Exec(query, stat.Id, stat.State, stat.Connections, stat.ConnectionsAdded, stat.ConnectionsRemoved, stat.Load, stat.Host, stat.Port)
+    res, err := s.db.Exec(query, stat.Id, stat.State, stat.Connections, stat.ConnectionsAdded, stat.ConnectionsRemoved, stat.Load, stat.Host, stat.Port, stat.GameType, stat.Region, stat.Visibility, stat.LastUpdateMS)
+    if err != nil {
+        s.logger.Error("update failed", "error", err)
+        return err
+    }
     n, err := res.RowsAffected()
     s.logger.Info("update complete", "rows affected", n, "error", err)
 
+    if err == nil {
+        s.watch.publish(stat)
+    }
     return err
 }
 
@@ -153,7 +286,7 @@ func EnsureSqliteURI(path string) string {
 
 func (j *Sqlite) Run(ctx context.Context) {
     <-ctx.Done()
-    j.db.Close()
+    j.Close()
     j.logger.Warn("Sqlite finished running")
 }
 
@@ -180,7 +313,7 @@ func (s *Sqlite) DeleteGameServerConfig(id string) {
 
 func (s *Sqlite) GetAllGameServerConfigs() ([]GameServerConfig, error) {
     var configs []GameServerConfig
-    query := `SELECT id, state, connections, load, host, port FROM GameServerConfigs;`
+    query := `SELECT id, state, connections, load, host, port, game_type, region, visibility FROM GameServerConfigs;`
 
     err := s.db.Select(&configs, query)
     if err != nil {
@@ -202,12 +335,222 @@ WHERE id=?;`, id)
     return nil
 }
 
+// WithStaleAfter sets how long a server can go without a heartbeat before it
+// is no longer matched into
+func (s *Sqlite) WithStaleAfter(ms int64) *Sqlite {
+    if ms > 0 {
+        s.staleAfterMS = ms
+    }
+    return s
+}
+
+// WithPolling is for game servers that share the database file and write to
+// it themselves instead of reporting over the control plane.  Their writes
+// never go through this Sqlite so the only way to see them is to poll the
+// data version every ms.  Must be set before the first Watch
+func (s *Sqlite) WithPolling(ms int64) *Sqlite {
+    s.pollIntervalMS = ms
+    return s
+}
+
 func (s *Sqlite) GetServersByUtilization(maxLoad float64) []GameServerConfig {
     var g []GameServerConfig
+    freshMS := time.Now().UnixMilli() - s.staleAfterMS
     s.db.Select(&g, `SELECT *
 FROM GameServerConfigs
-WHERE load < ? AND state == ?
-ORDER BY load DESC;`, maxLoad, GSStateReady)
+WHERE load < ? AND state == ? AND visibility == ? AND last_updated >= ?
+ORDER BY load DESC;`, maxLoad, GSStateReady, VisibilityPublic, freshMS)
     s.logger.Info("GetServersByUtilization", "maxLoad", maxLoad, "count", len(g))
     return g
 }
+
+func (s *Sqlite) CloseStaleServers(beforeMS int64) ([]GameServerConfig, error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    closed := []GameServerConfig{}
+    err := s.db.Select(&closed, `UPDATE GameServerConfigs
+SET state = ?
+WHERE state != ? AND last_updated < ?
+RETURNING *;`, GSStateClosed, GSStateClosed, beforeMS)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, c := range closed {
+        s.watch.publish(c)
+    }
+    return closed, nil
+}
+
+func (s *Sqlite) CreateLobby(lobby Lobby) error {
+    s.logger.Info("CreateLobby", "lobby", lobby.String())
+    query := `INSERT INTO Lobbies (code, game_server_id, owner, created_at)
+VALUES (?, ?, ?, ?);`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    _, err := s.db.Exec(query, lobby.Code, lobby.GameServerId, lobby.Owner, lobby.CreatedMS)
+    return err
+}
+
+func (s *Sqlite) GetLobby(code string) (*Lobby, error) {
+    lobbies := []Lobby{}
+    err := s.db.Select(&lobbies, `SELECT * FROM Lobbies WHERE code = ?;`, code)
+    if err != nil || len(lobbies) == 0 {
+        return nil, err
+    }
+    return &lobbies[0], nil
+}
+
+func (s *Sqlite) DeleteLobby(code string) error {
+    s.logger.Info("DeleteLobby", "code", code)
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    _, err := s.db.Exec(`DELETE FROM Lobbies WHERE code = ?;`, code)
+    return err
+}
+
+func (s *Sqlite) RecordSamples(atMS int64) error {
+    query := `INSERT INTO GameServerSamples (game_server_id, sampled_at, resolution, state, connections, connections_added, connections_removed, load, game_type, region)
+SELECT id, ?, 0, state, COALESCE(connections, 0), COALESCE(connections_added, 0), COALESCE(connections_removed, 0), COALESCE(load, 0), game_type, region
+FROM GameServerConfigs
+WHERE state != ?;`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    _, err := s.db.Exec(query, atMS, GSStateClosed)
+    return err
+}
+
+func (s *Sqlite) GetServerSamples(id string, fromMS int64, toMS int64) ([]Sample, error) {
+    samples := []Sample{}
+    err := s.db.Select(&samples, `SELECT *
+FROM GameServerSamples
+WHERE game_server_id = ? AND sampled_at >= ? AND sampled_at < ?
+ORDER BY sampled_at;`, id, fromMS, toMS)
+    return samples, err
+}
+
+func (s *Sqlite) GetFleetSamples(fromMS int64, toMS int64) ([]FleetSample, error) {
+    samples := []FleetSample{}
+    err := s.db.Select(&samples, `SELECT sampled_at,
+    COUNT(*) AS servers,
+    CAST(TOTAL(connections) AS INT) AS connections,
+    AVG(load) AS load
+FROM GameServerSamples
+WHERE sampled_at >= ? AND sampled_at < ?
+GROUP BY sampled_at
+ORDER BY sampled_at;`, fromMS, toMS)
+    return samples, err
+}
+
+func (s *Sqlite) DownsampleSamples(beforeMS int64, resolutionMS int64) error {
+    beforeMS = downsampleCutoff(beforeMS, resolutionMS)
+
+    // the bare columns of a MAX() group come from the row with the max, so
+    // state, the counters and the labels are the ones of the last sample
+    insert := `INSERT INTO GameServerSamples (game_server_id, sampled_at, resolution, state, connections, connections_added, connections_removed, load, game_type, region)
+SELECT game_server_id, bucket, ?, state, connections, connections_added, connections_removed, load, game_type, region
+FROM (
+    SELECT game_server_id,
+        sampled_at - sampled_at % ? AS bucket,
+        MAX(sampled_at) AS last,
+        state,
+        CAST(ROUND(AVG(connections)) AS INT) AS connections,
+        connections_added,
+        connections_removed,
+        AVG(load) AS load,
+        game_type,
+        region
+    FROM GameServerSamples
+    WHERE resolution = 0 AND sampled_at < ?
+    GROUP BY game_server_id, bucket
+);`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    tx, err := s.db.Beginx()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err = tx.Exec(insert, resolutionMS, resolutionMS, beforeMS); err != nil {
+        return err
+    }
+    _, err = tx.Exec(`DELETE FROM GameServerSamples WHERE resolution = 0 AND sampled_at < ?;`, beforeMS)
+    if err != nil {
+        return err
+    }
+
+    return tx.Commit()
+}
+
+func (s *Sqlite) PruneSamples(beforeMS int64) (int, error) {
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    res, err := s.db.Exec(`DELETE FROM GameServerSamples WHERE sampled_at < ?;`, beforeMS)
+    if err != nil {
+        return 0, err
+    }
+    n, err := res.RowsAffected()
+    return int(n), err
+}
+
+func (s *Sqlite) RecordLifecycleEvent(event LifecycleEvent) error {
+    s.logger.Info("RecordLifecycleEvent", "event", event.String())
+    query := `INSERT INTO LifecycleEvents (game_server_id, at, source, state, reason, connections, connections_added, connections_removed)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    _, err := s.db.Exec(query, event.GameServerId, event.AtMS, event.Source, event.State, event.Reason, event.Connections, event.ConnectionsAdded, event.ConnectionsRemoved)
+    return err
+}
+
+func (s *Sqlite) GetLifecycleEvents(id string) ([]LifecycleEvent, error) {
+    events := []LifecycleEvent{}
+    err := s.db.Select(&events, `SELECT *
+FROM LifecycleEvents
+WHERE game_server_id = ?
+ORDER BY at, id;`, id)
+    return events, err
+}
+
+func (s *Sqlite) StartPlayerSession(session PlayerSession) (int64, error) {
+    s.logger.Info("StartPlayerSession", "session", session.String())
+    query := `INSERT INTO PlayerSessions (client_id, proxy, game_server_id, source, connected_at)
+VALUES (?, ?, ?, ?, ?)
+RETURNING id;`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+
+    var id int64
+    err := s.db.Get(&id, query, session.ClientId, session.Proxy, session.GameServerId, session.Source, session.ConnectedMS)
+    return id, err
+}
+
+func (s *Sqlite) EndPlayerSession(id int64, atMS int64, reason string) error {
+    s.logger.Info("EndPlayerSession", "id", id, "at", atMS, "reason", reason)
+    query := `UPDATE PlayerSessions
+SET disconnected_at = ?, disconnect_reason = ?
+WHERE id = ? AND disconnected_at = 0;`
+
+    s.writeMutex.Lock()
+    defer s.writeMutex.Unlock()
+    _, err := s.db.Exec(query, atMS, reason, id)
+    return err
+}
+
+func (s *Sqlite) GetPlayerSessions(clientId string) ([]PlayerSession, error) {
+    sessions := []PlayerSession{}
+    err := s.db.Select(&sessions, `SELECT *
+FROM PlayerSessions
+WHERE client_id = ?
+ORDER BY connected_at, id;`, clientId)
+    return sessions, err
+}
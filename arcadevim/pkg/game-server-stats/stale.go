@@ -0,0 +1,84 @@
+package gameserverstats
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// game servers write their row at least this often, even when nothing changed
+const DefaultHeartbeatIntervalMS = 5000
+
+// a server that missed this many heartbeats in a row is treated as gone
+const DefaultStaleAfterMS = DefaultHeartbeatIntervalMS * 3
+
+type ReaperParams struct {
+	IntervalMS   int64
+	StaleAfterMS int64
+}
+
+func ReaperParamsFromEnv() ReaperParams {
+	return ReaperParams{
+		IntervalMS:   readInt64("STALE_REAP_INTERVAL_MS"),
+		StaleAfterMS: readInt64("STALE_AFTER_MS"),
+	}
+}
+
+func (p ReaperParams) withDefaults() ReaperParams {
+	if p.IntervalMS <= 0 {
+		p.IntervalMS = DefaultHeartbeatIntervalMS
+	}
+	if p.StaleAfterMS <= 0 {
+		p.StaleAfterMS = DefaultStaleAfterMS
+	}
+	return p
+}
+
+// Reaper closes game servers that stopped heartbeating, a server that hard
+// crashed never gets to write its closed state itself
+type Reaper struct {
+	stats  GSSRetriever
+	params ReaperParams
+	logger *slog.Logger
+}
+
+func NewReaper(stats GSSRetriever, params ReaperParams) *Reaper {
+	return &Reaper{
+		stats:  stats,
+		params: params.withDefaults(),
+		logger: slog.Default().With("area", "Reaper"),
+	}
+}
+
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(r.params.IntervalMS))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Reap(now)
+		}
+	}
+}
+
+// Reap closes every server that has been quiet for too long at now
+func (r *Reaper) Reap(now time.Time) []GameServerConfig {
+	closed, err := r.stats.CloseStaleServers(now.UnixMilli() - r.params.StaleAfterMS)
+	if err != nil {
+		r.logger.Error("unable to close stale servers", "error", err)
+		return nil
+	}
+
+	for _, c := range closed {
+		r.logger.Warn("closed stale game server", "id", c.Id, "last heartbeat", c.LastUpdateMS)
+		reason := fmt.Sprintf("no heartbeat for %dms", now.UnixMilli()-c.LastUpdateMS)
+		if err := r.stats.RecordLifecycleEvent(NewLifecycleEvent(c, SourceReaper, reason)); err != nil {
+			r.logger.Error("unable to record stale server", "id", c.Id, "error", err)
+		}
+	}
+	return closed
+}
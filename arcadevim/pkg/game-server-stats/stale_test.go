@@ -0,0 +1,41 @@
+package gameserverstats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+func TestReaper(t *testing.T) {
+	stats := gameserverstats.NewMemory()
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "crashed", State: gameserverstats.GSStateReady}))
+
+	reaper := gameserverstats.NewReaper(stats, gameserverstats.ReaperParams{StaleAfterMS: 1000})
+	require.Empty(t, reaper.Reap(time.Now()))
+
+	closed := reaper.Reap(time.Now().Add(2 * time.Second))
+	require.Len(t, closed, 1)
+	require.Equal(t, gameserverstats.GSStateClosed, stats.GetById("crashed").State)
+
+	events, err := stats.GetLifecycleEvents("crashed")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, gameserverstats.SourceReaper, events[0].Source)
+	require.Equal(t, gameserverstats.GSStateClosed, events[0].State)
+}
+
+func TestReaperRun(t *testing.T) {
+	stats := gameserverstats.NewMemory()
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{Id: "crashed", State: gameserverstats.GSStateReady}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gameserverstats.NewReaper(stats, gameserverstats.ReaperParams{IntervalMS: 5, StaleAfterMS: 20}).Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return stats.GetById("crashed").State == gameserverstats.GSStateClosed
+	}, time.Second, 5*time.Millisecond)
+}
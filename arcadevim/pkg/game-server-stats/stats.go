@@ -14,6 +14,15 @@ const (
 	GSStateClosed
 )
 
+type Visibility int
+
+const (
+	// listed for matchmaking
+	VisibilityPublic Visibility = iota
+	// only reachable through the join code of its lobby
+	VisibilityPrivate
+)
+
 type GameServecConfigConnectionStats struct {
 	Connections        int `db:"connections"`
 	ConnectionsAdded   int `db:"connections_added"`
@@ -47,6 +56,12 @@ type GameServerConfig struct {
 	Host string `db:"host"`
 
 	Port int `db:"port"`
+
+	// which game the server runs and where, empty means unlabeled
+	GameType string `db:"game_type"`
+	Region   string `db:"region"`
+
+	Visibility Visibility `db:"visibility"`
 }
 
 func (g *GameServerConfig) Equal(other *GameServerConfig) bool {
@@ -71,14 +86,70 @@ func stateToString(state State) string {
 	}
 }
 
+func (s State) String() string {
+	return stateToString(s)
+}
+
 func (g *GameServerConfig) String() string {
-	return fmt.Sprintf("Server(%s): Addr=%s Conns=%d Load=%f State=%s", g.Id, g.Addr(), g.Connections, g.Load, stateToString(g.State))
+	return fmt.Sprintf("Server(%s): Addr=%s Conns=%d Load=%f State=%s GameType=%s Region=%s", g.Id, g.Addr(), g.Connections, g.Load, stateToString(g.State), g.GameType, g.Region)
 }
 
 func (g *GameServerConfig) Addr() string {
 	return fmt.Sprintf("%s:%d", g.Host, g.Port)
 }
 
+// MatchRequest is what a client is asking to be matched into.  An empty
+// label matches any server
+type MatchRequest struct {
+	GameType string
+	Region   string
+
+	// a private server is created for the request and never matched into
+	Private bool
+}
+
+func (m MatchRequest) Matches(g *GameServerConfig) bool {
+	return (m.GameType == "" || m.GameType == g.GameType) &&
+		(m.Region == "" || m.Region == g.Region) &&
+		g.Visibility == VisibilityPublic
+}
+
+func (m MatchRequest) String() string {
+	return fmt.Sprintf("GameType=%s Region=%s Private=%v", m.GameType, m.Region, m.Private)
+}
+
+// Lobby is a private game server that friends join with a short code
+type Lobby struct {
+	Code         string `db:"code"`
+	GameServerId string `db:"game_server_id"`
+
+	// id of the client that created the lobby
+	Owner string `db:"owner"`
+
+	CreatedMS int64 `db:"created_at"`
+}
+
+func (l *Lobby) String() string {
+	return fmt.Sprintf("Lobby(%s): Server=%s Owner=%s", l.Code, l.GameServerId, l.Owner)
+}
+
+type LobbyStore interface {
+	CreateLobby(lobby Lobby) error
+	// nil when no lobby has the code
+	GetLobby(code string) (*Lobby, error)
+	DeleteLobby(code string) error
+}
+
+// GameServerReporter is everything a game server writes about itself.  The
+// stores implement it and so does the control plane client of game servers
+// that cannot reach the database
+type GameServerReporter interface {
+	Update(stats GameServerConfig) error
+	RecordLifecycleEvent(event LifecycleEvent) error
+	StartPlayerSession(session PlayerSession) (int64, error)
+	EndPlayerSession(id int64, atMS int64, reason string) error
+}
+
 // TODO I don't know what to call this thing...
 type GSSRetriever interface {
 	GetById(string) *GameServerConfig
@@ -88,4 +159,16 @@ type GSSRetriever interface {
 	Update(stats GameServerConfig) error
 	GetServerCount() int
 	GetTotalConnectionCount() GameServecConfigConnectionStats
+
+	// CloseStaleServers closes every server whose last heartbeat is older
+	// than beforeMS and returns them
+	CloseStaleServers(beforeMS int64) ([]GameServerConfig, error)
+
+	// Watch sends every change to a game server until ctx is done, then the
+	// channel is closed
+	Watch(ctx context.Context) <-chan GameServerEvent
+
+	SampleStore
+	LifecycleStore
+	PlayerSessionStore
 }
@@ -0,0 +1,140 @@
+package gameserverstats
+
+import (
+	"context"
+	"sync"
+)
+
+// GameServerEvent is sent every time a game server config changes
+type GameServerEvent struct {
+	// nil when the server was not known about before
+	Previous *GameServerConfig
+	Current  GameServerConfig
+}
+
+func (e GameServerEvent) StateChanged() bool {
+	return e.Previous == nil || e.Previous.State != e.Current.State
+}
+
+// FreedCapacity is true when the server can take more clients than before
+func (e GameServerEvent) FreedCapacity() bool {
+	if e.Current.State != GSStateReady {
+		return false
+	}
+	return e.StateChanged() || e.Current.Connections < e.Previous.Connections
+}
+
+func sameConfig(a GameServerConfig, b GameServerConfig) bool {
+	a.LastUpdateMS = 0
+	b.LastUpdateMS = 0
+	return a == b
+}
+
+// subscriber queues events so a slow reader never holds up publishing or
+// misses an event
+type subscriber struct {
+	mutex  sync.Mutex
+	queue  []GameServerEvent
+	signal chan struct{}
+	out    chan GameServerEvent
+}
+
+func (s *subscriber) push(e GameServerEvent) {
+	s.mutex.Lock()
+	s.queue = append(s.queue, e)
+	s.mutex.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run(ctx context.Context, unsubscribe func()) {
+	defer close(s.out)
+	defer unsubscribe()
+
+	for {
+		s.mutex.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mutex.Unlock()
+
+		for _, e := range queue {
+			select {
+			case s.out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-s.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchers keeps the last known config of every server so only real changes
+// are sent, no matter how many times the same config is published
+type watchers struct {
+	mutex sync.Mutex
+	known map[string]GameServerConfig
+	subs  map[*subscriber]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		known: map[string]GameServerConfig{},
+		subs:  map[*subscriber]struct{}{},
+	}
+}
+
+// seed sets what is known without telling anyone about it
+func (w *watchers) seed(configs []GameServerConfig) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, c := range configs {
+		w.known[c.Id] = c
+	}
+}
+
+func (w *watchers) publish(config GameServerConfig) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	e := GameServerEvent{Current: config}
+	if previous, ok := w.known[config.Id]; ok {
+		if sameConfig(previous, config) {
+			return
+		}
+		e.Previous = &previous
+	}
+	w.known[config.Id] = config
+
+	for s := range w.subs {
+		s.push(e)
+	}
+}
+
+// subscribe sends every change until ctx is done, then the channel is closed
+func (w *watchers) subscribe(ctx context.Context) <-chan GameServerEvent {
+	s := &subscriber{
+		signal: make(chan struct{}, 1),
+		out:    make(chan GameServerEvent),
+	}
+
+	w.mutex.Lock()
+	w.subs[s] = struct{}{}
+	w.mutex.Unlock()
+
+	go s.run(ctx, func() {
+		w.mutex.Lock()
+		delete(w.subs, s)
+		w.mutex.Unlock()
+	})
+
+	return s.out
+}
@@ -0,0 +1,119 @@
+package gameserverstats_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+func nextEvent(t *testing.T, events <-chan gameserverstats.GameServerEvent) gameserverstats.GameServerEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		require.FailNow(t, "expected a game server event")
+	}
+	return gameserverstats.GameServerEvent{}
+}
+
+func requireNoEvent(t *testing.T, events <-chan gameserverstats.GameServerEvent) {
+	select {
+	case e := <-events:
+		require.FailNow(t, "unexpected game server event", "event", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSqliteWatch(t *testing.T) {
+	path := gameserverstats.EnsureSqliteURI(filepath.Join(t.TempDir(), "watch.db"))
+	proxy := gameserverstats.NewSqlite(path)
+	defer proxy.Close()
+	proxy.SetSqliteModes()
+
+	existing := gameserverstats.GameServerConfig{Id: "existing", State: gameserverstats.GSStateReady}
+	require.NoError(t, proxy.Update(existing))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := proxy.Watch(ctx)
+
+	// servers that existed before watching are not sent
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateInitializing}
+	before := time.Now().UnixMilli()
+	require.NoError(t, proxy.Update(config))
+	e := nextEvent(t, events)
+	require.Nil(t, e.Previous)
+	require.Equal(t, "0", e.Current.Id)
+	require.GreaterOrEqual(t, e.Current.LastUpdateMS, before)
+	require.True(t, e.StateChanged())
+	require.False(t, e.FreedCapacity())
+
+	// the same config twice is one change
+	require.NoError(t, proxy.Update(config))
+	requireNoEvent(t, events)
+
+	config.State = gameserverstats.GSStateReady
+	config.Connections = 2
+	require.NoError(t, proxy.Update(config))
+	e = nextEvent(t, events)
+	require.Equal(t, gameserverstats.GSStateInitializing, e.Previous.State)
+	require.Equal(t, gameserverstats.GSStateReady, e.Current.State)
+	require.True(t, e.FreedCapacity())
+
+	// without polling the writes of other processes are not seen
+	server := gameserverstats.NewSqlite(path)
+	defer server.Close()
+	server.SetSqliteModes()
+
+	config.Connections = 3
+	require.NoError(t, server.Update(config))
+	requireNoEvent(t, events)
+
+	config.Connections = 1
+	require.NoError(t, proxy.Update(config))
+	e = nextEvent(t, events)
+	require.False(t, e.StateChanged())
+	require.True(t, e.FreedCapacity())
+	require.Equal(t, 1, e.Current.Connections)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-events:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+}
+
+func TestSqliteWatchPolling(t *testing.T) {
+	path := gameserverstats.EnsureSqliteURI(filepath.Join(t.TempDir(), "watch.db"))
+	proxy := gameserverstats.NewSqlite(path).WithPolling(gameserverstats.DefaultPollIntervalMS)
+	defer proxy.Close()
+	proxy.SetSqliteModes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := proxy.Watch(ctx)
+
+	// a game server process has its own connection to the database
+	server := gameserverstats.NewSqlite(path)
+	defer server.Close()
+	server.SetSqliteModes()
+
+	config := gameserverstats.GameServerConfig{Id: "0", State: gameserverstats.GSStateReady, Connections: 2}
+	require.NoError(t, server.Update(config))
+	e := nextEvent(t, events)
+	require.Nil(t, e.Previous)
+	require.Equal(t, 2, e.Current.Connections)
+
+	config.Connections = 1
+	require.NoError(t, server.Update(config))
+	e = nextEvent(t, events)
+	require.False(t, e.StateChanged())
+	require.True(t, e.FreedCapacity())
+}
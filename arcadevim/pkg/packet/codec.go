@@ -0,0 +1,229 @@
+package packet
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+)
+
+var PacketTypeNotRegistered = fmt.Errorf("Packet type has no registered payload")
+var PacketPayloadTypeMismatch = fmt.Errorf("Payload type does not match the type registered for the packet")
+var PacketEncodingMismatch = fmt.Errorf("Packet encoding does not match the registered codec")
+
+// Codec turns a payload into the bytes of a packet and back again.  The
+// Encoding is what ends up in the header so the other side knows what it is
+// looking at
+type Codec interface {
+    Encoding() Encoding
+    Marshal(v any) ([]byte, error)
+    Unmarshal(data []byte, v any) error
+}
+
+type JSONCodec struct {}
+
+func (j JSONCodec) Encoding() Encoding {
+    return EncodingJSON
+}
+
+func (j JSONCodec) Marshal(v any) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (j JSONCodec) Unmarshal(data []byte, v any) error {
+    return json.Unmarshal(data, v)
+}
+
+// StringCodec works with any type whose underlying kind is a string
+type StringCodec struct {}
+
+func (s StringCodec) Encoding() Encoding {
+    return EncodingString
+}
+
+func (s StringCodec) Marshal(v any) ([]byte, error) {
+    value := reflect.ValueOf(v)
+    if value.Kind() != reflect.String {
+        return nil, fmt.Errorf("StringCodec cannot marshal %T", v)
+    }
+    return []byte(value.String()), nil
+}
+
+func (s StringCodec) Unmarshal(data []byte, v any) error {
+    value := reflect.ValueOf(v)
+    if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.String {
+        return fmt.Errorf("StringCodec cannot unmarshal into %T", v)
+    }
+    value.Elem().SetString(string(data))
+    return nil
+}
+
+// BytesCodec hands the raw payload to types that know their own binary
+// layout (encoding.BinaryMarshaler / encoding.BinaryUnmarshaler) or []byte
+type BytesCodec struct {}
+
+func (b BytesCodec) Encoding() Encoding {
+    return EncodingBytes
+}
+
+func (b BytesCodec) Marshal(v any) ([]byte, error) {
+    switch value := v.(type) {
+    case encoding.BinaryMarshaler:
+        return value.MarshalBinary()
+    case []byte:
+        return value, nil
+    }
+    return nil, fmt.Errorf("BytesCodec cannot marshal %T", v)
+}
+
+func (b BytesCodec) Unmarshal(data []byte, v any) error {
+    switch value := v.(type) {
+    case encoding.BinaryUnmarshaler:
+        return value.UnmarshalBinary(data)
+    case *[]byte:
+        *value = append([]byte{}, data...)
+        return nil
+    }
+    return fmt.Errorf("BytesCodec cannot unmarshal into %T", v)
+}
+
+// VersionedCodec picks the codec by the version of the packet, a payload can
+// change its layout in a new version while v1 peers keep the one they know.
+// As a Codec it is the v1 codec, Encode and Decode pick by version
+type VersionedCodec struct {
+    V1 Codec
+    V2 Codec
+}
+
+func (v VersionedCodec) Encoding() Encoding {
+    return v.V1.Encoding()
+}
+
+func (v VersionedCodec) Marshal(value any) ([]byte, error) {
+    return v.V1.Marshal(value)
+}
+
+func (v VersionedCodec) Unmarshal(data []byte, value any) error {
+    return v.V1.Unmarshal(data, value)
+}
+
+func codecFor(codec Codec, version uint8) Codec {
+    versioned, ok := codec.(VersionedCodec)
+    if !ok {
+        return codec
+    }
+    if version == VERSION_2 {
+        return versioned.V2
+    }
+    return versioned.V1
+}
+
+type registration struct {
+    payload reflect.Type
+    codec Codec
+}
+
+var registry = map[PacketType]registration{}
+
+// Register ties a packet type to the go type of its payload and the codec
+// used to put it on the wire.  Each packet type can only be registered once
+func Register[T any](t PacketType, codec Codec) {
+    _, exists := registry[t]
+    assert.Assert(!exists, "packet type has already been registered", "type", t)
+    assert.Assert(t < MAX_TYPE_SIZE, "max type size exceeded", "MAX", MAX_TYPE_SIZE - 1, "received", t)
+
+    registry[t] = registration{
+        payload: reflect.TypeFor[T](),
+        codec: codec,
+    }
+}
+
+func IsRegistered(t PacketType) bool {
+    _, ok := registry[t]
+    return ok
+}
+
+// isVersioned is true when the payload of t is laid out differently per
+// version and has to be encoded again instead of given a new header
+func isVersioned(t PacketType) bool {
+    reg, ok := registry[t]
+    if !ok {
+        return false
+    }
+    _, ok = reg.codec.(VersionedCodec)
+    return ok
+}
+
+func Encode(t PacketType, value any) (Packet, error) {
+    return EncodeWithVersion(VERSION, t, value)
+}
+
+func EncodeWithVersion(version uint8, t PacketType, value any) (Packet, error) {
+    reg, ok := registry[t]
+    if !ok {
+        return Packet{}, errors.Join(PacketTypeNotRegistered, fmt.Errorf("type: %d", t))
+    }
+
+    rv := reflect.ValueOf(value)
+    if rv.Kind() == reflect.Pointer && rv.Type().Elem() == reg.payload {
+        value = rv.Elem().Interface()
+    } else if rv.Type() != reg.payload {
+        return Packet{}, errors.Join(
+            PacketPayloadTypeMismatch,
+            fmt.Errorf("expected %s received %T", reg.payload, value))
+    }
+
+    codec := codecFor(reg.codec, version)
+    data, err := codec.Marshal(value)
+    if err != nil {
+        return Packet{}, err
+    }
+
+    if len(data) > maxPayloadSize(version) {
+        if version == VERSION_2 {
+            return Packet{}, PacketV2MaxSizeExceeded
+        }
+        return Packet{}, PacketMaxSizeExceeded
+    }
+
+    return PacketFromVersionedParts(version, t, codec.Encoding(), data), nil
+}
+
+// MustEncode is for the packets that we construct ourselves where failing to
+// encode is a programming error
+func MustEncode(t PacketType, value any) Packet {
+    return MustEncodeWithVersion(VERSION, t, value)
+}
+
+func MustEncodeWithVersion(version uint8, t PacketType, value any) Packet {
+    pkt, err := EncodeWithVersion(version, t, value)
+    assert.NoError(err, "unable to encode packet", "type", t, "version", version)
+    return pkt
+}
+
+func Decode[T any](p *Packet) (T, error) {
+    var out T
+    reg, ok := registry[p.Type()]
+    if !ok {
+        return out, errors.Join(PacketTypeNotRegistered, fmt.Errorf("type: %d", p.Type()))
+    }
+
+    if reflect.TypeFor[T]() != reg.payload {
+        return out, errors.Join(
+            PacketPayloadTypeMismatch,
+            fmt.Errorf("expected %s received %s", reg.payload, reflect.TypeFor[T]()))
+    }
+
+    codec := codecFor(reg.codec, p.Version())
+    if p.Encoding() != codec.Encoding() {
+        return out, errors.Join(
+            PacketEncodingMismatch,
+            fmt.Errorf("expected %d received %d", codec.Encoding(), p.Encoding()))
+    }
+
+    err := codec.Unmarshal(p.Data(), &out)
+    return out, err
+}
@@ -0,0 +1,205 @@
+package packet_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/packet"
+)
+
+const testJSONType packet.PacketType = 60
+
+type TestJSONPayload struct {
+    Name string `json:"name"`
+    Count int `json:"count"`
+}
+
+func init() {
+    packet.Register[TestJSONPayload](testJSONType, packet.JSONCodec{})
+}
+
+func TestCodecJSON(t *testing.T) {
+    payload := TestJSONPayload{Name: "vim", Count: 69}
+    pkt, err := packet.Encode(testJSONType, payload)
+    require.NoError(t, err)
+    require.Equal(t, packet.EncodingJSON, pkt.Encoding())
+    require.Equal(t, testJSONType, pkt.Type())
+    require.JSONEq(t, `{"name":"vim","count":69}`, string(pkt.Data()))
+
+    out, err := packet.Decode[TestJSONPayload](&pkt)
+    require.NoError(t, err)
+    require.Equal(t, payload, out)
+
+    ptrPkt, err := packet.Encode(testJSONType, &payload)
+    require.NoError(t, err)
+    require.Equal(t, pkt, ptrPkt)
+}
+
+func TestCodecBuiltins(t *testing.T) {
+    id := [16]byte{0, 4, 2, 0, 1, 3, 3, 7, 0, 0, 4, 2, 0, 0, 6, 9}
+    auth := packet.CreateClientAuth(id[:])
+    require.Equal(t, packet.EncodingBytes, auth.Encoding())
+    require.Equal(t, id[:], auth.Data())
+
+    decodedAuth, err := packet.Decode[packet.ClientAuth](&auth)
+    require.NoError(t, err)
+    require.Equal(t, id, decodedAuth.Id)
+    require.Equal(t, "", decodedAuth.GameType)
+
+    matchAuth := packet.CreateMatchClientAuth(id[:], "vim-arcade", "us-east")
+    require.Equal(t, packet.CLIENT_ID_SIZE + 5 + len("vim-arcade") + len("us-east"), matchAuth.Len())
+
+    decodedAuth, err = packet.Decode[packet.ClientAuth](&matchAuth)
+    require.NoError(t, err)
+    require.Equal(t, packet.ClientAuth{Id: id, GameType: "vim-arcade", Region: "us-east"}, decodedAuth)
+
+    regionOnly := packet.CreateMatchClientAuth(id[:], "", "eu-west")
+    decodedAuth, err = packet.Decode[packet.ClientAuth](&regionOnly)
+    require.NoError(t, err)
+    require.Equal(t, "", decodedAuth.GameType)
+    require.Equal(t, "eu-west", decodedAuth.Region)
+    require.False(t, decodedAuth.IsParty())
+
+    partyAuth := packet.CreatePartyClientAuth(id[:], "vim-arcade", "", "friends", 3)
+    decodedAuth, err = packet.Decode[packet.ClientAuth](&partyAuth)
+    require.NoError(t, err)
+    require.Equal(t, packet.ClientAuth{Id: id, GameType: "vim-arcade", Party: "friends", PartySize: 3}, decodedAuth)
+    require.True(t, decodedAuth.IsParty())
+
+    lobbyAuth := packet.CreateLobbyClientAuth(id[:], "vim-arcade", "us-east")
+    decodedAuth, err = packet.Decode[packet.ClientAuth](&lobbyAuth)
+    require.NoError(t, err)
+    require.Equal(t, packet.LobbyCreate, decodedAuth.Lobby)
+    require.Equal(t, "vim-arcade", decodedAuth.GameType)
+
+    joinAuth := packet.CreateJoinLobbyClientAuth(id[:], "ABC123")
+    decodedAuth, err = packet.Decode[packet.ClientAuth](&joinAuth)
+    require.NoError(t, err)
+    require.Equal(t, packet.ClientAuth{Id: id, Lobby: packet.LobbyJoin, LobbyCode: "ABC123"}, decodedAuth)
+
+    rsp := packet.CreateServerAuthResponse(true, "69")
+    require.Equal(t, []byte{1, '6', '9'}, rsp.Data())
+    require.Equal(t, "69", packet.ServerAuthGameId(&rsp))
+
+    decodedRsp, err := packet.Decode[packet.ServerAuthResponse](&rsp)
+    require.NoError(t, err)
+    require.Equal(t, packet.ServerAuthResponse{Accepted: true, GameId: "69"}, decodedRsp)
+    require.False(t, decodedRsp.HasSession())
+
+    session := [packet.SESSION_TOKEN_SIZE]byte{}
+    session[0] = 0x42
+    sessionRsp := packet.CreateSessionAuthResponse("69", session)
+    require.Equal(t, 1 + packet.SESSION_TOKEN_SIZE + 2, sessionRsp.Len())
+    require.Equal(t, "69", packet.ServerAuthGameId(&sessionRsp))
+
+    decodedRsp, err = packet.Decode[packet.ServerAuthResponse](&sessionRsp)
+    require.NoError(t, err)
+    require.True(t, decodedRsp.Accepted)
+    require.Equal(t, session, decodedRsp.Session)
+
+    lobbyRsp := packet.MustEncode(packet.PacketServerAuthResponse, packet.ServerAuthResponse{
+        Accepted: true,
+        GameId: "69",
+        Session: session,
+        Lobby: "ABC123",
+    })
+    decodedRsp, err = packet.Decode[packet.ServerAuthResponse](&lobbyRsp)
+    require.NoError(t, err)
+    require.Equal(t, "ABC123", decodedRsp.Lobby)
+    require.Equal(t, session, decodedRsp.Session)
+    require.Equal(t, "69", decodedRsp.GameId)
+
+    resume := packet.CreateClientResume(session)
+    decodedResume, err := packet.Decode[packet.ClientResume](&resume)
+    require.NoError(t, err)
+    require.Equal(t, session, decodedResume.Token)
+
+    msg := packet.CreateMessage("hello")
+    decodedMsg, err := packet.Decode[string](&msg)
+    require.NoError(t, err)
+    require.Equal(t, "hello", decodedMsg)
+
+    closePkt := packet.CreateCloseConnection()
+    require.Equal(t, 0, closePkt.Len())
+    _, err = packet.Decode[packet.CloseConnection](&closePkt)
+    require.NoError(t, err)
+
+    closePkt = packet.CreateCloseConnectionWithReason("shutting down")
+    decodedClose, err := packet.Decode[packet.CloseConnection](&closePkt)
+    require.NoError(t, err)
+    require.Equal(t, "shutting down", decodedClose.Reason)
+}
+
+func TestCodecErrors(t *testing.T) {
+    _, err := packet.Encode(testJSONType, "not the payload")
+    require.ErrorIs(t, err, packet.PacketPayloadTypeMismatch)
+
+    _, err = packet.Encode(packet.PacketItem, TestJSONPayload{})
+    require.ErrorIs(t, err, packet.PacketTypeNotRegistered)
+
+    msg := packet.CreateMessage("hello")
+    _, err = packet.Decode[TestJSONPayload](&msg)
+    require.ErrorIs(t, err, packet.PacketPayloadTypeMismatch)
+
+    wrongEnc := packet.PacketFromParts(testJSONType, packet.EncodingBytes, []byte("{}"))
+    _, err = packet.Decode[TestJSONPayload](&wrongEnc)
+    require.ErrorIs(t, err, packet.PacketEncodingMismatch)
+
+    short := packet.PacketFromParts(packet.PacketClientAuth, packet.EncodingBytes, []byte{1, 2, 3})
+    _, err = packet.Decode[packet.ClientAuth](&short)
+    require.Error(t, err)
+
+    badLabels := packet.PacketFromParts(packet.PacketClientAuth, packet.EncodingBytes, append(make([]byte, packet.CLIENT_ID_SIZE), 5, 'v'))
+    _, err = packet.Decode[packet.ClientAuth](&badLabels)
+    require.Error(t, err)
+
+    noPartySize := packet.PacketFromParts(packet.PacketClientAuth, packet.EncodingBytes, append(make([]byte, packet.CLIENT_ID_SIZE), 0, 0))
+    _, err = packet.Decode[packet.ClientAuth](&noPartySize)
+    require.Error(t, err)
+
+    badLobby := packet.PacketFromParts(packet.PacketClientAuth, packet.EncodingBytes, append(make([]byte, packet.CLIENT_ID_SIZE), 0, 0, 0, 0, 9))
+    _, err = packet.Decode[packet.ClientAuth](&badLobby)
+    require.Error(t, err)
+
+    truncatedLobby := packet.PacketFromParts(packet.PacketServerAuthResponse, packet.EncodingBytes, []byte{5, 4, 'A'})
+    _, err = packet.Decode[packet.ServerAuthResponse](&truncatedLobby)
+    require.Error(t, err)
+}
+
+func TestCodecVersionedAuth(t *testing.T) {
+    id := [16]byte{0, 4, 2, 0, 1, 3, 3, 7, 0, 0, 4, 2, 0, 0, 6, 9}
+    auth := packet.ClientAuth{Id: id, GameType: "vim-arcade", Party: "friends", PartySize: 3}
+
+    // v2 peers get json, v1 peers keep the binary layout
+    v2, err := packet.EncodeWithVersion(packet.VERSION_2, packet.PacketClientAuth, auth)
+    require.NoError(t, err)
+    require.Equal(t, packet.EncodingJSON, v2.Encoding())
+
+    decodedAuth, err := packet.Decode[packet.ClientAuth](&v2)
+    require.NoError(t, err)
+    require.Equal(t, auth, decodedAuth)
+
+    v1 := packet.MustEncode(packet.PacketClientAuth, auth)
+    require.Equal(t, packet.EncodingBytes, v1.Encoding())
+
+    rsp := packet.ServerAuthResponse{Accepted: true, GameId: "69", Lobby: "ABC123"}
+    v2Rsp := packet.MustEncodeWithVersion(packet.VERSION_2, packet.PacketServerAuthResponse, rsp)
+    require.Equal(t, packet.EncodingJSON, v2Rsp.Encoding())
+
+    decodedRsp, err := packet.Decode[packet.ServerAuthResponse](&v2Rsp)
+    require.NoError(t, err)
+    require.Equal(t, rsp, decodedRsp)
+
+    // each version only takes its own encoding
+    bytesV2 := packet.PacketFromVersionedParts(packet.VERSION_2, packet.PacketClientAuth, packet.EncodingBytes, id[:])
+    _, err = packet.Decode[packet.ClientAuth](&bytesV2)
+    require.ErrorIs(t, err, packet.PacketEncodingMismatch)
+
+    jsonV1 := packet.PacketFromParts(packet.PacketClientAuth, packet.EncodingJSON, []byte("{}"))
+    _, err = packet.Decode[packet.ClientAuth](&jsonV1)
+    require.ErrorIs(t, err, packet.PacketEncodingMismatch)
+
+    badLobby := packet.PacketFromVersionedParts(packet.VERSION_2, packet.PacketClientAuth, packet.EncodingJSON, []byte(`{"lobby":9}`))
+    _, err = packet.Decode[packet.ClientAuth](&badLobby)
+    require.Error(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"time"
 
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 	prettylog "github.com/khulnasoft/next.vim/arcadevim/pkg/pretty-log"
@@ -14,6 +15,12 @@ import (
 
 const VERSION uint8 = 1
 
+// VERSION_2 packets use a 32 bit length so that payloads can be well past
+// the 1KB v1 cap.  v1 is still accepted everywhere, the version byte of each
+// packet decides how its header is read
+const VERSION_2 uint8 = 2
+const MAX_VERSION = VERSION_2
+
 const HEADER_SIZE = 4
 const TYPE_ENC_INDEX = 1
 const MAX_TYPE_SIZE = 0x3F
@@ -21,10 +28,13 @@ const HEADER_LENGTH_OFFSET = 2
 const PACKET_MAX_SIZE = 1024
 const PACKET_PAYLOAD_SIZE = 1024 - HEADER_SIZE
 
-const PACKET_AUTH_SIZE = 16 + HEADER_SIZE
+const HEADER_SIZE_V2 = 6
+const PACKET_V2_MAX_SIZE = 1 << 20
+const PACKET_V2_PAYLOAD_SIZE = PACKET_V2_MAX_SIZE - HEADER_SIZE_V2
 
 var PacketMaxSizeExceeded = fmt.Errorf("Packet length has exceeded allowed size of %d", PACKET_PAYLOAD_SIZE - 1)
-var PacketVersionMismatch = fmt.Errorf("Expected packet version to equal %d", VERSION)
+var PacketV2MaxSizeExceeded = fmt.Errorf("Packet length has exceeded allowed size of %d", PACKET_V2_PAYLOAD_SIZE)
+var PacketVersionMismatch = fmt.Errorf("Expected packet version to be between %d and %d", VERSION, MAX_VERSION)
 var PacketBufferNotBigEnough = fmt.Errorf("Buffer could not fit the entire packet")
 
 type Encoding uint8
@@ -47,6 +57,20 @@ const (
     PacketItem
     PacketItemUpdate
     PacketCloseConnection
+    PacketPing
+    PacketPong
+    PacketQueueStatus
+    PacketClientResume
+
+    // control plane, a game server reporting itself to the matchmaker
+    PacketServerRegister
+    PacketServerStats
+    PacketServerDeregister
+    PacketServerLifecycle
+    PacketServerPlayerSession
+
+    // keep this last, new types go above it
+    packetTypeCount
 )
 
 type Packet struct {
@@ -71,28 +95,68 @@ func TypeToString(t PacketType) string {
     case PacketItem: return "Item"
     case PacketItemUpdate: return "ItemUpdate"
     case PacketCloseConnection: return "CloseConnection"
+    case PacketPing: return "Ping"
+    case PacketPong: return "Pong"
+    case PacketQueueStatus: return "QueueStatus"
+    case PacketClientResume: return "ClientResume"
+    case PacketServerRegister: return "ServerRegister"
+    case PacketServerStats: return "ServerStats"
+    case PacketServerDeregister: return "ServerDeregister"
+    case PacketServerLifecycle: return "ServerLifecycle"
+    case PacketServerPlayerSession: return "ServerPlayerSession"
     default:
         assert.Never("packet unknown", "type", t)
     }
     return ""
 }
 
+// TypeName is TypeToString for types that came off of the wire and may not be
+// one we know about
+func TypeName(t PacketType) string {
+    if t >= packetTypeCount {
+        return fmt.Sprintf("Unknown(%d)", t)
+    }
+    return TypeToString(t)
+}
+
 func CreateTypeAndEncodingByte(t PacketType, enc Encoding) byte {
     return uint8(enc << 6) | uint8(t)
 }
 
+func IsSupportedVersion(version uint8) bool {
+    return version >= VERSION && version <= MAX_VERSION
+}
+
+func HeaderSize(version uint8) int {
+    assert.Assert(IsSupportedVersion(version), "unsupported packet version", "version", version)
+    if version == VERSION_2 {
+        return HEADER_SIZE_V2
+    }
+    return HEADER_SIZE
+}
+
+func maxPayloadSize(version uint8) int {
+    if version == VERSION_2 {
+        return PACKET_V2_PAYLOAD_SIZE
+    }
+    return PACKET_PAYLOAD_SIZE - 1
+}
+
 func PacketFromParts(t PacketType, enc Encoding, data []byte) Packet {
-    assert.Assert(len(data) < PACKET_PAYLOAD_SIZE, "packet size is too large", "MAX", PACKET_MAX_SIZE - 1, "received", len(data))
-    assert.Assert(t < MAX_TYPE_SIZE, "max type size exceeded", "MAX", MAX_TYPE_SIZE - 1, "received", t)
+    return PacketFromVersionedParts(VERSION, t, enc, data)
+}
 
-    buf := append([]byte{
-        VERSION,
-        CreateTypeAndEncodingByte(t, enc),
-        0,
-        0,
-    }, data...)
+func PacketFromVersionedParts(version uint8, t PacketType, enc Encoding, data []byte) Packet {
+    assert.Assert(IsSupportedVersion(version), "unsupported packet version", "version", version)
+    assert.Assert(len(data) <= maxPayloadSize(version), "packet size is too large", "MAX", maxPayloadSize(version), "received", len(data))
+    assert.Assert(t < MAX_TYPE_SIZE, "max type size exceeded", "MAX", MAX_TYPE_SIZE - 1, "received", t)
 
-    binary.BigEndian.PutUint16(buf[HEADER_LENGTH_OFFSET:], uint16(len(data)))
+    headerSize := HeaderSize(version)
+    buf := make([]byte, headerSize, headerSize + len(data))
+    buf[0] = version
+    buf[TYPE_ENC_INDEX] = CreateTypeAndEncodingByte(t, enc)
+    putPacketLength(buf, len(data))
+    buf = append(buf, data...)
 
     return Packet{
         data: buf,
@@ -101,48 +165,129 @@ func PacketFromParts(t PacketType, enc Encoding, data []byte) Packet {
 }
 
 func CreateMessage(msg string) Packet {
-    return PacketFromParts(PacketMessage, EncodingString, []byte(msg))
+    return MustEncode(PacketMessage, msg)
 }
 
 func CreateErrorPacket(err error) Packet {
-    return PacketFromParts(PacketError, EncodingString, []byte(err.Error()))
+    return MustEncode(PacketError, err.Error())
 }
 
 func CreateServerAuthResponse(accepted bool, id string) Packet {
-    var b uint8 = 1
-    if !accepted {
-        b = 0
-    }
-
-    data := []byte{ b }
-    data = append(data, []byte(id)...)
+    return MustEncode(PacketServerAuthResponse, ServerAuthResponse{
+        Accepted: accepted,
+        GameId: id,
+    })
+}
 
-    return PacketFromParts(PacketServerAuthResponse, EncodingBytes, data)
+// CreateSessionAuthResponse accepts the client and hands it the token it can
+// use to resume the session if its connection drops
+func CreateSessionAuthResponse(id string, session [SESSION_TOKEN_SIZE]byte) Packet {
+    return MustEncode(PacketServerAuthResponse, ServerAuthResponse{
+        Accepted: true,
+        GameId: id,
+        Session: session,
+    })
 }
 
 func CreateCloseConnection() Packet {
-    // i think i have a 0 packet size assert...
-    // lets find out
-    return PacketFromParts(PacketCloseConnection, EncodingBytes, []byte{})
+    return MustEncode(PacketCloseConnection, CloseConnection{})
+}
+
+func CreateCloseConnectionWithReason(reason string) Packet {
+    return MustEncode(PacketCloseConnection, CloseConnection{Reason: reason})
+}
+
+func CreatePing(seq uint32, sent time.Time) Packet {
+    return MustEncode(PacketPing, Heartbeat{
+        Seq: seq,
+        SentMS: sent.UnixMilli(),
+    })
+}
+
+// CreatePong echos the decoded ping back in the version it was received in,
+// decoding is up to the caller as a ping that fails to decode is bad input
+func CreatePong(ping Heartbeat, version uint8) Packet {
+    pong := MustEncode(PacketPong, ping)
+    return pong.WithVersion(version)
 }
 
 func CreateClientAuth(id []byte) Packet {
-    assert.Assert(len(id) == 16, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
-    return PacketFromParts(PacketClientAuth, EncodingBytes, id)
+    assert.Assert(len(id) == CLIENT_ID_SIZE, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
+    return MustEncode(PacketClientAuth, ClientAuth{Id: [CLIENT_ID_SIZE]byte(id)})
 }
 
-func getPacketLength(data []byte) uint16 {
-    return binary.BigEndian.Uint16(data[HEADER_LENGTH_OFFSET:])
+// CreateMatchClientAuth asks to be placed on a server of gameType in region,
+// either can be empty to accept any
+func CreateMatchClientAuth(id []byte, gameType string, region string) Packet {
+    assert.Assert(len(id) == CLIENT_ID_SIZE, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
+    return MustEncode(PacketClientAuth, ClientAuth{
+        Id: [CLIENT_ID_SIZE]byte(id),
+        GameType: gameType,
+        Region: region,
+    })
+}
+
+// CreatePartyClientAuth is CreateMatchClientAuth for a party of size clients
+// that all share the same party code
+func CreatePartyClientAuth(id []byte, gameType string, region string, party string, size int) Packet {
+    assert.Assert(len(id) == CLIENT_ID_SIZE, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
+    return MustEncode(PacketClientAuth, ClientAuth{
+        Id: [CLIENT_ID_SIZE]byte(id),
+        GameType: gameType,
+        Region: region,
+        Party: party,
+        PartySize: size,
+    })
+}
+
+// CreateLobbyClientAuth asks for a private game server, the join code for it
+// comes back in the ServerAuthResponse
+func CreateLobbyClientAuth(id []byte, gameType string, region string) Packet {
+    assert.Assert(len(id) == CLIENT_ID_SIZE, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
+    return MustEncode(PacketClientAuth, ClientAuth{
+        Id: [CLIENT_ID_SIZE]byte(id),
+        GameType: gameType,
+        Region: region,
+        Lobby: LobbyCreate,
+    })
+}
+
+func CreateJoinLobbyClientAuth(id []byte, code string) Packet {
+    assert.Assert(len(id) == CLIENT_ID_SIZE, "cannot create a auth packet that isn't 16 bytes", "len", len(id))
+    return MustEncode(PacketClientAuth, ClientAuth{
+        Id: [CLIENT_ID_SIZE]byte(id),
+        Lobby: LobbyJoin,
+        LobbyCode: code,
+    })
+}
+
+func CreateClientResume(session [SESSION_TOKEN_SIZE]byte) Packet {
+    return MustEncode(PacketClientResume, ClientResume{Token: session})
+}
+
+func getPacketLength(data []byte) int {
+    if data[0] == VERSION_2 {
+        return int(binary.BigEndian.Uint32(data[HEADER_LENGTH_OFFSET:]))
+    }
+    return int(binary.BigEndian.Uint16(data[HEADER_LENGTH_OFFSET:]))
+}
+
+func putPacketLength(data []byte, length int) {
+    if data[0] == VERSION_2 {
+        binary.BigEndian.PutUint32(data[HEADER_LENGTH_OFFSET:], uint32(length))
+        return
+    }
+    binary.BigEndian.PutUint16(data[HEADER_LENGTH_OFFSET:], uint16(length))
 }
 
 func PacketFromBytes(data []byte) Packet {
-    assert.Assert(data[0] == VERSION, "version mismatch: this should be handled by the framer before packet is created", "VERSION", VERSION, "provided", data[0])
+    assert.Assert(IsSupportedVersion(data[0]), "version mismatch: this should be handled by the framer before packet is created", "MAX_VERSION", MAX_VERSION, "provided", data[0])
 
-    dataLen := len(data) - HEADER_SIZE
+    dataLen := len(data) - HeaderSize(data[0])
     assert.Assert(dataLen >= 0, "packets must contain some sort of data")
 
     encodedLen := getPacketLength(data)
-    assert.Assert(dataLen == int(encodedLen), "the data buffer provided has a length mismatch", "expected length", dataLen, "encoded length", encodedLen)
+    assert.Assert(dataLen == encodedLen, "the data buffer provided has a length mismatch", "expected length", dataLen, "encoded length", encodedLen)
 
     return Packet{
         data: data,
@@ -173,12 +318,32 @@ func (p *Packet) Into(writer io.Writer) (int, error) {
     return writer.Write(p.data[:p.len])
 }
 
-func (p *Packet) Len() uint16 {
-    return binary.BigEndian.Uint16(p.data[2:])
+// Size is the full size of the packet on the wire, header included
+func (p *Packet) Size() int {
+    return p.len
+}
+
+func (p *Packet) Len() int {
+    return getPacketLength(p.data)
+}
+
+func (p *Packet) Version() uint8 {
+    return p.data[0]
 }
 
 func (p *Packet) Data() []byte {
-    return p.data[HEADER_SIZE:p.len]
+    return p.data[HeaderSize(p.Version()):p.len]
+}
+
+// WithVersion re-encodes the packet with the header of the provided version.
+// This is how a peer gets answered in the same version it spoke to us with.
+// Payloads with a VersionedCodec have to go through EncodeWithVersion instead
+func (p *Packet) WithVersion(version uint8) Packet {
+    if p.Version() == version {
+        return *p
+    }
+    assert.Assert(!isVersioned(p.Type()), "versioned payloads must be encoded with EncodeWithVersion", "type", p.Type())
+    return PacketFromVersionedParts(version, p.Type(), p.Encoding(), p.Data())
 }
 
 // shit
@@ -239,27 +404,35 @@ func (p *PacketFramer) Push(data []byte) error {
 }
 
 func (p *PacketFramer) pull() (*Packet, error) {
-    if p.idx < HEADER_SIZE {
+    if p.idx == 0 {
         return nil, nil
     }
 
-    if p.buf[0] != VERSION {
+    version := p.buf[0]
+    if !IsSupportedVersion(version) {
         return nil, errors.Join(
             PacketVersionMismatch,
-            fmt.Errorf("received version: %d", p.buf[0]))
+            fmt.Errorf("received version: %d", version))
+    }
+
+    headerSize := HeaderSize(version)
+    if p.idx < headerSize {
+        return nil, nil
     }
 
     packetLen := getPacketLength(p.buf)
-    fullLen := packetLen + HEADER_SIZE
-    if packetLen == PACKET_PAYLOAD_SIZE {
+    fullLen := packetLen + headerSize
+    if version == VERSION && packetLen == PACKET_PAYLOAD_SIZE {
         return nil, PacketMaxSizeExceeded
+    } else if version == VERSION_2 && packetLen > PACKET_V2_PAYLOAD_SIZE {
+        return nil, PacketV2MaxSizeExceeded
     }
 
-    if fullLen <= uint16(p.idx) {
+    if fullLen <= p.idx {
         out := make([]byte, fullLen, fullLen)
         copy(out, p.buf[:fullLen])
         copy(p.buf, p.buf[fullLen:])
-        p.idx = p.idx - int(fullLen)
+        p.idx = p.idx - fullLen
 
         pkt := PacketFromBytes(out)
         return &pkt, nil
@@ -276,19 +449,31 @@ func FrameWithReader(framer *PacketFramer, reader io.Reader) error {
             return err
         }
 
-        framer.Push(data[:n])
+        if err := framer.Push(data[:n]); err != nil {
+            return err
+        }
     }
 }
 
 func IsCloseConnection(p *Packet) bool {
     return p.Type() == PacketCloseConnection
 }
+func IsQueueStatus(p *Packet) bool {
+    return p.Type() == PacketQueueStatus
+}
+func IsPing(p *Packet) bool {
+    return p.Type() == PacketPing
+}
+func IsClientResume(p *Packet) bool {
+    return p.Type() == PacketClientResume
+}
 func IsServerAuth(p *Packet) bool {
     return p.Type() == PacketServerAuthResponse
 }
 
-// ok here is the other verson of the same thing
 func ServerAuthGameId(p *Packet) string {
     assert.Assert(p.Type() == PacketServerAuthResponse, "cannot cast the packet into a server auth packet", "packet", p.String())
-    return string(p.data[HEADER_SIZE + 1:])
+    rsp, err := Decode[ServerAuthResponse](p)
+    assert.NoError(err, "unable to decode server auth response", "packet", p.String())
+    return rsp.GameId
 }
@@ -137,3 +137,75 @@ func TestPacketFromParts(t *testing.T) {
     require.Equal(t, pkt[1], packet.CreateTypeAndEncodingByte(packet.PacketClientAuth, packet.EncodingBytes))
     require.Equal(t, bLen, uint16(16))
 }
+
+func TestPacketV2LargePayload(t *testing.T) {
+    payload := bytes.Repeat([]byte{0x42}, 8 * 1024)
+    p := packet.PacketFromVersionedParts(packet.VERSION_2, packet.PacketGameSettings, packet.EncodingBytes, payload)
+
+    data := make([]byte, 0, 100)
+    buf := bytes.NewBuffer(data)
+    _, err := p.Into(buf)
+    require.NoError(t, err, "unable to write into buffer")
+
+    raw := buf.Bytes()
+    require.Equal(t, raw[0], packet.VERSION_2)
+    require.Equal(t, binary.BigEndian.Uint32(raw[2:]), uint32(len(payload)))
+
+    framer := packet.NewPacketFramer()
+    go func() {
+        err := packet.FrameWithReader(&framer, buf)
+        if !errors.Is(err, io.EOF) {
+            require.NoError(t, err)
+        }
+    }()
+
+    pkt := <-framer.C
+    require.Equal(t, packet.VERSION_2, pkt.Version())
+    require.Equal(t, packet.PacketGameSettings, pkt.Type())
+    require.Equal(t, len(payload), pkt.Len())
+    require.Equal(t, payload, pkt.Data())
+}
+
+func TestPacketFramerMixedVersions(t *testing.T) {
+    v1 := packet.CreateMessage("hello v1")
+    v2 := packet.CreateMessage("hello v2")
+    v2 = v2.WithVersion(packet.VERSION_2)
+
+    data := make([]byte, 0, 100)
+    buf := bytes.NewBuffer(data)
+    _, err := v1.Into(buf)
+    require.NoError(t, err, "unable to write into buffer")
+    _, err = v2.Into(buf)
+    require.NoError(t, err, "unable to write into buffer")
+
+    framer := packet.NewPacketFramer()
+    require.NoError(t, framer.Push(buf.Bytes()))
+
+    pkt := <-framer.C
+    require.Equal(t, packet.VERSION, pkt.Version())
+    require.Equal(t, []byte("hello v1"), pkt.Data())
+
+    pkt = <-framer.C
+    require.Equal(t, packet.VERSION_2, pkt.Version())
+    require.Equal(t, []byte("hello v2"), pkt.Data())
+
+    back := pkt.WithVersion(packet.VERSION)
+    require.Equal(t, v1.Data(), []byte("hello v1"))
+    require.Equal(t, []byte("hello v2"), back.Data())
+    require.Equal(t, packet.VERSION, back.Version())
+}
+
+func TestPacketFramerUnknownVersion(t *testing.T) {
+    framer := packet.NewPacketFramer()
+    err := framer.Push([]byte{packet.MAX_VERSION + 1, 0, 0, 0})
+    require.ErrorIs(t, err, packet.PacketVersionMismatch)
+}
+
+func TestPacketFramerV2MaxSize(t *testing.T) {
+    header := []byte{packet.VERSION_2, 0, 0, 0, 0, 0}
+    binary.BigEndian.PutUint32(header[2:], packet.PACKET_V2_PAYLOAD_SIZE + 1)
+
+    framer := packet.NewPacketFramer()
+    err := framer.Push(header)
+    require.ErrorIs(t, err, packet.PacketV2MaxSizeExceeded)
+}
@@ -0,0 +1,305 @@
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const CLIENT_ID_SIZE = 16
+const MAX_LABEL_SIZE = 255
+
+type LobbyAction uint8
+
+const (
+    LobbyNone LobbyAction = iota
+    // start a private game server and get a join code for it
+    LobbyCreate
+    // join the private game server of the lobby code
+    LobbyJoin
+)
+
+func (l *LobbyAction) UnmarshalJSON(data []byte) error {
+    var action uint8
+    if err := json.Unmarshal(data, &action); err != nil {
+        return err
+    }
+    if LobbyAction(action) > LobbyJoin {
+        return fmt.Errorf("client auth has an unknown lobby action %d", action)
+    }
+    *l = LobbyAction(action)
+    return nil
+}
+
+// ClientAuth is the client id optionally followed by what the client wants
+// to be matched into.  A bare id is matched into anything on its own.
+// Clients that send the same party code are placed on the same game server.
+// v1 packets carry the layout below, VERSION_2 packets carry it as JSON
+//
+// | id (16) | game type length (1) | game type | region length (1) | region | party size (1) | party length (1) | party code | lobby action (1) | lobby code |
+type ClientAuth struct {
+    Id [CLIENT_ID_SIZE]byte `json:"id"`
+    GameType string `json:"gameType,omitempty"`
+    Region string `json:"region,omitempty"`
+
+    // empty when the client is not in a party
+    Party string `json:"party,omitempty"`
+    PartySize int `json:"partySize,omitempty"`
+
+    Lobby LobbyAction `json:"lobby,omitempty"`
+    // only used when joining a lobby
+    LobbyCode string `json:"lobbyCode,omitempty"`
+}
+
+func (c ClientAuth) IsParty() bool {
+    return c.Party != ""
+}
+
+func appendLabel(data []byte, name string, label string) ([]byte, error) {
+    if len(label) > MAX_LABEL_SIZE {
+        return nil, fmt.Errorf("client auth %s cannot exceed %d bytes, received %d", name, MAX_LABEL_SIZE, len(label))
+    }
+    data = append(data, uint8(len(label)))
+    return append(data, []byte(label)...), nil
+}
+
+func readLabel(data []byte, name string) (string, []byte, error) {
+    if len(data) == 0 {
+        return "", nil, fmt.Errorf("client auth is missing the %s", name)
+    }
+
+    size := int(data[0])
+    data = data[1:]
+    if len(data) < size {
+        return "", nil, fmt.Errorf("client auth %s expects %d bytes, received %d", name, size, len(data))
+    }
+    return string(data[:size]), data[size:], nil
+}
+
+func (c ClientAuth) MarshalBinary() ([]byte, error) {
+    if c.GameType == "" && c.Region == "" && !c.IsParty() && c.Lobby == LobbyNone {
+        return c.Id[:], nil
+    }
+
+    if c.PartySize < 0 || c.PartySize > MAX_LABEL_SIZE {
+        return nil, fmt.Errorf("client auth party size must be between 0 and %d, received %d", MAX_LABEL_SIZE, c.PartySize)
+    }
+
+    data := make([]byte, 0, CLIENT_ID_SIZE + 5 + len(c.GameType) + len(c.Region) + len(c.Party) + len(c.LobbyCode))
+    data = append(data, c.Id[:]...)
+
+    data, err := appendLabel(data, "game type", c.GameType)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err = appendLabel(data, "region", c.Region)
+    if err != nil {
+        return nil, err
+    }
+
+    data = append(data, uint8(c.PartySize))
+    data, err = appendLabel(data, "party code", c.Party)
+    if err != nil {
+        return nil, err
+    }
+
+    data = append(data, uint8(c.Lobby))
+    return append(data, []byte(c.LobbyCode)...), nil
+}
+
+func (c *ClientAuth) UnmarshalBinary(data []byte) error {
+    if len(data) < CLIENT_ID_SIZE {
+        return fmt.Errorf("client auth expects at least %d bytes, received %d", CLIENT_ID_SIZE, len(data))
+    }
+    copy(c.Id[:], data)
+    data = data[CLIENT_ID_SIZE:]
+
+    c.GameType = ""
+    c.Region = ""
+    c.Party = ""
+    c.PartySize = 0
+    c.Lobby = LobbyNone
+    c.LobbyCode = ""
+    if len(data) == 0 {
+        return nil
+    }
+
+    var err error
+    c.GameType, data, err = readLabel(data, "game type")
+    if err != nil {
+        return err
+    }
+
+    c.Region, data, err = readLabel(data, "region")
+    if err != nil {
+        return err
+    }
+
+    if len(data) == 0 {
+        return fmt.Errorf("client auth is missing the party size")
+    }
+
+    c.PartySize = int(data[0])
+    c.Party, data, err = readLabel(data[1:], "party code")
+    if err != nil {
+        return err
+    }
+
+    if len(data) == 0 {
+        return fmt.Errorf("client auth is missing the lobby action")
+    }
+
+    c.Lobby = LobbyAction(data[0])
+    if c.Lobby > LobbyJoin {
+        return fmt.Errorf("client auth has an unknown lobby action %d", c.Lobby)
+    }
+    c.LobbyCode = string(data[1:])
+    return nil
+}
+
+const SESSION_TOKEN_SIZE = 16
+
+const (
+    authFlagAccepted uint8 = 1 << iota
+    authFlagSession
+    authFlagLobby
+)
+
+// ServerAuthResponse is laid out as a flags byte, the session token when the
+// session flag is set, the lobby code when the lobby flag is set, and then
+// the id of the game server the client was placed on.  VERSION_2 packets
+// carry it as JSON instead
+//
+// | flags (1) | session token (16, optional) | lobby length (1, optional) | lobby code | game id |
+type ServerAuthResponse struct {
+    Accepted bool `json:"accepted"`
+    GameId string `json:"gameId"`
+
+    // zero when the proxy does not support resuming the session
+    Session [SESSION_TOKEN_SIZE]byte `json:"session"`
+
+    // the join code of the private lobby the client is in
+    Lobby string `json:"lobby,omitempty"`
+}
+
+func (s ServerAuthResponse) HasSession() bool {
+    return s.Session != [SESSION_TOKEN_SIZE]byte{}
+}
+
+func (s ServerAuthResponse) MarshalBinary() ([]byte, error) {
+    var flags uint8 = 0
+    if s.Accepted {
+        flags |= authFlagAccepted
+    }
+
+    data := []byte{ flags }
+    if s.HasSession() {
+        data[0] |= authFlagSession
+        data = append(data, s.Session[:]...)
+    }
+    if s.Lobby != "" {
+        if len(s.Lobby) > MAX_LABEL_SIZE {
+            return nil, fmt.Errorf("server auth response lobby cannot exceed %d bytes, received %d", MAX_LABEL_SIZE, len(s.Lobby))
+        }
+        data[0] |= authFlagLobby
+        data = append(data, uint8(len(s.Lobby)))
+        data = append(data, []byte(s.Lobby)...)
+    }
+    return append(data, []byte(s.GameId)...), nil
+}
+
+func (s *ServerAuthResponse) UnmarshalBinary(data []byte) error {
+    if len(data) == 0 {
+        return fmt.Errorf("server auth response requires at least 1 byte")
+    }
+
+    flags := data[0]
+    data = data[1:]
+    s.Accepted = flags & authFlagAccepted != 0
+
+    if flags & authFlagSession != 0 {
+        if len(data) < SESSION_TOKEN_SIZE {
+            return fmt.Errorf("server auth response session expects %d bytes, received %d", SESSION_TOKEN_SIZE, len(data))
+        }
+        copy(s.Session[:], data)
+        data = data[SESSION_TOKEN_SIZE:]
+    }
+
+    s.Lobby = ""
+    if flags & authFlagLobby != 0 {
+        if len(data) == 0 || len(data) - 1 < int(data[0]) {
+            return fmt.Errorf("server auth response lobby code is truncated")
+        }
+        s.Lobby = string(data[1:1 + data[0]])
+        data = data[1 + data[0]:]
+    }
+
+    s.GameId = string(data)
+    return nil
+}
+
+// ClientResume is sent instead of ClientAuth by a client whose connection
+// dropped, the token is the session from its ServerAuthResponse
+type ClientResume struct {
+    Token [SESSION_TOKEN_SIZE]byte
+}
+
+func (c ClientResume) MarshalBinary() ([]byte, error) {
+    return c.Token[:], nil
+}
+
+func (c *ClientResume) UnmarshalBinary(data []byte) error {
+    if len(data) != SESSION_TOKEN_SIZE {
+        return fmt.Errorf("client resume expects %d bytes, received %d", SESSION_TOKEN_SIZE, len(data))
+    }
+    copy(c.Token[:], data)
+    return nil
+}
+
+// CloseConnection optionally carries why the connection is being closed
+type CloseConnection struct {
+    Reason string
+}
+
+func (c CloseConnection) MarshalBinary() ([]byte, error) {
+    return []byte(c.Reason), nil
+}
+
+func (c *CloseConnection) UnmarshalBinary(data []byte) error {
+    c.Reason = string(data)
+    return nil
+}
+
+// Heartbeat is the payload of both ping and pong, a pong carries the ping it
+// is answering so the sender can measure the round trip
+type Heartbeat struct {
+    Seq uint32 `json:"seq"`
+    SentMS int64 `json:"sentMS"`
+}
+
+func (h *Heartbeat) RTT(now time.Time) time.Duration {
+    return now.Sub(time.UnixMilli(h.SentMS))
+}
+
+// QueueStatus is sent to clients that are waiting for a game server to free
+// up.  ETAMS is 0 when there isn't enough history to make a guess
+type QueueStatus struct {
+    Position int `json:"position"`
+    ETAMS int64 `json:"etaMS"`
+}
+
+// the auth payloads keep the binary layout old clients speak in v1
+var authCodec = VersionedCodec{V1: BytesCodec{}, V2: JSONCodec{}}
+
+func init() {
+    Register[string](PacketError, StringCodec{})
+    Register[string](PacketMessage, StringCodec{})
+    Register[ClientAuth](PacketClientAuth, authCodec)
+    Register[ServerAuthResponse](PacketServerAuthResponse, authCodec)
+    Register[CloseConnection](PacketCloseConnection, BytesCodec{})
+    Register[Heartbeat](PacketPing, JSONCodec{})
+    Register[Heartbeat](PacketPong, JSONCodec{})
+    Register[QueueStatus](PacketQueueStatus, JSONCodec{})
+    Register[ClientResume](PacketClientResume, BytesCodec{})
+}
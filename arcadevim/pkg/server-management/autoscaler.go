@@ -0,0 +1,379 @@
+package servermanagement
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
+
+// Fleet is what the autoscaler grows and shrinks
+type Fleet interface {
+	CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error)
+	Destroy(ctx context.Context, id string) error
+}
+
+// the zero value never scales anything
+type AutoscalerParams struct {
+	// how often the fleet is looked at, defaults to 30 seconds
+	IntervalMS int64
+
+	// ready servers without connections kept around so clients never wait on
+	// a server to start
+	WarmServers int
+
+	// one more server is created when the average load of the fleet is at or
+	// above ScaleUpLoad.  0 disables scaling on load
+	ScaleUpLoad float64
+
+	// idle servers past the warm pool are destroyed once they have been idle
+	// for IdleCooldownMS.  0 never scales down
+	IdleCooldownMS int64
+
+	// MaxServers 0 has no limit
+	MinServers int
+	MaxServers int
+
+	// a created server that has not shown up in stats by now is forgotten
+	// about, defaults to 60 seconds
+	StartTimeoutMS int64
+
+	// the kind of server that is scaled
+	Request gameserverstats.MatchRequest
+}
+
+func (a AutoscalerParams) withDefaults() AutoscalerParams {
+	if a.IntervalMS == 0 {
+		a.IntervalMS = 30000
+	}
+	if a.StartTimeoutMS == 0 {
+		a.StartTimeoutMS = 60000
+	}
+	return a
+}
+
+const (
+	ScaleUp   = "up"
+	ScaleDown = "down"
+	// a scale up that was not allowed
+	ScaleBlocked = "blocked"
+)
+
+const (
+	ReasonMinServers = "min_servers"
+	ReasonWarmPool   = "warm_pool"
+	ReasonLoad       = "load"
+	ReasonIdle       = "idle"
+	ReasonMaxServers = "max_servers"
+)
+
+type ScaleDecision struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+type AutoscalerStats struct {
+	// registered servers that are not closed
+	Servers int `json:"servers"`
+	// created but not registered yet
+	Starting int `json:"starting"`
+	// servers without connections, starting ones included
+	Idle int     `json:"idle"`
+	Load float64 `json:"load"`
+
+	Decisions map[ScaleDecision]int `json:"-"`
+	Errors    int                   `json:"errors"`
+}
+
+// Autoscaler keeps a warm pool of servers around, adds servers as the fleet
+// fills up and removes the ones nobody has used in a while.  Servers that are
+// still starting count as idle so a slow start is not scaled up twice
+type Autoscaler struct {
+	logger *slog.Logger
+	stats  gameserverstats.GSSRetriever
+	params AutoscalerParams
+
+	// only touched by the reconcile loop
+	starting  map[string]time.Time
+	idleSince map[string]time.Time
+
+	mutex      sync.Mutex
+	lastStats  AutoscalerStats
+	decisions  map[ScaleDecision]int
+	errorCount int
+}
+
+func NewAutoscaler(stats gameserverstats.GSSRetriever, params AutoscalerParams) *Autoscaler {
+	return &Autoscaler{
+		logger:    slog.Default().With("area", "Autoscaler"),
+		stats:     stats,
+		params:    params.withDefaults(),
+		starting:  map[string]time.Time{},
+		idleSince: map[string]time.Time{},
+		mutex:     sync.Mutex{},
+		decisions: map[ScaleDecision]int{},
+	}
+}
+
+func (a *Autoscaler) Run(ctx context.Context, fleet Fleet) {
+	timer := time.NewTicker(time.Millisecond * time.Duration(a.params.IntervalMS))
+	defer timer.Stop()
+
+	a.Reconcile(ctx, fleet)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			a.Reconcile(ctx, fleet)
+		}
+	}
+}
+
+func (a *Autoscaler) decide(action string, reason string, count int, attrs ...any) {
+	a.mutex.Lock()
+	a.decisions[ScaleDecision{Action: action, Reason: reason}] += count
+	a.mutex.Unlock()
+
+	a.logger.Info("autoscale decision", append([]any{"action", action, "reason", reason, "count", count}, attrs...)...)
+}
+
+func (a *Autoscaler) failed(msg string, err error, attrs ...any) {
+	a.mutex.Lock()
+	a.errorCount++
+	a.mutex.Unlock()
+
+	a.logger.Error(msg, append([]any{"error", err}, attrs...)...)
+}
+
+func (a *Autoscaler) fleet() ([]gameserverstats.GameServerConfig, error) {
+	servers, err := a.stats.GetAllGameServerConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(servers, func(gs gameserverstats.GameServerConfig) bool {
+		return gs.State == gameserverstats.GSStateClosed || !a.params.Request.Matches(&gs)
+	}), nil
+}
+
+// Reconcile looks at the fleet once and scales it if needed
+func (a *Autoscaler) Reconcile(ctx context.Context, fleet Fleet) {
+	servers, err := a.fleet()
+	if err != nil {
+		a.failed("unable to read the fleet", err)
+		return
+	}
+
+	now := time.Now()
+	startTimeout := time.Millisecond * time.Duration(a.params.StartTimeoutMS)
+
+	registered := map[string]bool{}
+	for _, gs := range servers {
+		registered[gs.Id] = true
+	}
+	for id, created := range a.starting {
+		if registered[id] {
+			delete(a.starting, id)
+		} else if now.Sub(created) > startTimeout {
+			a.failed("server never registered", fmt.Errorf("timed out after %s", startTimeout), "id", id)
+			delete(a.starting, id)
+		}
+	}
+
+	load := 0.0
+	idle := []gameserverstats.GameServerConfig{}
+	for _, gs := range servers {
+		load += float64(gs.Load)
+		if gs.Connections > 0 {
+			delete(a.idleSince, gs.Id)
+			continue
+		}
+
+		if _, ok := a.idleSince[gs.Id]; !ok {
+			a.idleSince[gs.Id] = now
+		}
+		idle = append(idle, gs)
+	}
+	for id := range a.idleSince {
+		if !registered[id] {
+			delete(a.idleSince, id)
+		}
+	}
+	if len(servers) > 0 {
+		load /= float64(len(servers))
+	}
+
+	total := len(servers) + len(a.starting)
+	idleCount := len(idle) + len(a.starting)
+
+	a.mutex.Lock()
+	a.lastStats = AutoscalerStats{
+		Servers:  len(servers),
+		Starting: len(a.starting),
+		Idle:     idleCount,
+		Load:     load,
+	}
+	a.mutex.Unlock()
+
+	up, reason := 0, ""
+	if total < a.params.MinServers {
+		up, reason = a.params.MinServers-total, ReasonMinServers
+	} else if idleCount < a.params.WarmServers {
+		up, reason = a.params.WarmServers-idleCount, ReasonWarmPool
+	} else if a.params.ScaleUpLoad > 0 && len(servers) > 0 && len(a.starting) == 0 && load >= a.params.ScaleUpLoad {
+		up, reason = 1, ReasonLoad
+	}
+
+	if up > 0 {
+		if a.params.MaxServers > 0 && total+up > a.params.MaxServers {
+			blocked := total + up - a.params.MaxServers
+			a.decide(ScaleBlocked, ReasonMaxServers, blocked, "wanted", reason, "servers", total)
+			up -= blocked
+		}
+		if up > 0 {
+			a.decide(ScaleUp, reason, up, "servers", total, "idle", idleCount, "load", load)
+			a.scaleUp(ctx, fleet, up)
+		}
+		return
+	}
+
+	a.scaleDown(ctx, fleet, idle, total, idleCount, now)
+}
+
+func (a *Autoscaler) scaleUp(ctx context.Context, fleet Fleet, count int) {
+	for range count {
+		id, err := fleet.CreateNewServer(ctx, a.params.Request)
+		if err != nil {
+			a.failed("unable to create server", err)
+			return
+		}
+		a.starting[id] = time.Now()
+	}
+}
+
+// scaleDown destroys the servers that have been idle the longest, the warm
+// pool and min servers are always left standing
+func (a *Autoscaler) scaleDown(ctx context.Context, fleet Fleet, idle []gameserverstats.GameServerConfig, total int, idleCount int, now time.Time) {
+	if a.params.IdleCooldownMS == 0 {
+		return
+	}
+
+	cooldown := time.Millisecond * time.Duration(a.params.IdleCooldownMS)
+	excess := min(idleCount-a.params.WarmServers, total-a.params.MinServers)
+	if excess <= 0 {
+		return
+	}
+
+	slices.SortFunc(idle, func(x, y gameserverstats.GameServerConfig) int {
+		return a.idleSince[x.Id].Compare(a.idleSince[y.Id])
+	})
+
+	for _, gs := range idle {
+		if excess == 0 || now.Sub(a.idleSince[gs.Id]) < cooldown {
+			return
+		}
+
+		empty, err := a.close(gs.Id)
+		if err != nil {
+			a.failed("unable to close server", err, "id", gs.Id)
+			continue
+		}
+		if !empty {
+			a.logger.Info("idle server got a connection while closing, keeping it", "id", gs.Id)
+			delete(a.idleSince, gs.Id)
+			continue
+		}
+
+		a.decide(ScaleDown, ReasonIdle, 1, "id", gs.Id, "idle", now.Sub(a.idleSince[gs.Id]))
+		if err := fleet.Destroy(ctx, gs.Id); err != nil {
+			a.failed("unable to destroy server", err, "id", gs.Id)
+			continue
+		}
+
+		delete(a.idleSince, gs.Id)
+		excess--
+	}
+}
+
+// close marks the server closed so the matchmaker stops handing it out and
+// then checks nobody was placed on it in the meantime.  A server that got a
+// connection is put back the way it was and false is returned
+func (a *Autoscaler) close(id string) (bool, error) {
+	config := a.stats.GetById(id)
+	if config == nil {
+		return true, nil
+	}
+	if config.Connections > 0 {
+		return false, nil
+	}
+
+	state := config.State
+	config.State = gameserverstats.GSStateClosed
+	if err := a.stats.Update(*config); err != nil {
+		return false, err
+	}
+
+	config = a.stats.GetById(id)
+	if config == nil || config.Connections == 0 {
+		return true, nil
+	}
+
+	if config.State == gameserverstats.GSStateClosed {
+		config.State = state
+		return false, a.stats.Update(*config)
+	}
+	return false, nil
+}
+
+func (a *Autoscaler) Stats() AutoscalerStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	stats := a.lastStats
+	stats.Errors = a.errorCount
+	stats.Decisions = map[ScaleDecision]int{}
+	for k, v := range a.decisions {
+		stats.Decisions[k] = v
+	}
+	return stats
+}
+
+// WriteMetrics writes the autoscaler stats in the prometheus text format
+func (a *Autoscaler) WriteMetrics(w io.Writer) {
+	stats := a.Stats()
+
+	fmt.Fprintf(w, "# HELP autoscaler_servers Game servers in the scaled fleet.\n")
+	fmt.Fprintf(w, "# TYPE autoscaler_servers gauge\n")
+	fmt.Fprintf(w, "autoscaler_servers{state=\"registered\"} %d\n", stats.Servers)
+	fmt.Fprintf(w, "autoscaler_servers{state=\"starting\"} %d\n", stats.Starting)
+	fmt.Fprintf(w, "autoscaler_servers{state=\"idle\"} %d\n", stats.Idle)
+
+	fmt.Fprintf(w, "# HELP autoscaler_load Average load of the scaled fleet.\n")
+	fmt.Fprintf(w, "# TYPE autoscaler_load gauge\n")
+	fmt.Fprintf(w, "autoscaler_load %g\n", stats.Load)
+
+	decisions := make([]ScaleDecision, 0, len(stats.Decisions))
+	for d := range stats.Decisions {
+		decisions = append(decisions, d)
+	}
+	slices.SortFunc(decisions, func(x, y ScaleDecision) int {
+		return cmp.Or(cmp.Compare(x.Action, y.Action), cmp.Compare(x.Reason, y.Reason))
+	})
+
+	fmt.Fprintf(w, "# HELP autoscaler_decisions_total Servers the autoscaler decided to add, remove or was not allowed to add.\n")
+	fmt.Fprintf(w, "# TYPE autoscaler_decisions_total counter\n")
+	for _, d := range decisions {
+		fmt.Fprintf(w, "autoscaler_decisions_total{action=\"%s\",reason=\"%s\"} %d\n", d.Action, d.Reason, stats.Decisions[d])
+	}
+
+	fmt.Fprintf(w, "# HELP autoscaler_errors_total Failed fleet reads, creates and destroys.\n")
+	fmt.Fprintf(w, "# TYPE autoscaler_errors_total counter\n")
+	fmt.Fprintf(w, "autoscaler_errors_total %d\n", stats.Errors)
+}
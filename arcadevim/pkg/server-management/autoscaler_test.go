@@ -0,0 +1,248 @@
+package servermanagement_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+// fakeFleet registers the servers it creates right away unless told not to
+type fakeFleet struct {
+	t     *testing.T
+	stats *gameserverstats.Memory
+
+	created   []string
+	destroyed []string
+	lazy      bool
+}
+
+func (f *fakeFleet) CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error) {
+	id := fmt.Sprintf("%d", len(f.created))
+	f.created = append(f.created, id)
+	if !f.lazy {
+		f.add(id, 0, 0)
+	}
+	return id, nil
+}
+
+func (f *fakeFleet) Destroy(ctx context.Context, id string) error {
+	f.destroyed = append(f.destroyed, id)
+	config := f.stats.GetById(id)
+	config.State = gameserverstats.GSStateClosed
+	return f.stats.Update(*config)
+}
+
+func (f *fakeFleet) add(id string, connections int, load float32) {
+	require.NoError(f.t, f.stats.Update(gameserverstats.GameServerConfig{
+		Id:          id,
+		State:       gameserverstats.GSStateReady,
+		Connections: connections,
+		Load:        load,
+	}))
+}
+
+func newFakeFleet(t *testing.T) *fakeFleet {
+	return &fakeFleet{t: t, stats: testStats(t)}
+}
+
+func decisions(a *servermanagement.Autoscaler, action string, reason string) int {
+	return a.Stats().Decisions[servermanagement.ScaleDecision{Action: action, Reason: reason}]
+}
+
+func TestAutoscalerZeroValue(t *testing.T) {
+	fleet := newFakeFleet(t)
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{})
+
+	scaler.Reconcile(context.Background(), fleet)
+	require.Empty(t, fleet.created)
+	require.Empty(t, scaler.Stats().Decisions)
+}
+
+func TestAutoscalerMinAndWarmPool(t *testing.T) {
+	fleet := newFakeFleet(t)
+	fleet.lazy = true
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		MinServers:  3,
+		WarmServers: 2,
+	})
+
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 3)
+	require.Equal(t, 3, decisions(scaler, servermanagement.ScaleUp, servermanagement.ReasonMinServers))
+
+	// servers that are still starting are not created twice
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 3)
+	require.Equal(t, 3, scaler.Stats().Starting)
+
+	// two of them fill up, the warm pool needs one more
+	fleet.add("0", 5, 0.5)
+	fleet.add("1", 5, 0.5)
+	fleet.add("2", 0, 0)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 4)
+	require.Equal(t, 1, decisions(scaler, servermanagement.ScaleUp, servermanagement.ReasonWarmPool))
+
+	stats := scaler.Stats()
+	require.Equal(t, 3, stats.Servers)
+	require.Equal(t, 0, stats.Starting)
+	require.Equal(t, 1, stats.Idle)
+	require.InDelta(t, 1.0/3.0, stats.Load, 0.001)
+}
+
+func TestAutoscalerLoad(t *testing.T) {
+	fleet := newFakeFleet(t)
+	fleet.lazy = true
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		ScaleUpLoad: 0.8,
+		MaxServers:  3,
+	})
+
+	fleet.add("a", 10, 0.95)
+	fleet.add("b", 10, 0.75)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 1)
+	require.Equal(t, 1, decisions(scaler, servermanagement.ScaleUp, servermanagement.ReasonLoad))
+
+	// one at a time, the new server has to take some of the load first
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 1)
+
+	fleet.add("0", 10, 1)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 1)
+	require.Equal(t, 1, decisions(scaler, servermanagement.ScaleBlocked, servermanagement.ReasonMaxServers))
+}
+
+func TestAutoscalerMaxServers(t *testing.T) {
+	fleet := newFakeFleet(t)
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		WarmServers: 3,
+		MaxServers:  2,
+	})
+
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 2)
+	require.Equal(t, 2, decisions(scaler, servermanagement.ScaleUp, servermanagement.ReasonWarmPool))
+	require.Equal(t, 1, decisions(scaler, servermanagement.ScaleBlocked, servermanagement.ReasonMaxServers))
+}
+
+func TestAutoscalerIdleReaping(t *testing.T) {
+	fleet := newFakeFleet(t)
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		WarmServers:    1,
+		MinServers:     2,
+		IdleCooldownMS: 20,
+	})
+
+	fleet.add("a", 0, 0)
+	fleet.add("b", 0, 0)
+	fleet.add("c", 3, 0.3)
+	fleet.add("d", 0, 0)
+
+	// nobody has been idle long enough yet
+	scaler.Reconcile(context.Background(), fleet)
+	require.Empty(t, fleet.destroyed)
+
+	// a connection resets the cooldown
+	fleet.add("a", 1, 0.1)
+	scaler.Reconcile(context.Background(), fleet)
+	fleet.add("a", 0, 0)
+
+	time.Sleep(30 * time.Millisecond)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Equal(t, []string{"b", "d"}, fleet.destroyed)
+	require.Equal(t, 2, decisions(scaler, servermanagement.ScaleDown, servermanagement.ReasonIdle))
+
+	// "a" is the warm pool and "c" is in use, min servers keeps them both
+	time.Sleep(30 * time.Millisecond)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.destroyed, 2)
+	require.Empty(t, fleet.created)
+}
+
+// racingStats places a client on a server the moment it is closed, like a
+// matchmaker that picked the server right before the autoscaler closed it
+type racingStats struct {
+	*gameserverstats.Memory
+	racer string
+}
+
+func (r *racingStats) Update(config gameserverstats.GameServerConfig) error {
+	if err := r.Memory.Update(config); err != nil {
+		return err
+	}
+	if config.Id != r.racer || config.State != gameserverstats.GSStateClosed {
+		return nil
+	}
+
+	config.Connections = 1
+	return r.Memory.Update(config)
+}
+
+func TestAutoscalerScaleDownRace(t *testing.T) {
+	fleet := newFakeFleet(t)
+	stats := &racingStats{Memory: fleet.stats, racer: "b"}
+	scaler := servermanagement.NewAutoscaler(stats, servermanagement.AutoscalerParams{
+		IdleCooldownMS: 20,
+	})
+
+	fleet.add("a", 0, 0)
+	fleet.add("b", 0, 0)
+
+	scaler.Reconcile(context.Background(), fleet)
+	time.Sleep(30 * time.Millisecond)
+	scaler.Reconcile(context.Background(), fleet)
+
+	// "b" got a client while it was being closed
+	require.Equal(t, []string{"a"}, fleet.destroyed)
+	require.Equal(t, 1, decisions(scaler, servermanagement.ScaleDown, servermanagement.ReasonIdle))
+
+	config := stats.GetById("b")
+	require.Equal(t, gameserverstats.GSStateReady, config.State)
+	require.Equal(t, 1, config.Connections)
+}
+
+func TestAutoscalerStartTimeout(t *testing.T) {
+	fleet := newFakeFleet(t)
+	fleet.lazy = true
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		WarmServers:    1,
+		StartTimeoutMS: 10,
+	})
+
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 1)
+
+	time.Sleep(20 * time.Millisecond)
+	scaler.Reconcile(context.Background(), fleet)
+	require.Len(t, fleet.created, 2)
+	require.Equal(t, 1, scaler.Stats().Errors)
+}
+
+func TestAutoscalerMetrics(t *testing.T) {
+	fleet := newFakeFleet(t)
+	scaler := servermanagement.NewAutoscaler(fleet.stats, servermanagement.AutoscalerParams{
+		WarmServers: 2,
+		MaxServers:  1,
+	})
+	scaler.Reconcile(context.Background(), fleet)
+	scaler.Reconcile(context.Background(), fleet)
+
+	out := bytes.Buffer{}
+	scaler.WriteMetrics(&out)
+	metrics := out.String()
+
+	require.Contains(t, metrics, `autoscaler_servers{state="registered"} 1`+"\n")
+	require.Contains(t, metrics, `autoscaler_servers{state="idle"} 1`+"\n")
+	require.Contains(t, metrics, "autoscaler_load 0\n")
+	require.Contains(t, metrics, `autoscaler_decisions_total{action="up",reason="warm_pool"} 1`+"\n")
+	require.Contains(t, metrics, `autoscaler_decisions_total{action="blocked",reason="max_servers"} 2`+"\n")
+	require.Contains(t, metrics, "autoscaler_errors_total 0\n")
+}
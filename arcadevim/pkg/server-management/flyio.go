@@ -2,203 +2,426 @@ package servermanagement
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 )
 
 var BASE_URL = "https://api.machines.dev"
 
-func machineCreateUrl() string {
-    return fmt.Sprintf("%s/v1/apps/arcadevim/machines", BASE_URL)
+var FlyRequestFailed = errors.New("fly machines request failed")
+
+// the longest the machines api lets a wait request block for
+const flyWaitTimeoutSeconds = 60
+
+type FlyParams struct {
+	// defaults to BASE_URL
+	BaseURL string
+	Token   string
+	App     string
+
+	// the image used when no game type is asked for, Images maps game types
+	// to the image that runs them
+	Image  string
+	Images map[string]string
+
+	// where machines are created when the request has no region
+	Region string
+
+	CPUKind  string
+	CPUs     int
+	MemoryMB int
+
+	// the port the game server listens on inside of the machine
+	InternalPort int
+
+	// passed to every machine on top of the game server env
+	Env map[string]string
 }
 
-func machineStart(machineId string) string {
-    return fmt.Sprintf("%s/start", machine(machineId))
+func FlyParamsFromEnv() FlyParams {
+	cpus, _ := strconv.Atoi(os.Getenv("FLY_CPUS"))
+	memory, _ := strconv.Atoi(os.Getenv("FLY_MEMORY_MB"))
+	port, _ := strconv.Atoi(os.Getenv("FLY_INTERNAL_PORT"))
+
+	return FlyParams{
+		BaseURL:      os.Getenv("FLY_API_URL"),
+		Token:        os.Getenv("FLY_IO_ORG_TOKEN"),
+		App:          os.Getenv("FLY_APP"),
+		Image:        os.Getenv("FLY_IMAGE"),
+		Region:       os.Getenv("FLY_REGION"),
+		CPUKind:      os.Getenv("FLY_CPU_KIND"),
+		CPUs:         cpus,
+		MemoryMB:     memory,
+		InternalPort: port,
+		Env: map[string]string{
+			"SQLITE":              os.Getenv("SQLITE"),
+			"CONTROL_PLANE":       os.Getenv("CONTROL_PLANE"),
+			"CONTROL_PLANE_TOKEN": os.Getenv("CONTROL_PLANE_TOKEN"),
+		},
+	}
 }
 
-func machineStop(machineId string) string {
-    return fmt.Sprintf("%s/stop", machine(machineId))
+func (f FlyParams) withDefaults() FlyParams {
+	if f.BaseURL == "" {
+		f.BaseURL = BASE_URL
+	}
+	if f.App == "" {
+		f.App = "arcadevim"
+	}
+	if f.CPUKind == "" {
+		f.CPUKind = "shared"
+	}
+	if f.CPUs == 0 {
+		f.CPUs = 1
+	}
+	if f.MemoryMB == 0 {
+		f.MemoryMB = 256
+	}
+	if f.InternalPort == 0 {
+		f.InternalPort = 8080
+	}
+	return f
 }
 
-func machineDestroy(machineId string) string {
-    return fmt.Sprintf("%s?force=true", machine(machineId))
+//{"id":"1852414f4125d8","name":"arcadevim","state":"created","region":"den","instance_id":"01J6ZE56EA12S649SSKRK71PF6","private_ip":"fdaa:3:c60a:a7b:5:5607:a0b9:2","config":{"env":{"APP_ENV":"production"},"init":{},"guest":{"cpu_kind":"shared","cpus":1,"memory_mb":256},"services":[{"protocol":"tcp","internal_port":8080,"ports":[{"port":80,"handlers":["http"]}],"force_instance_key":null}],"image":"registry.fly.io/arcadevim:deployment-01J6XBCR5F95VZAH6REWNP2XBC"},"incomplete_config":null,"image_ref":{"registry":"registry.fly.io","repository":"arcadevim","tag":"deployment-01J6XBCR5F95VZAH6REWNP2XBC","digest":"sha256:ac31956327e300c624741d92b6537f766890d239f6ef8e44fc20edd1c672f94f","labels":null},"created_at":"2024-09-04T21:13:27Z","updated_at":"2024-09-04T21:13:27Z","events":[{"id":"01J6ZE56FARDMV304HFVVAT8PK","type":"launch","status":"created","source":"user","timestamp":1725484407274}],"host_status":"ok"}
+type Machine struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Region     string `json:"region"`
+	InstanceID string `json:"instance_id"`
+	PrivateIP  string `json:"private_ip"`
 }
 
-func machine(machineId string) string {
-    return fmt.Sprintf("%s/v1/apps/arcadevim/machines/%s", BASE_URL, machineId)
+func (m *Machine) String() string {
+	return fmt.Sprintf("Id: %s -- Name: %s -- State: %s -- Region: %s -- InstanceID: %s", m.Id, m.Name, m.State, m.Region, m.InstanceID)
 }
 
-//{"id":"1852414f4125d8","name":"arcadevim","state":"created","region":"den","instance_id":"01J6ZE56EA12S649SSKRK71PF6","private_ip":"fdaa:3:c60a:a7b:5:5607:a0b9:2","config":{"env":{"APP_ENV":"production"},"init":{},"guest":{"cpu_kind":"shared","cpus":1,"memory_mb":256},"services":[{"protocol":"tcp","internal_port":8080,"ports":[{"port":80,"handlers":["http"]}],"force_instance_key":null}],"image":"registry.fly.io/arcadevim:deployment-01J6XBCR5F95VZAH6REWNP2XBC"},"incomplete_config":null,"image_ref":{"registry":"registry.fly.io","repository":"arcadevim","tag":"deployment-01J6XBCR5F95VZAH6REWNP2XBC","digest":"sha256:ac31956327e300c624741d92b6537f766890d239f6ef8e44fc20edd1c672f94f","labels":null},"created_at":"2024-09-04T21:13:27Z","updated_at":"2024-09-04T21:13:27Z","events":[{"id":"01J6ZE56FARDMV304HFVVAT8PK","type":"launch","status":"created","source":"user","timestamp":1725484407274}],"host_status":"ok"}
-type MachineCreateResponse struct {
-    Id string `json:"id"`
-    InstanceID string `json:"instance_id"`
-}
-
-func (m *MachineCreateResponse) String() string {
-    return fmt.Sprintf("Id: %s -- InstanceID: %s", m.Id, m.InstanceID)
-}
-
-func createMachine() (*MachineCreateResponse, error) {
-	body := []byte(`{
-      "config": {
-        "image": "registry.fly.io/arcadevim:deployment-01J6XBCR5F95VZAH6REWNP2XBC",
-        "env": {
-          "APP_ENV": "production"
-        },
-        "services": [
-          {
-            "ports": [
-                {
-                "port": 443,
-                "handlers": [
-                  "tls",
-                  "http"
-                ]
-              },
-              {
-                "port": 80,
-                "handlers": [
-                  "http"
-                ]
-              }
-            ],
-            "protocol": "tcp",
-            "internal_port": 8080
-          }
-        ]
-      }
-	}`)
-
-	r, err := http.NewRequest("POST", machineCreateUrl(), bytes.NewBuffer(body))
-	if err != nil {
-        return nil, err
-	}
+type MachineGuest struct {
+	CPUKind  string `json:"cpu_kind"`
+	CPUs     int    `json:"cpus"`
+	MemoryMB int    `json:"memory_mb"`
+}
 
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("FLY_IO_ORG_TOKEN")))
+type MachineRestart struct {
+	Policy string `json:"policy"`
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil {
-        return nil, err
+// MachineConfig has no services on purpose, game servers are only reached by
+// the proxy over the private network
+type MachineConfig struct {
+	Image   string            `json:"image"`
+	Env     map[string]string `json:"env"`
+	Guest   MachineGuest      `json:"guest"`
+	Restart MachineRestart    `json:"restart"`
+
+	// game servers close themselves once they are empty, the machine goes
+	// with them
+	AutoDestroy bool `json:"auto_destroy"`
+}
+
+type MachineCreateRequest struct {
+	Name   string        `json:"name"`
+	Region string        `json:"region,omitempty"`
+	Config MachineConfig `json:"config"`
+}
+
+// FlyServers runs every game server on its own Fly.io machine.  The game
+// servers report into stats the same way local ones do, the machines api is
+// only used to create, wait for and tear down machines
+type FlyServers struct {
+	logger *slog.Logger
+	stats  gameserverstats.GSSRetriever
+	params ServerParams
+	fly    FlyParams
+	client *http.Client
+
+	mutex sync.Mutex
+	// game server id to its machine
+	machines map[string]Machine
+}
+
+func NewFlyServers(stats gameserverstats.GSSRetriever, params ServerParams, fly FlyParams) *FlyServers {
+	return &FlyServers{
+		logger:   slog.Default().With("area", "FlyServers"),
+		stats:    stats,
+		params:   params,
+		fly:      fly.withDefaults(),
+		client:   &http.Client{},
+		mutex:    sync.Mutex{},
+		machines: map[string]Machine{},
 	}
+}
 
-	defer res.Body.Close()
+func (f *FlyServers) machinesUrl() string {
+	return fmt.Sprintf("%s/v1/apps/%s/machines", f.fly.BaseURL, f.fly.App)
+}
+
+func (f *FlyServers) machineUrl(machineId string) string {
+	return fmt.Sprintf("%s/%s", f.machinesUrl(), machineId)
+}
 
-    machineResponse := MachineCreateResponse{}
-    b, err := io.ReadAll(res.Body)
-    if err != nil {
-        return nil, err
-    }
-    fmt.Printf("Machine: %s -- %d\n", string(b), res.StatusCode)
-    err = json.Unmarshal(b, &machineResponse)
-    if err != nil {
-        return nil, err
-    }
+func (f *FlyServers) machineWaitUrl(machineId string, state string) string {
+	return fmt.Sprintf("%s/wait?state=%s&timeout=%d", f.machineUrl(machineId), url.QueryEscape(state), flyWaitTimeoutSeconds)
+}
+
+func (f *FlyServers) machineStopUrl(machineId string) string {
+	return fmt.Sprintf("%s/stop", f.machineUrl(machineId))
+}
 
-    return &machineResponse, nil
+func (f *FlyServers) machineDestroyUrl(machineId string) string {
+	return fmt.Sprintf("%s?force=true", f.machineUrl(machineId))
 }
 
-func getMachine(machineId string) (string, error) {
-	r, err := http.NewRequest("GET", machine(machineId), bytes.NewBuffer([]byte{}))
+// do sends the request and decodes the response into out when out is not
+// nil.  Anything but a 2xx is a FlyRequestFailed with the status attached
+func (f *FlyServers) do(ctx context.Context, method string, url string, body any, out any) (int, error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
-        return "", err
+		return 0, err
 	}
 
 	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("FLY_IO_ORG_TOKEN")))
+	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", f.fly.Token))
 
-	client := &http.Client{}
-	res, err := client.Do(r)
+	res, err := f.client.Do(r)
 	if err != nil {
-        return "", err
+		return 0, err
 	}
-
 	defer res.Body.Close()
 
-    b, err := io.ReadAll(res.Body)
-    if err != nil {
-        return "", err;
-    }
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
 
-    return string(b), err
-}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("%w: %s %s returned %d: %s", FlyRequestFailed, method, url, res.StatusCode, strings.TrimSpace(string(b)))
+	}
 
-func stopMachine(machineId string) (string, error) {
-	r, err := http.NewRequest("POST", machineStop(machineId), bytes.NewBuffer([]byte{}))
-	if err != nil {
-        return "", err
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return res.StatusCode, err
+		}
 	}
+	return res.StatusCode, nil
+}
 
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("FLY_IO_ORG_TOKEN")))
+func (f *FlyServers) image(gameType string) (string, error) {
+	if gameType == "" {
+		return f.fly.Image, nil
+	}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil {
-        return "", err
+	image, ok := f.fly.Images[gameType]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", UnknownGameType, gameType)
 	}
+	return image, nil
+}
 
-	defer res.Body.Close()
+func newServerId() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	assert.NoError(err, "unable to read random bytes for a server id")
+	return hex.EncodeToString(id)
+}
 
-    b, err := io.ReadAll(res.Body)
-    if err != nil {
-        return "", err;
-    }
+func (f *FlyServers) machineConfig(id string, image string, req gameserverstats.MatchRequest, region string) MachineConfig {
+	env := map[string]string{}
+	for k, v := range f.fly.Env {
+		env[k] = v
+	}
+	env["ID"] = id
+	env["GAME_TYPE"] = req.GameType
+	env["REGION"] = region
+	env["PRIVATE"] = fmt.Sprintf("%v", req.Private)
+
+	return MachineConfig{
+		Image: image,
+		Env:   env,
+		Guest: MachineGuest{
+			CPUKind:  f.fly.CPUKind,
+			CPUs:     f.fly.CPUs,
+			MemoryMB: f.fly.MemoryMB,
+		},
+		Restart:     MachineRestart{Policy: "no"},
+		AutoDestroy: true,
+	}
+}
 
-    return string(b), err
+func (f *FlyServers) ListServers(req gameserverstats.MatchRequest) []gameserverstats.GameServerConfig {
+	servers := f.stats.GetServersByUtilization(float64(f.params.MaxLoad))
+	return slices.DeleteFunc(servers, func(gs gameserverstats.GameServerConfig) bool {
+		return !req.Matches(&gs)
+	})
 }
 
-func startMachine(machineId string) (string, error) {
-	r, err := http.NewRequest("POST", machineStart(machineId), bytes.NewBuffer([]byte{}))
+func (f *FlyServers) CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error) {
+	region := req.Region
+	if region == "" {
+		region = f.fly.Region
+	}
+
+	image, err := f.image(req.GameType)
 	if err != nil {
-        return "", err
+		return "", err
 	}
 
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("FLY_IO_ORG_TOKEN")))
+	id := newServerId()
+	create := MachineCreateRequest{
+		Name:   id,
+		Region: region,
+		Config: f.machineConfig(id, image, req, region),
+	}
+
+	machine := Machine{}
+	if _, err := f.do(ctx, "POST", f.machinesUrl(), create, &machine); err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	f.machines[id] = machine
+	f.mutex.Unlock()
+
+	f.logger.Info("created machine", "id", id, "machine", machine.String())
+	return id, nil
+}
+
+func (f *FlyServers) machine(id string) (Machine, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	machine, ok := f.machines[id]
+	if !ok {
+		return Machine{}, fmt.Errorf("%w: no fly machine for %s", ErrServerNotFound, id)
+	}
+	return machine, nil
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
+// WaitForReady waits for the machine to start and then for the game server
+// on it to report itself ready, see LocalServers.WaitForReady for the errors
+func (f *FlyServers) WaitForReady(ctx context.Context, id string) error {
+	machine, err := f.machine(id)
 	if err != nil {
-        return "", err
+		return err
 	}
 
-	defer res.Body.Close()
+	for {
+		status, err := f.do(ctx, "GET", f.machineWaitUrl(machine.Id, "started"), nil, nil)
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil {
+			return readyError(ctx, id)
+		}
 
-    b, err := io.ReadAll(res.Body)
-    if err != nil {
-        return "", err;
-    }
+		// the wait itself timed out, the machine can still be starting
+		if status != http.StatusRequestTimeout {
+			return err
+		}
+	}
+
+	return waitForState(ctx, f.stats, id)
+}
 
-    return string(b), err
+func (f *FlyServers) Watch(ctx context.Context) <-chan gameserverstats.GameServerEvent {
+	return f.stats.Watch(ctx)
 }
 
-func destroyMachine(machineId string) (string, error) {
-	r, err := http.NewRequest("DELETE", machineDestroy(machineId), bytes.NewBuffer([]byte{}))
+// GetConnectionString is the machine's address on the fly private network
+func (f *FlyServers) GetConnectionString(id string) (string, error) {
+	machine, err := f.machine(id)
 	if err != nil {
-        return "", err
+		return "", err
 	}
 
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("FLY_IO_ORG_TOKEN")))
+	port := f.fly.InternalPort
+	if gs := f.stats.GetById(id); gs != nil && gs.Port != 0 {
+		port = gs.Port
+	}
+	return net.JoinHostPort(machine.PrivateIP, strconv.Itoa(port)), nil
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
+// Destroy stops the machine and removes it, the game server is marked as
+// closed so it is never handed out again
+func (f *FlyServers) Destroy(ctx context.Context, id string) error {
+	machine, err := f.machine(id)
 	if err != nil {
-        return "", err
+		return err
 	}
 
-	defer res.Body.Close()
+	if _, err := f.do(ctx, "POST", f.machineStopUrl(machine.Id), nil, nil); err != nil {
+		f.logger.Warn("unable to stop machine, destroying it anyways", "id", id, "error", err)
+	}
 
-    b, err := io.ReadAll(res.Body)
-    if err != nil {
-        return "", err;
-    }
+	if status, err := f.do(ctx, "DELETE", f.machineDestroyUrl(machine.Id), nil, nil); err != nil && status != http.StatusNotFound {
+		return err
+	}
+
+	f.mutex.Lock()
+	delete(f.machines, id)
+	f.mutex.Unlock()
 
-    return string(b), err
+	markClosed(f.stats, f.logger)(id, nil)
+	f.logger.Info("destroyed machine", "id", id, "machine", machine.String())
+	return nil
 }
 
+// Close destroys every machine that was created
+func (f *FlyServers) Close() {
+	f.mutex.Lock()
+	ids := make([]string, 0, len(f.machines))
+	for id := range f.machines {
+		ids = append(ids, id)
+	}
+	f.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	for _, id := range ids {
+		if err := f.Destroy(ctx, id); err != nil {
+			f.logger.Error("unable to destroy machine", "id", id, "error", err)
+		}
+	}
+}
+
+func (f *FlyServers) String() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	machines := []string{}
+	for id, m := range f.machines {
+		machines = append(machines, fmt.Sprintf("%s: %s", id, m.String()))
+	}
+	slices.Sort(machines)
+	return strings.Join(machines, "\n")
+}
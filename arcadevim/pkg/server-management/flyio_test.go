@@ -0,0 +1,312 @@
+package servermanagement_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+const flyToken = "fly-token"
+
+// fakeMachines is a stand in for api.machines.dev that only knows about the
+// endpoints FlyServers uses
+type fakeMachines struct {
+	t     *testing.T
+	mutex sync.Mutex
+
+	machines  map[string]servermanagement.Machine
+	creates   []servermanagement.MachineCreateRequest
+	stopped   []string
+	destroyed []string
+
+	// how many wait requests time out before the machine is started
+	waitTimeouts int
+	failCreate   bool
+}
+
+func newFakeMachines(t *testing.T) (*fakeMachines, *httptest.Server) {
+	f := &fakeMachines{
+		t:        t,
+		machines: map[string]servermanagement.Machine{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeMachines) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+flyToken {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/v1/apps/test-app/machines")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == "POST" && parts[0] == "":
+		f.create(w, r)
+	case r.Method == "GET" && len(parts) == 2 && parts[1] == "wait":
+		f.wait(w, r, parts[0])
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "stop":
+		f.stop(w, parts[0])
+	case r.Method == "DELETE" && len(parts) == 1:
+		require.Equal(f.t, "true", r.URL.Query().Get("force"))
+		f.destroy(w, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeMachines) create(w http.ResponseWriter, r *http.Request) {
+	if f.failCreate {
+		http.Error(w, `{"error":"no capacity in region"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	require.NoError(f.t, err)
+
+	// nothing may be exposed to the internet
+	raw := struct {
+		Config map[string]json.RawMessage `json:"config"`
+	}{}
+	require.NoError(f.t, json.Unmarshal(body, &raw))
+	require.NotContains(f.t, raw.Config, "services")
+
+	req := servermanagement.MachineCreateRequest{}
+	require.NoError(f.t, json.Unmarshal(body, &req))
+	f.creates = append(f.creates, req)
+
+	machine := servermanagement.Machine{
+		Id:        fmt.Sprintf("machine-%d", len(f.creates)),
+		Name:      req.Name,
+		State:     "created",
+		Region:    req.Region,
+		PrivateIP: fmt.Sprintf("fdaa::%d", len(f.creates)),
+	}
+	f.machines[machine.Id] = machine
+	json.NewEncoder(w).Encode(machine)
+}
+
+func (f *fakeMachines) wait(w http.ResponseWriter, r *http.Request, id string) {
+	require.Equal(f.t, "started", r.URL.Query().Get("state"))
+
+	machine, ok := f.machines[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if f.waitTimeouts > 0 {
+		f.waitTimeouts--
+		http.Error(w, `{"error":"deadline_exceeded"}`, http.StatusRequestTimeout)
+		return
+	}
+
+	machine.State = "started"
+	f.machines[id] = machine
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func (f *fakeMachines) stop(w http.ResponseWriter, id string) {
+	f.stopped = append(f.stopped, id)
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func (f *fakeMachines) destroy(w http.ResponseWriter, id string) {
+	if _, ok := f.machines[id]; !ok {
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+		return
+	}
+
+	delete(f.machines, id)
+	f.destroyed = append(f.destroyed, id)
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func (f *fakeMachines) lastCreate() servermanagement.MachineCreateRequest {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	require.NotEmpty(f.t, f.creates)
+	return f.creates[len(f.creates)-1]
+}
+
+func testStats(t *testing.T) *gameserverstats.Memory {
+	return gameserverstats.NewMemory()
+}
+
+func flyParams(url string) servermanagement.FlyParams {
+	return servermanagement.FlyParams{
+		BaseURL:  url,
+		Token:    flyToken,
+		App:      "test-app",
+		Image:    "registry.fly.io/arcadevim:latest",
+		Images:   map[string]string{"vim-arcade": "registry.fly.io/vim-arcade:latest"},
+		Region:   "den",
+		MemoryMB: 512,
+		Env:      map[string]string{"SQLITE": "https://stats.example"},
+	}
+}
+
+// register does what the game server on the machine would do once it is up
+func register(t *testing.T, stats gameserverstats.GSSRetriever, id string, state gameserverstats.State) {
+	require.NoError(t, stats.Update(gameserverstats.GameServerConfig{
+		Id:    id,
+		State: state,
+		Host:  "0.0.0.0",
+		Port:  42069,
+	}))
+}
+
+func TestFlyServersCreate(t *testing.T) {
+	machines, server := newFakeMachines(t)
+	stats := testStats(t)
+	fly := servermanagement.NewFlyServers(stats, servermanagement.ServerParams{MaxLoad: 0.9}, flyParams(server.URL))
+
+	id, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{GameType: "vim-arcade"})
+	require.NoError(t, err)
+
+	create := machines.lastCreate()
+	require.Equal(t, id, create.Name)
+	require.Equal(t, "den", create.Region)
+	require.Equal(t, "registry.fly.io/vim-arcade:latest", create.Config.Image)
+	require.Equal(t, 512, create.Config.Guest.MemoryMB)
+	require.Equal(t, 1, create.Config.Guest.CPUs)
+	require.Equal(t, "shared", create.Config.Guest.CPUKind)
+	require.True(t, create.Config.AutoDestroy)
+	require.Equal(t, map[string]string{
+		"SQLITE":    "https://stats.example",
+		"ID":        id,
+		"GAME_TYPE": "vim-arcade",
+		"REGION":    "den",
+		"PRIVATE":   "false",
+	}, create.Config.Env)
+
+	// the request region wins over the default one
+	id, err = fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{Region: "ams", Private: true})
+	require.NoError(t, err)
+	create = machines.lastCreate()
+	require.Equal(t, "ams", create.Region)
+	require.Equal(t, "registry.fly.io/arcadevim:latest", create.Config.Image)
+	require.Equal(t, "true", create.Config.Env["PRIVATE"])
+	require.Equal(t, "ams", create.Config.Env["REGION"])
+
+	_, err = fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{GameType: "tetris"})
+	require.ErrorIs(t, err, servermanagement.UnknownGameType)
+
+	machines.mutex.Lock()
+	machines.failCreate = true
+	machines.mutex.Unlock()
+	_, err = fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.ErrorIs(t, err, servermanagement.FlyRequestFailed)
+	require.ErrorContains(t, err, "no capacity in region")
+	require.Contains(t, fly.String(), id)
+}
+
+func TestFlyServersBadToken(t *testing.T) {
+	_, server := newFakeMachines(t)
+	params := flyParams(server.URL)
+	params.Token = "wrong"
+	fly := servermanagement.NewFlyServers(testStats(t), servermanagement.ServerParams{}, params)
+
+	_, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.ErrorIs(t, err, servermanagement.FlyRequestFailed)
+	require.ErrorContains(t, err, "401")
+}
+
+func TestFlyServersWaitForReady(t *testing.T) {
+	machines, server := newFakeMachines(t)
+	machines.waitTimeouts = 2
+	stats := testStats(t)
+	fly := servermanagement.NewFlyServers(stats, servermanagement.ServerParams{MaxLoad: 0.9}, flyParams(server.URL))
+
+	id, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.NoError(t, err)
+
+	// started machines are not ready until the game server says so
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, fly.WaitForReady(ctx, id), servermanagement.ErrReadyTimeout)
+
+	machines.mutex.Lock()
+	require.Equal(t, 0, machines.waitTimeouts)
+	require.Equal(t, "started", machines.machines["machine-1"].State)
+	machines.mutex.Unlock()
+
+	register(t, stats, id, gameserverstats.GSStateReady)
+	require.NoError(t, fly.WaitForReady(context.Background(), id))
+
+	addr, err := fly.GetConnectionString(id)
+	require.NoError(t, err)
+	require.Equal(t, "[fdaa::1]:42069", addr)
+
+	servers := fly.ListServers(gameserverstats.MatchRequest{})
+	require.Len(t, servers, 1)
+	require.Equal(t, id, servers[0].Id)
+
+	_, err = fly.GetConnectionString("unknown")
+	require.ErrorIs(t, err, servermanagement.ErrServerNotFound)
+	require.ErrorIs(t, fly.WaitForReady(context.Background(), "unknown"), servermanagement.ErrServerNotFound)
+}
+
+func TestFlyServersConnectionBeforeRegister(t *testing.T) {
+	_, server := newFakeMachines(t)
+	fly := servermanagement.NewFlyServers(testStats(t), servermanagement.ServerParams{}, flyParams(server.URL))
+
+	id, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.NoError(t, err)
+
+	addr, err := fly.GetConnectionString(id)
+	require.NoError(t, err)
+	require.Equal(t, "[fdaa::1]:8080", addr)
+}
+
+func TestFlyServersDestroy(t *testing.T) {
+	machines, server := newFakeMachines(t)
+	stats := testStats(t)
+	fly := servermanagement.NewFlyServers(stats, servermanagement.ServerParams{MaxLoad: 0.9}, flyParams(server.URL))
+
+	first, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.NoError(t, err)
+	second, err := fly.CreateNewServer(context.Background(), gameserverstats.MatchRequest{})
+	require.NoError(t, err)
+	register(t, stats, first, gameserverstats.GSStateReady)
+
+	require.NoError(t, fly.Destroy(context.Background(), first))
+	require.Equal(t, gameserverstats.GSStateClosed, stats.GetById(first).State)
+	require.Empty(t, fly.ListServers(gameserverstats.MatchRequest{}))
+	require.ErrorIs(t, fly.Destroy(context.Background(), first), servermanagement.ErrServerNotFound)
+
+	// a closed server never becomes ready
+	register(t, stats, second, gameserverstats.GSStateClosed)
+	require.ErrorIs(t, fly.WaitForReady(context.Background(), second), servermanagement.ErrServerClosed)
+
+	fly.Close()
+	require.Empty(t, fly.String())
+
+	machines.mutex.Lock()
+	defer machines.mutex.Unlock()
+	require.Equal(t, []string{"machine-1", "machine-2"}, machines.stopped)
+	require.Equal(t, []string{"machine-1", "machine-2"}, machines.destroyed)
+	require.Empty(t, machines.machines)
+	require.NotEqual(t, first, second)
+}
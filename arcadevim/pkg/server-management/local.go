@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
-	"time"
+	"sync/atomic"
 
-	"github.com/khulnasoft/next.vim/arcadevim/pkg/assert"
 	"github.com/khulnasoft/next.vim/arcadevim/pkg/cmd"
 	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
 )
@@ -17,7 +17,9 @@ type LocalServers struct {
 	logger  *slog.Logger
 	stats   gameserverstats.GSSRetriever
 	params  ServerParams
-	servers []*cmd.Cmder
+
+	supervisor *Supervisor
+	autoscaler *Autoscaler
 
 	load        float32
 	connections float32
@@ -29,20 +31,86 @@ func getEnvVars() []string {
 	return []string{
 		fmt.Sprintf("GOPATH=%s", os.Getenv("GOPATH")),
         fmt.Sprintf("SQLITE=%s", os.Getenv("SQLITE")),
+        fmt.Sprintf("CONTROL_PLANE=%s", os.Getenv("CONTROL_PLANE")),
+        fmt.Sprintf("CONTROL_PLANE_TOKEN=%s", os.Getenv("CONTROL_PLANE_TOKEN")),
         fmt.Sprintf("DEBUG_TYPE=%s", os.Getenv("DEBUG_TYPE")),
 	}
 }
 
 func NewLocalServers(stats gameserverstats.GSSRetriever, params ServerParams) LocalServers {
+	logger := slog.Default().With("area", "LocalServers")
 	return LocalServers{
 		stats:                 stats,
 		params:                params,
-		servers:               []*cmd.Cmder{},
-		logger:                slog.Default().With("area", "LocalServers"),
+		supervisor:            NewSupervisor(params.Supervisor, markClosed(stats, logger)).WithTransitions(recordTransition(stats, logger)),
+		autoscaler:            NewAutoscaler(stats, params.Autoscale),
+		logger:                logger,
 		lastTimeNoConnections: false,
 	}
 }
 
+// markClosed makes sure a server that died is never handed out again, a
+// restarted server marks itself ready once it is back up.  A server that died
+// before registering is recorded as closed so nobody waits on it
+func markClosed(stats gameserverstats.GSSRetriever, logger *slog.Logger) ExitFn {
+	return func(id string, err error) {
+		config := stats.GetById(id)
+		if config == nil {
+			config = &gameserverstats.GameServerConfig{Id: id}
+		} else if config.State == gameserverstats.GSStateClosed {
+			return
+		}
+
+		logger.Warn("marking exited server as closed", "id", id, "error", err)
+		config.State = gameserverstats.GSStateClosed
+		if err := stats.Update(*config); err != nil {
+			logger.Error("unable to mark server as closed", "id", id, "error", err)
+		}
+	}
+}
+
+// recordTransition adds what the supervisor does to a server to its
+// lifecycle, a process that is not running is a closed game server
+func recordTransition(stats gameserverstats.GSSRetriever, logger *slog.Logger) TransitionFn {
+	return func(status ProcessStatus, err error) {
+		config := gameserverstats.GameServerConfig{Id: status.Id}
+		if found := stats.GetById(status.Id); found != nil {
+			config = *found
+		}
+
+		reason := status.State.String()
+		switch {
+		case status.State == ProcessRunning && status.Restarts == 0:
+			config.State = gameserverstats.GSStateInitializing
+			reason = "started"
+		case status.State == ProcessRunning:
+			config.State = gameserverstats.GSStateInitializing
+			reason = fmt.Sprintf("restart %d", status.Restarts)
+		default:
+			config.State = gameserverstats.GSStateClosed
+		}
+		if err != nil {
+			reason = fmt.Sprintf("%s: %s", reason, err)
+		}
+
+		event := gameserverstats.NewLifecycleEvent(config, gameserverstats.SourceSupervisor, reason)
+		if err := stats.RecordLifecycleEvent(event); err != nil {
+			logger.Error("unable to record server transition", "id", status.Id, "error", err)
+		}
+	}
+}
+
+// registered is the health check of local servers, once a server has had
+// time to start it has to be in stats
+func (l *LocalServers) registered(id string) HealthCheck {
+	return func(ctx context.Context) error {
+		if l.stats.GetById(id) == nil {
+			return fmt.Errorf("server %s has not registered itself", id)
+		}
+		return nil
+	}
+}
+
 func (l *LocalServers) GetBestServer() (string, error) {
 	servers := l.stats.GetServersByUtilization(float64(l.params.MaxLoad))
 
@@ -55,131 +123,146 @@ func (l *LocalServers) GetBestServer() (string, error) {
 	return servers[0].Id, nil
 }
 
-var id = 0
-
-func (l *LocalServers) CreateNewServer(ctx context.Context) (string, error) {
-    dummyServer := os.Getenv("GAME_SERVER")
-    if dummyServer == "" {
-        dummyServer = "./cmd/api-server/main.go"
-    }
-	outId := id
-    // TODO i bet there is a better way of doing this...
-    // i just don't know other than straight passthrough?
-    // i feel like i need more intelligent passing of logs from inner to outer
-	cmdr := cmd.NewCmder("go", ctx).
-		AddVArgv([]string{"run", dummyServer}).
-		WithOutFn(func(b []byte) (int, error) {
-			fmt.Fprintf(os.Stdout, "%s", string(b))
-			return len(b), nil
-		}).
-		WithErrFn(func(b []byte) (int, error) {
-			fmt.Fprintf(os.Stderr, "%s", string(b))
-			return len(b), nil
-		})
-
-	id++
-
-	go func() {
-        vars := getEnvVars()
-        vars = append(vars,
-            fmt.Sprintf("ID=%d", outId),
-
-            // subprocesses should not have the log file as it will cause odd
-            // log file truncation
-            fmt.Sprintf("DEBUG_LOG="),
-        )
+func (l *LocalServers) ListServers(req gameserverstats.MatchRequest) []gameserverstats.GameServerConfig {
+	servers := l.stats.GetServersByUtilization(float64(l.params.MaxLoad))
+	return slices.DeleteFunc(servers, func(gs gameserverstats.GameServerConfig) bool {
+		return !req.Matches(&gs)
+	})
+}
 
-		err := cmdr.Run(vars)
-        cancelled := false
-        select {
-        case <-ctx.Done():
-            cancelled = true
-        default:
-        }
-
-		if cancelled {
-			l.logger.Error("cmdr context killed")
-        } else if !cancelled && err != nil {
-			l.logger.Error("unable to run cmdr", "err", err)
+func (l *LocalServers) gameServer(gameType string) (string, error) {
+	if gameType == "" {
+		dummyServer := os.Getenv("GAME_SERVER")
+		if dummyServer == "" {
+			dummyServer = "./cmd/api-server/main.go"
 		}
+		return dummyServer, nil
+	}
 
-		// TODO the database checking to prove that this commander has closed
-		// properly
-		done := false
-		select {
-		case <-ctx.Done():
-			done = true
-		default:
-            config := l.stats.GetById(fmt.Sprintf("%d", outId))
-            if config != nil {
-                done = config.State == gameserverstats.GSStateClosed
-            }
+	server, ok := l.params.GameServers[gameType]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", UnknownGameType, gameType)
+	}
+	return server, nil
+}
+
+// servers are created from concurrent matchmaking requests
+var id atomic.Int64
+
+func (l *LocalServers) CreateNewServer(ctx context.Context, req gameserverstats.MatchRequest) (string, error) {
+	if req.Region != "" && l.params.Region != "" && req.Region != l.params.Region {
+		return "", fmt.Errorf("%w: asked for %s, servers are in %s", WrongRegion, req.Region, l.params.Region)
+	}
+
+	region := req.Region
+	if region == "" {
+		region = l.params.Region
+	}
+
+	dummyServer, err := l.gameServer(req.GameType)
+	if err != nil {
+		return "", err
+	}
+
+	outId := id.Add(1) - 1
+	serverId := fmt.Sprintf("%d", outId)
+
+	vars := getEnvVars()
+	vars = append(vars,
+		fmt.Sprintf("ID=%d", outId),
+		fmt.Sprintf("GAME_TYPE=%s", req.GameType),
+		fmt.Sprintf("REGION=%s", region),
+		fmt.Sprintf("PRIVATE=%v", req.Private),
+
+		// subprocesses should not have the log file as it will cause odd
+		// log file truncation
+		fmt.Sprintf("DEBUG_LOG="),
+	)
+
+	// every restart needs a fresh cmder, they can only be ran once
+	run := func(ctx context.Context) error {
+		// TODO i bet there is a better way of doing this...
+		// i just don't know other than straight passthrough?
+		// i feel like i need more intelligent passing of logs from inner to outer
+		cmdr := cmd.NewCmder("go", ctx).
+			AddVArgv([]string{"run", dummyServer}).
+			WithOutFn(func(b []byte) (int, error) {
+				fmt.Fprintf(os.Stdout, "%s", string(b))
+				return len(b), nil
+			}).
+			WithErrFn(func(b []byte) (int, error) {
+				fmt.Fprintf(os.Stderr, "%s", string(b))
+				return len(b), nil
+			})
+
+		err := cmdr.Run(vars)
+		if err != nil || ctx.Err() != nil {
+			return err
 		}
 
-		if !done {
-			assert.Never("cmdr has closed unexpectedly", "id", outId)
+		// a clean exit is only clean if the server said it was closing
+		config := l.stats.GetById(serverId)
+		if config == nil || config.State != gameserverstats.GSStateClosed {
+			return ServerExitedOpen
 		}
-	}()
+		return nil
+	}
 
-	l.servers = append(l.servers, cmdr)
-	return fmt.Sprintf("%d", outId), nil
+	l.supervisor.Start(ctx, serverId, run, l.registered(serverId))
+	return serverId, nil
 }
 
-// TODO Add timeout...?
+func (l *LocalServers) Status(id string) (ProcessStatus, bool) {
+	return l.supervisor.Status(id)
+}
+
+// WaitForReady waits until ctx is done for the server to report itself
+// ready.  A server that closes or whose process gives up first is an
+// ErrServerClosed
 func (l *LocalServers) WaitForReady(ctx context.Context, id string) error {
-	for {
-		time.Sleep(time.Millisecond * 50)
-
-		gs := l.stats.GetById(id)
-		l.logger.Info("WaitForReady", "id", id, "gs", gs)
-		if gs != nil {
-			if gs.State == gameserverstats.GSStateReady {
-				return nil
-			} else if gs.State == gameserverstats.GSStateClosed {
-				// TODO Add closed error
-				return nil
-			}
-		}
+	if _, ok := l.supervisor.Status(id); !ok && l.stats.GetById(id) == nil {
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
 	}
+
+	err := waitForState(ctx, l.stats, id)
+	l.logger.Info("WaitForReady", "id", id, "error", err)
+	return err
+}
+
+func (l *LocalServers) Watch(ctx context.Context) <-chan gameserverstats.GameServerEvent {
+	return l.stats.Watch(ctx)
 }
 
 func (l *LocalServers) GetConnectionString(id string) (string, error) {
 	gs := l.stats.GetById(id)
 	if gs == nil {
-		// TODO Handle DNE error
-		return "", nil
+		return "", fmt.Errorf("%w: %s", ErrServerNotFound, id)
 	}
 	return fmt.Sprintf("%s:%d", gs.Host, gs.Port), nil
 }
 
-func (l *LocalServers) refresh(ctx context.Context) {
+// Destroy kills the server process, it is never restarted
+func (l *LocalServers) Destroy(ctx context.Context, id string) error {
+	if _, ok := l.supervisor.Status(id); !ok {
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+
+	l.supervisor.Stop(id)
+	markClosed(l.stats, l.logger)(id, nil)
+	return nil
 }
 
+// Run autoscales the servers until ctx is cancelled
 func (l *LocalServers) Run(ctx context.Context) {
-
-	// TODO(v1) make this configurable
-	timer := time.NewTicker(time.Second * 30)
-	defer timer.Stop()
-
-outer:
-	for {
-		select {
-		case <-ctx.Done():
-			break outer
-		case <-timer.C:
-			l.refresh(ctx)
-		}
-	}
+	l.autoscaler.Run(ctx, l)
 }
 
-func (l *LocalServers) Close() {
-	for _, c := range l.servers {
-		c.Close()
-	}
+func (l *LocalServers) Autoscaler() *Autoscaler {
+	return l.autoscaler
 }
 
-func (l *LocalServers) Ready() {
-	// TODO i should maybe create one server IF there are no servers
+func (l *LocalServers) Close() {
+	l.supervisor.Close()
 }
 
 func (l *LocalServers) String() string {
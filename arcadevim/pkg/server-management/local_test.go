@@ -0,0 +1,54 @@
+package servermanagement_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+func TestLocalServersErrors(t *testing.T) {
+	stats := testStats(t)
+	local := servermanagement.NewLocalServers(stats, servermanagement.ServerParams{})
+	defer local.Close()
+
+	_, err := local.GetConnectionString("missing")
+	require.ErrorIs(t, err, servermanagement.ErrServerNotFound)
+	require.ErrorIs(t, local.WaitForReady(context.Background(), "missing"), servermanagement.ErrServerNotFound)
+	require.ErrorIs(t, local.Destroy(context.Background(), "missing"), servermanagement.ErrServerNotFound)
+
+	register(t, stats, "starting", gameserverstats.GSStateInitializing)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, local.WaitForReady(ctx, "starting"), servermanagement.ErrReadyTimeout)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, local.WaitForReady(ctx, "starting"), context.Canceled)
+
+	register(t, stats, "closed", gameserverstats.GSStateClosed)
+	require.ErrorIs(t, local.WaitForReady(context.Background(), "closed"), servermanagement.ErrServerClosed)
+
+	// becoming ready wakes up whoever is waiting
+	ready := make(chan error, 1)
+	go func() {
+		ready <- local.WaitForReady(context.Background(), "starting")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	register(t, stats, "starting", gameserverstats.GSStateReady)
+	select {
+	case err := <-ready:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "WaitForReady never saw the server become ready")
+	}
+
+	register(t, stats, "ready", gameserverstats.GSStateReady)
+	require.NoError(t, local.WaitForReady(context.Background(), "ready"))
+	addr, err := local.GetConnectionString("ready")
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0:42069", addr)
+}
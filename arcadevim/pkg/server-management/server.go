@@ -1,9 +1,73 @@
 package servermanagement
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	gameserverstats "github.com/khulnasoft/next.vim/arcadevim/pkg/game-server-stats"
+)
 
 var NoBestServer = errors.New("no best server found")
+var UnknownGameType = errors.New("no game server is configured for the game type")
+var WrongRegion = errors.New("game servers cannot be created in the requested region")
+var ServerExitedOpen = errors.New("game server exited without closing")
+
+var ErrServerClosed = errors.New("game server closed before it was ready")
+var ErrServerNotFound = errors.New("game server not found")
+var ErrReadyTimeout = errors.New("timed out waiting for the game server to be ready")
 
 type ServerParams struct {
     MaxLoad float32
+
+    // game type to the game server to run for it, a request without a game
+    // type runs the default server
+    GameServers map[string]string
+
+    // where the servers are created, empty accepts any region asked for
+    Region string
+
+    // what happens when a server process dies
+    Supervisor SupervisorParams
+
+    // the zero value leaves the fleet alone
+    Autoscale AutoscalerParams
+}
+
+// readyError is what WaitForReady returns once ctx is done, running out of
+// time is an ErrReadyTimeout
+func readyError(ctx context.Context, id string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrReadyTimeout, id)
+	}
+	return ctx.Err()
+}
+
+// waitForState waits on stats for the game server to be ready or closed, the
+// watch is started before the first read so no change is missed
+func waitForState(ctx context.Context, stats gameserverstats.GSSRetriever, id string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := stats.Watch(ctx)
+	gs := stats.GetById(id)
+	for {
+		if gs != nil && gs.State == gameserverstats.GSStateReady {
+			return nil
+		} else if gs != nil && gs.State == gameserverstats.GSStateClosed {
+			return fmt.Errorf("%w: %s", ErrServerClosed, id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return readyError(ctx, id)
+		case e, ok := <-events:
+			if !ok {
+				return readyError(ctx, id)
+			}
+			if e.Current.Id == id {
+				gs = &e.Current
+			}
+		}
+	}
 }
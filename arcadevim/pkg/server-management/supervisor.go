@@ -0,0 +1,343 @@
+package servermanagement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ProcessUnhealthy = errors.New("process failed its health checks")
+var ProcessCrashLooping = errors.New("process is crash looping")
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+type ProcessState int
+
+const (
+	ProcessRunning ProcessState = iota
+	// waiting out the backoff before being restarted
+	ProcessRestarting
+	ProcessStopped
+	// restarted too often in too short of a time, it will not be restarted
+	ProcessCrashLoop
+)
+
+func (p ProcessState) String() string {
+	switch p {
+	case ProcessRunning:
+		return "running"
+	case ProcessRestarting:
+		return "restarting"
+	case ProcessStopped:
+		return "stopped"
+	case ProcessCrashLoop:
+		return "crash-loop"
+	default:
+		return "unknown"
+	}
+}
+
+type SupervisorParams struct {
+	// empty is RestartNever
+	Restart RestartPolicy
+
+	// the first restart waits BackoffMS and every restart after that doubles
+	// it up to MaxBackoffMS.  A process that stays up for the crash loop
+	// window starts over at BackoffMS
+	BackoffMS    int64
+	MaxBackoffMS int64
+
+	// more than CrashLoopRestarts restarts within CrashLoopWindowMS and the
+	// process is given up on.  0 never gives up
+	CrashLoopRestarts int
+	CrashLoopWindowMS int64
+
+	// the process is killed after HealthCheckFailures checks in a row fail.
+	// 0 disables health checks
+	HealthCheckIntervalMS int64
+	HealthCheckFailures   int
+}
+
+func (s SupervisorParams) withDefaults() SupervisorParams {
+	if s.Restart == "" {
+		s.Restart = RestartNever
+	}
+	if s.BackoffMS == 0 {
+		s.BackoffMS = 500
+	}
+	if s.MaxBackoffMS == 0 {
+		s.MaxBackoffMS = 30000
+	}
+	if s.CrashLoopWindowMS == 0 {
+		s.CrashLoopWindowMS = 60000
+	}
+	if s.HealthCheckFailures == 0 {
+		s.HealthCheckFailures = 3
+	}
+	return s
+}
+
+// RunFn runs the process until it exits, cancelling ctx has to stop it
+type RunFn func(ctx context.Context) error
+
+// HealthCheck is called every health check interval while the process runs
+type HealthCheck func(ctx context.Context) error
+
+// ExitFn is called every time a process exits while it is being supervised,
+// err is nil when the process exited cleanly
+type ExitFn func(id string, err error)
+
+// TransitionFn is called every time a supervised process changes state, err
+// is what caused the change and nil when nothing went wrong
+type TransitionFn func(status ProcessStatus, err error)
+
+type ProcessStatus struct {
+	Id       string
+	State    ProcessState
+	Restarts int
+	LastErr  error
+}
+
+func (p ProcessStatus) String() string {
+	return fmt.Sprintf("Process(%s): State=%s Restarts=%d LastErr=%v", p.Id, p.State, p.Restarts, p.LastErr)
+}
+
+type supervised struct {
+	id     string
+	run    RunFn
+	health HealthCheck
+	cancel context.CancelFunc
+
+	status ProcessStatus
+}
+
+// Supervisor keeps processes running according to their restart policy.  A
+// process dying is never fatal to the supervisor
+type Supervisor struct {
+	params       SupervisorParams
+	onExit       ExitFn
+	onTransition TransitionFn
+	logger       *slog.Logger
+
+	mutex sync.Mutex
+	procs map[string]*supervised
+	wait  sync.WaitGroup
+}
+
+func NewSupervisor(params SupervisorParams, onExit ExitFn) *Supervisor {
+	if onExit == nil {
+		onExit = func(string, error) {}
+	}
+
+	return &Supervisor{
+		params:       params.withDefaults(),
+		onExit:       onExit,
+		onTransition: func(ProcessStatus, error) {},
+		logger:       slog.Default().With("area", "Supervisor"),
+		mutex:        sync.Mutex{},
+		procs:        map[string]*supervised{},
+	}
+}
+
+func (s *Supervisor) WithTransitions(fn TransitionFn) *Supervisor {
+	s.onTransition = fn
+	return s
+}
+
+// Start runs the process until ctx is cancelled or the restart policy gives
+// up on it.  health may be nil
+func (s *Supervisor) Start(ctx context.Context, id string, run RunFn, health HealthCheck) {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &supervised{
+		id:     id,
+		run:    run,
+		health: health,
+		cancel: cancel,
+		status: ProcessStatus{Id: id, State: ProcessRunning},
+	}
+
+	s.mutex.Lock()
+	s.procs[id] = p
+	s.mutex.Unlock()
+	s.onTransition(p.status, nil)
+
+	s.wait.Add(1)
+	go s.supervise(ctx, p)
+}
+
+func (s *Supervisor) Status(id string) (ProcessStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.procs[id]
+	if !ok {
+		return ProcessStatus{}, false
+	}
+	return p.status, true
+}
+
+// Stop kills the process and never restarts it
+func (s *Supervisor) Stop(id string) {
+	s.mutex.Lock()
+	p, ok := s.procs[id]
+	s.mutex.Unlock()
+
+	if ok {
+		p.cancel()
+	}
+}
+
+// Close stops every process and waits for them to exit
+func (s *Supervisor) Close() {
+	s.mutex.Lock()
+	for _, p := range s.procs {
+		p.cancel()
+	}
+	s.mutex.Unlock()
+
+	s.wait.Wait()
+}
+
+func (s *Supervisor) setStatus(p *supervised, state ProcessState, err error) {
+	s.mutex.Lock()
+	p.status.State = state
+	if err != nil {
+		p.status.LastErr = err
+	}
+	status := p.status
+	s.mutex.Unlock()
+
+	s.onTransition(status, err)
+}
+
+func (s *Supervisor) shouldRestart(err error) bool {
+	switch s.params.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+func (s *Supervisor) supervise(ctx context.Context, p *supervised) {
+	defer s.wait.Done()
+
+	window := time.Millisecond * time.Duration(s.params.CrashLoopWindowMS)
+	backoff := time.Millisecond * time.Duration(s.params.BackoffMS)
+	restarts := []time.Time{}
+
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx, p)
+
+		if ctx.Err() != nil {
+			s.logger.Info("process stopped", "id", p.id)
+			s.setStatus(p, ProcessStopped, nil)
+			return
+		}
+
+		if err != nil {
+			s.logger.Error("process exited unexpectedly", "id", p.id, "error", err, "uptime", time.Since(started))
+		} else {
+			s.logger.Info("process exited", "id", p.id, "uptime", time.Since(started))
+		}
+		s.onExit(p.id, err)
+
+		if !s.shouldRestart(err) {
+			s.setStatus(p, ProcessStopped, err)
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(started) >= window {
+			backoff = time.Millisecond * time.Duration(s.params.BackoffMS)
+		}
+
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > window {
+			restarts = restarts[1:]
+		}
+
+		if s.params.CrashLoopRestarts > 0 && len(restarts) > s.params.CrashLoopRestarts {
+			s.logger.Error("process is crash looping, giving up", "id", p.id, "restarts", len(restarts), "window", window)
+			s.setStatus(p, ProcessCrashLoop, errors.Join(ProcessCrashLooping, err))
+			return
+		}
+
+		s.logger.Warn("restarting process", "id", p.id, "backoff", backoff)
+		s.setStatus(p, ProcessRestarting, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.setStatus(p, ProcessStopped, nil)
+			return
+		}
+
+		backoff = min(backoff*2, time.Millisecond*time.Duration(s.params.MaxBackoffMS))
+
+		s.mutex.Lock()
+		p.status.Restarts++
+		p.status.State = ProcessRunning
+		status := p.status
+		s.mutex.Unlock()
+		s.onTransition(status, nil)
+	}
+}
+
+// runOnce runs the process with its health checks, an unhealthy process is
+// killed and reported as ProcessUnhealthy
+func (s *Supervisor) runOnce(ctx context.Context, p *supervised) error {
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if p.health != nil && s.params.HealthCheckIntervalMS > 0 {
+		go s.checkHealth(runCtx, cancel, p)
+	}
+
+	err := p.run(runCtx)
+	if cause := context.Cause(runCtx); errors.Is(cause, ProcessUnhealthy) {
+		return cause
+	}
+	return err
+}
+
+func (s *Supervisor) checkHealth(ctx context.Context, kill context.CancelCauseFunc, p *supervised) {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(s.params.HealthCheckIntervalMS))
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := p.health(ctx)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		s.logger.Warn("health check failed", "id", p.id, "error", err, "failures", failures)
+		if failures >= s.params.HealthCheckFailures {
+			kill(errors.Join(ProcessUnhealthy, err))
+			return
+		}
+	}
+}
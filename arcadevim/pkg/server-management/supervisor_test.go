@@ -0,0 +1,219 @@
+package servermanagement_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	servermanagement "github.com/khulnasoft/next.vim/arcadevim/pkg/server-management"
+)
+
+var crashed = errors.New("crashed")
+
+type exits struct {
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (e *exits) onExit(id string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.errs = append(e.errs, err)
+}
+
+func (e *exits) count() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.errs)
+}
+
+// exitAfter runs for the given amount of time and then exits with err
+func exitAfter(runs *int, mutex *sync.Mutex, d time.Duration, err error) servermanagement.RunFn {
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		*runs++
+		mutex.Unlock()
+
+		select {
+		case <-time.After(d):
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func fastParams(restart servermanagement.RestartPolicy) servermanagement.SupervisorParams {
+	return servermanagement.SupervisorParams{
+		Restart:      restart,
+		BackoffMS:    1,
+		MaxBackoffMS: 5,
+	}
+}
+
+func requireState(t *testing.T, s *servermanagement.Supervisor, id string, state servermanagement.ProcessState) servermanagement.ProcessStatus {
+	var status servermanagement.ProcessStatus
+	require.Eventually(t, func() bool {
+		var ok bool
+		status, ok = s.Status(id)
+		return ok && status.State == state
+	}, time.Second, time.Millisecond)
+	return status
+}
+
+func TestSupervisorRestartNever(t *testing.T) {
+	e := &exits{}
+	s := servermanagement.NewSupervisor(fastParams(servermanagement.RestartNever), e.onExit)
+	defer s.Close()
+
+	runs, mutex := 0, sync.Mutex{}
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, 0, crashed), nil)
+
+	status := requireState(t, s, "0", servermanagement.ProcessStopped)
+	require.ErrorIs(t, status.LastErr, crashed)
+	require.Equal(t, 0, status.Restarts)
+	require.Equal(t, 1, e.count())
+}
+
+func TestSupervisorRestartOnFailure(t *testing.T) {
+	e := &exits{}
+	s := servermanagement.NewSupervisor(fastParams(servermanagement.RestartOnFailure), e.onExit)
+	defer s.Close()
+
+	runs, mutex := 0, sync.Mutex{}
+	run := func(ctx context.Context) error {
+		mutex.Lock()
+		runs++
+		current := runs
+		mutex.Unlock()
+
+		if current < 3 {
+			return crashed
+		}
+		return nil
+	}
+	s.Start(context.Background(), "0", run, nil)
+
+	// a clean exit is not a failure and is left alone
+	status := requireState(t, s, "0", servermanagement.ProcessStopped)
+	require.Equal(t, 2, status.Restarts)
+	require.ErrorIs(t, status.LastErr, crashed)
+	require.Equal(t, 3, e.count())
+}
+
+func TestSupervisorRestartAlways(t *testing.T) {
+	e := &exits{}
+	s := servermanagement.NewSupervisor(fastParams(servermanagement.RestartAlways), e.onExit)
+
+	runs, mutex := 0, sync.Mutex{}
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, time.Millisecond, nil), nil)
+
+	require.Eventually(t, func() bool {
+		return e.count() >= 3
+	}, time.Second, time.Millisecond)
+
+	s.Close()
+	status, ok := s.Status("0")
+	require.True(t, ok)
+	require.Equal(t, servermanagement.ProcessStopped, status.State)
+	require.GreaterOrEqual(t, status.Restarts, 2)
+}
+
+func TestSupervisorCrashLoop(t *testing.T) {
+	params := fastParams(servermanagement.RestartAlways)
+	params.CrashLoopRestarts = 3
+	params.CrashLoopWindowMS = 10000
+
+	e := &exits{}
+	s := servermanagement.NewSupervisor(params, e.onExit)
+	defer s.Close()
+
+	runs, mutex := 0, sync.Mutex{}
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, 0, crashed), nil)
+
+	status := requireState(t, s, "0", servermanagement.ProcessCrashLoop)
+	require.ErrorIs(t, status.LastErr, servermanagement.ProcessCrashLooping)
+	require.ErrorIs(t, status.LastErr, crashed)
+	require.Equal(t, 3, status.Restarts)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, 4, runs)
+}
+
+func TestSupervisorUnhealthy(t *testing.T) {
+	params := fastParams(servermanagement.RestartNever)
+	params.HealthCheckIntervalMS = 1
+	params.HealthCheckFailures = 2
+
+	e := &exits{}
+	s := servermanagement.NewSupervisor(params, e.onExit)
+	defer s.Close()
+
+	runs, mutex := 0, sync.Mutex{}
+	health := func(ctx context.Context) error {
+		return errors.New("not registered")
+	}
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, time.Minute, nil), health)
+
+	status := requireState(t, s, "0", servermanagement.ProcessStopped)
+	require.ErrorIs(t, status.LastErr, servermanagement.ProcessUnhealthy)
+	require.Equal(t, 1, e.count())
+}
+
+func TestSupervisorStop(t *testing.T) {
+	e := &exits{}
+	s := servermanagement.NewSupervisor(fastParams(servermanagement.RestartAlways), e.onExit)
+	defer s.Close()
+
+	runs, mutex := 0, sync.Mutex{}
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, time.Minute, nil), nil)
+	requireState(t, s, "0", servermanagement.ProcessRunning)
+
+	s.Stop("0")
+	status := requireState(t, s, "0", servermanagement.ProcessStopped)
+	require.NoError(t, status.LastErr)
+
+	// being stopped is not an exit the owner has to clean up after
+	require.Equal(t, 0, e.count())
+
+	_, ok := s.Status("1")
+	require.False(t, ok)
+}
+
+func TestSupervisorTransitions(t *testing.T) {
+	params := fastParams(servermanagement.RestartOnFailure)
+	params.CrashLoopRestarts = 1
+	params.CrashLoopWindowMS = 10000
+
+	mutex := sync.Mutex{}
+	states := []servermanagement.ProcessState{}
+	errs := []error{}
+	s := servermanagement.NewSupervisor(params, nil).WithTransitions(func(status servermanagement.ProcessStatus, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, status.State)
+		errs = append(errs, err)
+	})
+	defer s.Close()
+
+	runs := 0
+	s.Start(context.Background(), "0", exitAfter(&runs, &mutex, 0, crashed), nil)
+	requireState(t, s, "0", servermanagement.ProcessCrashLoop)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []servermanagement.ProcessState{
+		servermanagement.ProcessRunning,
+		servermanagement.ProcessRestarting,
+		servermanagement.ProcessRunning,
+		servermanagement.ProcessCrashLoop,
+	}, states)
+	require.Nil(t, errs[0])
+	require.ErrorIs(t, errs[1], crashed)
+	require.Nil(t, errs[2])
+	require.ErrorIs(t, errs[3], servermanagement.ProcessCrashLooping)
+}